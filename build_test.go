@@ -0,0 +1,200 @@
+package go_kd_segment_tree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestTree_ParallelBuild(t *testing.T) {
+	rnd := rand.New(rand.NewSource(20))
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "tag": DimTypeDiscrete, "age": DimTypeReal, "score": DimTypeReal}
+
+	randRect := func() Rect {
+		rect := Rect{}
+		switch rnd.Intn(3) {
+		case 0:
+			rect["country"] = Measures{MeasureString(fmt.Sprint("c", rnd.Intn(6)))}
+		case 1:
+			rect["country"] = ExcludedMeasures{MeasureString(fmt.Sprint("c", rnd.Intn(6)))}
+		}
+		if rnd.Intn(2) == 0 {
+			rect["tag"] = Measures{MeasureInt(rnd.Intn(10)), MeasureInt(rnd.Intn(10))}
+		}
+		if rnd.Intn(3) > 0 {
+			// few distinct bounds, so that ties are broken
+			from := rnd.Intn(10) * 10
+			rect["age"] = Interval{MeasureInt(from), Exclusive{MeasureInt(from + 10*rnd.Intn(4))}}
+		}
+		if rnd.Intn(2) == 0 {
+			rect["score"] = Interval{MeasureFloat(rnd.Float64()), nil}
+		}
+		return rect
+	}
+	randPoint := func() Point {
+		p := Point{}
+		if rnd.Intn(5) > 0 {
+			p["country"] = MeasureString(fmt.Sprint("c", rnd.Intn(7)))
+		}
+		if rnd.Intn(3) > 0 {
+			p["tag"] = MeasureInt(rnd.Intn(12))
+		}
+		if rnd.Intn(5) > 0 {
+			p["age"] = MeasureInt(rnd.Intn(110))
+		}
+		if rnd.Intn(3) > 0 {
+			p["score"] = MeasureFloat(rnd.Float64())
+		}
+		return p
+	}
+
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2, BuildWorkers: 8},
+		{LeafNodeDataMax: 4, TreeLevelMax: 4, BuildWorkers: 2},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0, BuildWorkers: 8},
+	} {
+		tree := NewTypedTree[int](dimTypes, opts)
+		var rects []Rect
+		for i := 0; i < 1000; i++ {
+			rect := randRect()
+			rects = append(rects, rect)
+			_ = tree.Add(rect, i)
+		}
+		tree.Build()
+
+		for i := 0; i < 500; i++ {
+			p := randPoint()
+			var expected []int
+			for data, rect := range rects {
+				if rect.Contains(p) {
+					expected = append(expected, data)
+				}
+			}
+			result := tree.Search(p)
+			sort.Ints(result)
+			if fmt.Sprint(result) != fmt.Sprint(expected) {
+				t.Fatal("parallel build search error:", p, result, expected)
+			}
+		}
+
+		// the sequential build of the same segments is the same tree
+		var parallel, sequential bytes.Buffer
+		_ = tree.ExportJSON(&parallel, nil)
+		buildWorkers := tree.buildWorkers
+		tree.buildWorkers = nil
+		tree.Build()
+		_ = tree.ExportJSON(&sequential, nil)
+		if parallel.String() != sequential.String() {
+			t.Fatal("parallel build differs from the sequential one")
+		}
+
+		tree.buildWorkers = buildWorkers
+		tree.Build()
+		parallel.Reset()
+		_ = tree.ExportJSON(&parallel, nil)
+		if parallel.String() != sequential.String() {
+			t.Fatal("parallel build is not deterministic")
+		}
+	}
+}
+
+func TestTree_SeededBuild(t *testing.T) {
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "age": DimTypeReal, "score": DimTypeReal}
+
+	build := func(opts *TreeOptions) *TypedTree[int] {
+		rnd := rand.New(rand.NewSource(21))
+		tree := NewTypedTree[int](dimTypes, opts)
+		for i := 0; i < 500; i++ {
+			// equal bounds of different types and many ties
+			from := Measure(MeasureInt(rnd.Intn(10) * 10))
+			if rnd.Intn(2) == 0 {
+				from = MeasureUint(rnd.Intn(10) * 10)
+			}
+			rect := Rect{"age": Interval{from, Exclusive{MeasureInt(100)}}}
+			if rnd.Intn(3) > 0 {
+				rect["country"] = Measures{MeasureString(fmt.Sprint("c", rnd.Intn(5))), MeasureString(fmt.Sprint("c", rnd.Intn(5)))}
+			}
+			if rnd.Intn(2) == 0 {
+				rect["score"] = Interval{MeasureInt(rnd.Intn(3)), nil}
+			}
+			_ = tree.Add(rect, i%300)
+		}
+		_ = tree.UpsertRule("rule", []Rect{{"age": Interval{MeasureInt(90), nil}}, {"age": Interval{nil, MeasureInt(5)}}}, 1000)
+		tree.Build()
+		return tree
+	}
+	artifacts := func(tree *TypedTree[int]) string {
+		var export, saved bytes.Buffer
+		_ = tree.ExportJSON(&export, nil)
+		if err := tree.Save(&saved, &TreeCodec[int]{}); err != nil {
+			t.Fatal("save error:", err)
+		}
+		return tree.Dumps() + export.String() + saved.String()
+	}
+
+	for _, opts := range []TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+	} {
+		seeded := opts
+		seeded.Seed = 21
+		parallel := seeded
+		parallel.BuildWorkers = 8
+
+		tree := build(&seeded)
+		expected := artifacts(tree)
+		for _, opts := range []TreeOptions{seeded, parallel} {
+			if artifacts(build(&opts)) != expected {
+				t.Fatal("seeded build is not reproducible")
+			}
+		}
+
+		// rebuilds keep the tree and the order of the segments
+		tree.Build()
+		if artifacts(tree) != expected {
+			t.Fatal("seeded rebuild is not reproducible")
+		}
+		if rule, _ := tree.GetRule("rule"); len(rule) != 2 || rule[0].Rect["age"].(Interval).lowerBound().m == nil {
+			t.Fatal("build reordered the segments:", rule)
+		}
+
+		var buf bytes.Buffer
+		_ = tree.Save(&buf, &TreeCodec[int]{})
+		loaded, err := LoadTypedTree[int](&buf, &TreeCodec[int]{})
+		if err != nil || loaded.options.Seed != 21 {
+			t.Fatal("load seed error:", err)
+		}
+
+		other := build(&TreeOptions{LeafNodeDataMax: opts.LeafNodeDataMax, Seed: 7})
+		for age := 0; age < 110; age += 5 {
+			p := Point{"country": MeasureString(fmt.Sprint("c", age%6)), "age": MeasureInt(age), "score": MeasureInt(age % 4)}
+			result, otherResult := tree.Search(p), other.Search(p)
+			sort.Ints(result)
+			sort.Ints(otherResult)
+			if fmt.Sprint(result) != fmt.Sprint(otherResult) {
+				t.Fatal("seeded search error:", p, result, otherResult)
+			}
+		}
+	}
+}
+
+func BenchmarkTree_Build(b *testing.B) {
+	for _, buildWorkers := range []int{1, 8} {
+		b.Run(fmt.Sprint("workers", buildWorkers), func(b *testing.B) {
+			tree := NewTree(dimType, &TreeOptions{BuildWorkers: buildWorkers})
+			for i, rect := range testRects {
+				_ = tree.Add(rect, "data"+strconv.FormatInt(int64(i), 10))
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				tree.Build()
+			}
+		})
+	}
+}
@@ -0,0 +1,979 @@
+package go_kd_segment_tree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	mapset "github.com/deckarep/golang-set/v2"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// TreeCodecVersion is the version of the binary format written by Save.
+const TreeCodecVersion = 4
+
+var treeCodecMagic = [4]byte{'K', 'D', 'S', 'T'}
+
+// PayloadCodec encodes the payloads of a tree.
+type PayloadCodec[T comparable] interface {
+	Encode(w io.Writer, data T) error
+	Decode(r io.Reader) (T, error)
+}
+
+// ValueCodec encodes measures and dim names of types unknown to the tree codec.
+// Encode reports false when it does not handle the value.
+type ValueCodec interface {
+	Name() string
+	Encode(w io.Writer, v interface{}) (bool, error)
+	Decode(r io.Reader) (interface{}, error)
+}
+
+// TreeCodec configures Save and LoadTypedTree. Payloads are encoded with gob
+// when Payload is nil.
+type TreeCodec[T comparable] struct {
+	Payload PayloadCodec[T]
+	Values  []ValueCodec
+}
+
+// GobPayloadCodec encodes payloads with encoding/gob; interface{} payloads of
+// custom types have to be registered with gob.Register.
+type GobPayloadCodec[T comparable] struct{}
+
+func (GobPayloadCodec[T]) Encode(w io.Writer, data T) error {
+	return gob.NewEncoder(w).Encode(&data)
+}
+
+func (GobPayloadCodec[T]) Decode(r io.Reader) (T, error) {
+	var data T
+	err := gob.NewDecoder(r).Decode(&data)
+	return data, err
+}
+
+const (
+	valueNil byte = iota
+	valueMeasureFloat
+	valueMeasureString
+	valueMeasureTime
+	valueMeasureInt
+	valueMeasureUint
+	valueExclusive
+	valueInterval
+	valueIntervals
+	valueMeasures
+	valueExcludedMeasures
+	valueMeasureSet
+	valueString
+	valueInt
+	valueInt64
+	valueUint64
+	valueFloat64
+	valueCustom byte = 255
+)
+
+const (
+	nodeNil byte = iota
+	nodeLeaf
+	nodeBinary
+	nodeHash
+	nodeConjunction
+)
+
+const (
+	conjunctionDimNil byte = iota
+	conjunctionDimReal
+	conjunctionDimDiscrete
+)
+
+// Save writes the tree, including its built node graph, in a versioned binary
+// format that LoadTypedTree reads back without rebuilding.
+func (tree *TypedTree[T]) Save(w io.Writer, codec *TreeCodec[T]) error {
+	tree.updateMu.Lock()
+	defer tree.updateMu.Unlock()
+
+	enc := &treeEncoder[T]{
+		w:        bufio.NewWriter(w),
+		codec:    newTreeCodec(codec),
+		segIndex: make(map[*TypedSegment[T]]int),
+		copies:   make(map[int][]int),
+	}
+	root := tree.snapshot()
+
+	enc.write(treeCodecMagic[:])
+	enc.writeUvarint(TreeCodecVersion)
+
+	enc.writeVarint(int64(tree.options.TreeLevelMax))
+	enc.writeVarint(int64(tree.options.LeafNodeDataMax))
+	enc.writeFloat(tree.options.BranchingDecreasePercentMin)
+	enc.writeFloat(tree.options.ConjunctionTargetRateMin)
+	enc.writeVarint(tree.options.Seed)
+	enc.writeFloat(tree.options.RebuildInsertRate)
+	enc.writeVarint(int64(tree.options.RebuildInsertMin))
+
+	var dims [][]byte
+	for dimName, dimType := range tree.dimTypes {
+		dim := enc.valueBytes(dimName)
+		dim = binary.AppendVarint(dim, int64(dimType.Type))
+		dims = append(dims, dim)
+	}
+	sort.Slice(dims, func(i, j int) bool { return bytes.Compare(dims[i], dims[j]) < 0 })
+	enc.writeUvarint(uint64(len(dims)))
+	for _, dim := range dims {
+		enc.write(dim)
+	}
+
+	// segments are shared between nodes, write each of them once
+	enc.collectSegments(tree.segments)
+	enc.collectNodeSegments(root)
+	enc.writeUvarint(uint64(len(enc.segments)))
+	for _, seg := range enc.segments {
+		enc.writeSegment(seg)
+	}
+	for _, seg := range enc.segments {
+		enc.writeSegmentIndexes(seg.merged)
+	}
+
+	enc.writeSegmentIndexes(tree.segments)
+	enc.writeNode(root)
+
+	if enc.err != nil {
+		return enc.err
+	}
+	return enc.w.Flush()
+}
+
+// LoadTypedTree reads a tree written by Save.
+func LoadTypedTree[T comparable](r io.Reader, codec *TreeCodec[T]) (*TypedTree[T], error) {
+	dec := &treeDecoder[T]{
+		r:     bufio.NewReader(r),
+		codec: newTreeCodec(codec),
+	}
+
+	var magic [4]byte
+	dec.read(magic[:])
+	if dec.err == nil && magic != treeCodecMagic {
+		return nil, errors.New("not a tree file")
+	}
+	// version 1 has no seed, version 2 no rebuild thresholds
+	version := dec.readUvarint()
+	if dec.err == nil && (version < 1 || version > TreeCodecVersion) {
+		return nil, errors.New(fmt.Sprintf("not support tree file version:%v", version))
+	}
+
+	opts := &TreeOptions{
+		TreeLevelMax:                int(dec.readVarint()),
+		LeafNodeDataMax:             int(dec.readVarint()),
+		BranchingDecreasePercentMin: dec.readFloat(),
+		ConjunctionTargetRateMin:    dec.readFloat(),
+	}
+	if version > 1 {
+		opts.Seed = dec.readVarint()
+	}
+	if version > 2 {
+		opts.RebuildInsertRate = dec.readFloat()
+		opts.RebuildInsertMin = int(dec.readVarint())
+	}
+
+	dimTypes := make(DimTypes)
+	for i := dec.readLen(); i > 0 && dec.err == nil; i-- {
+		dimName := dec.readKey()
+		dimTypes[dimName] = DimType{Type: int(dec.readVarint())}
+	}
+	if dec.err != nil {
+		return nil, dec.err
+	}
+
+	dec.tree = NewTypedTree[T](dimTypes, opts)
+
+	for i := dec.readLen(); i > 0 && dec.err == nil; i-- {
+		dec.segments = append(dec.segments, dec.readSegment())
+	}
+	if version > 3 {
+		for _, seg := range dec.segments {
+			if merged := dec.readSegmentIndexes(); len(merged) > 0 {
+				seg.merged = merged
+			}
+		}
+	}
+	dec.tree.indexSegments(dec.segments)
+	dec.tree.segments = dec.readSegmentIndexes()
+
+	root := dec.readNode()
+	if dec.err != nil {
+		return nil, dec.err
+	}
+	if root != nil {
+		dec.tree.root.Store(&treeSnapshot[T]{root: root})
+	}
+	return dec.tree, nil
+}
+
+// LoadTree reads an untyped tree written by Save.
+func LoadTree(r io.Reader, codec *TreeCodec[interface{}]) (*Tree, error) {
+	return LoadTypedTree[interface{}](r, codec)
+}
+
+func newTreeCodec[T comparable](codec *TreeCodec[T]) *TreeCodec[T] {
+	if codec == nil {
+		codec = &TreeCodec[T]{}
+	}
+	if codec.Payload == nil {
+		codec = &TreeCodec[T]{
+			Payload: GobPayloadCodec[T]{},
+			Values:  codec.Values,
+		}
+	}
+	return codec
+}
+
+type treeEncoder[T comparable] struct {
+	w     *bufio.Writer
+	codec *TreeCodec[T]
+	err   error
+
+	segments []*TypedSegment[T]
+	segIndex map[*TypedSegment[T]]int
+
+	// copies lists the written segments by index
+	copies map[int][]int
+}
+
+func (enc *treeEncoder[T]) write(b []byte) {
+	if enc.err != nil {
+		return
+	}
+	_, enc.err = enc.w.Write(b)
+}
+
+func (enc *treeEncoder[T]) writeUvarint(x uint64) {
+	enc.write(binary.AppendUvarint(nil, x))
+}
+
+func (enc *treeEncoder[T]) writeVarint(x int64) {
+	enc.write(binary.AppendVarint(nil, x))
+}
+
+func (enc *treeEncoder[T]) writeFloat(x float64) {
+	enc.write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(x)))
+}
+
+func (enc *treeEncoder[T]) writeBytes(b []byte) {
+	enc.writeUvarint(uint64(len(b)))
+	enc.write(b)
+}
+
+func (enc *treeEncoder[T]) writeValue(v interface{}) {
+	enc.write(enc.valueBytes(v))
+}
+
+// valueBytes encodes a measure, a rect constraint or a dim name.
+func (enc *treeEncoder[T]) valueBytes(v interface{}) []byte {
+	var b []byte
+	switch v := v.(type) {
+	case nil:
+		b = append(b, valueNil)
+	case MeasureFloat:
+		b = append(b, valueMeasureFloat)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(float64(v)))
+	case MeasureString:
+		b = append(b, valueMeasureString)
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+	case MeasureTime:
+		data, err := time.Time(v).MarshalBinary()
+		if err != nil && enc.err == nil {
+			enc.err = err
+		}
+		b = append(b, valueMeasureTime)
+		b = binary.AppendUvarint(b, uint64(len(data)))
+		b = append(b, data...)
+	case MeasureInt:
+		b = append(b, valueMeasureInt)
+		b = binary.AppendVarint(b, int64(v))
+	case MeasureUint:
+		b = append(b, valueMeasureUint)
+		b = binary.AppendUvarint(b, uint64(v))
+	case Exclusive:
+		b = append(b, valueExclusive)
+		b = append(b, enc.valueBytes(v.Measure)...)
+	case Interval:
+		b = append(b, valueInterval)
+		b = append(b, enc.valueBytes(v[0])...)
+		b = append(b, enc.valueBytes(v[1])...)
+	case Intervals:
+		b = append(b, valueIntervals)
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		for _, interval := range v {
+			b = append(b, enc.valueBytes(interval)[1:]...)
+		}
+	case Measures:
+		b = enc.appendMeasures(append(b, valueMeasures), v)
+	case ExcludedMeasures:
+		b = enc.appendMeasures(append(b, valueExcludedMeasures), v)
+	case MeasureSet:
+		b = enc.appendMeasures(append(b, valueMeasureSet), v)
+	case string:
+		b = append(b, valueString)
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+	case int:
+		b = append(b, valueInt)
+		b = binary.AppendVarint(b, int64(v))
+	case int64:
+		b = append(b, valueInt64)
+		b = binary.AppendVarint(b, v)
+	case uint64:
+		b = append(b, valueUint64)
+		b = binary.AppendUvarint(b, v)
+	case float64:
+		b = append(b, valueFloat64)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	default:
+		for _, valueCodec := range enc.codec.Values {
+			var buf bytes.Buffer
+			ok, err := valueCodec.Encode(&buf, v)
+			if err != nil && enc.err == nil {
+				enc.err = err
+			}
+			if ok {
+				b = append(b, valueCustom)
+				b = binary.AppendUvarint(b, uint64(len(valueCodec.Name())))
+				b = append(b, valueCodec.Name()...)
+				b = binary.AppendUvarint(b, uint64(buf.Len()))
+				return append(b, buf.Bytes()...)
+			}
+		}
+		if enc.err == nil {
+			enc.err = errors.New(fmt.Sprintf("not support value type:%T", v))
+		}
+	}
+	return b
+}
+
+func (enc *treeEncoder[T]) appendMeasures(b []byte, measures []Measure) []byte {
+	b = binary.AppendUvarint(b, uint64(len(measures)))
+	for _, m := range measures {
+		b = append(b, enc.valueBytes(m)...)
+	}
+	return b
+}
+
+// collectSegments lists the segments to write, once for the copies of a
+// segment holding the same data, so that a loaded tree shares them too.
+func (enc *treeEncoder[T]) collectSegments(segments []*TypedSegment[T]) {
+segments:
+	for _, seg := range segments {
+		if _, ok := enc.segIndex[seg]; ok {
+			continue
+		}
+		for _, i := range enc.copies[seg.index] {
+			if enc.segments[i].Data.Equal(seg.Data) {
+				enc.segIndex[seg] = i
+				continue segments
+			}
+		}
+		enc.segIndex[seg] = len(enc.segments)
+		enc.copies[seg.index] = append(enc.copies[seg.index], len(enc.segments))
+		enc.segments = append(enc.segments, seg)
+		enc.collectSegments(seg.merged)
+	}
+}
+
+func (enc *treeEncoder[T]) collectNodeSegments(node TypedTreeNode[T]) {
+	switch node := node.(type) {
+	case *TypedLeafNode[T]:
+		enc.collectSegments(node.Segments)
+	case *TypedConjunctionNode[T]:
+		enc.collectSegments(node.segments)
+	case *TypedBinaryNode[T]:
+		enc.collectNodeSegments(node.Left)
+		enc.collectNodeSegments(node.Right)
+		enc.collectNodeSegments(node.Pass)
+	case *TypedHashNode[T]:
+		for _, key := range enc.sortedChildKeys(node) {
+			enc.collectNodeSegments(node.child[key])
+		}
+		enc.collectNodeSegments(node.pass)
+		enc.collectNodeSegments(node.other)
+	}
+}
+
+// sortedChildKeys returns the child keys of the hash node ordered by their
+// encoding.
+func (enc *treeEncoder[T]) sortedChildKeys(node *TypedHashNode[T]) []int32 {
+	keys := make([]int32, 0, len(node.child))
+	keyBytes := make(map[int32][]byte, len(node.child))
+	for key := range node.child {
+		keys = append(keys, key)
+		keyBytes[key] = enc.valueBytes(node.Tree.schema.Value(key))
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keyBytes[keys[i]], keyBytes[keys[j]]) < 0 })
+	return keys
+}
+
+func (enc *treeEncoder[T]) writeSegment(seg *TypedSegment[T]) {
+	enc.writeBytes([]byte(seg.ID))
+
+	var dims [][]byte
+	for dimName, d := range seg.Rect {
+		dims = append(dims, append(enc.valueBytes(dimName), enc.valueBytes(d)...))
+	}
+	sort.Slice(dims, func(i, j int) bool { return bytes.Compare(dims[i], dims[j]) < 0 })
+	enc.writeUvarint(uint64(len(dims)))
+	for _, dim := range dims {
+		enc.write(dim)
+	}
+
+	var data []T
+	if seg.Data != nil {
+		data = seg.Data.ToSlice()
+	}
+	// payloads are sorted by encoding, so that saving is reproducible
+	var payloads [][]byte
+	for _, d := range data {
+		var buf bytes.Buffer
+		if err := enc.codec.Payload.Encode(&buf, d); err != nil && enc.err == nil {
+			enc.err = err
+		}
+		payloads = append(payloads, buf.Bytes())
+	}
+	sort.Slice(payloads, func(i, j int) bool { return bytes.Compare(payloads[i], payloads[j]) < 0 })
+	enc.writeUvarint(uint64(len(payloads)))
+	for _, payload := range payloads {
+		enc.writeBytes(payload)
+	}
+}
+
+func (enc *treeEncoder[T]) writeSegmentIndexes(segments []*TypedSegment[T]) {
+	enc.writeUvarint(uint64(len(segments)))
+	for _, seg := range segments {
+		enc.writeUvarint(uint64(enc.segIndex[seg]))
+	}
+}
+
+func (enc *treeEncoder[T]) writeInts(ints []int) {
+	enc.writeUvarint(uint64(len(ints)))
+	for _, i := range ints {
+		enc.writeUvarint(uint64(i))
+	}
+}
+
+func (enc *treeEncoder[T]) writeNode(node TypedTreeNode[T]) {
+	switch node := node.(type) {
+	case *TypedLeafNode[T]:
+		enc.write([]byte{nodeLeaf})
+		enc.writeSegmentIndexes(node.Segments)
+	case *TypedBinaryNode[T]:
+		enc.write([]byte{nodeBinary})
+		enc.writeValue(node.DimName)
+		enc.writeVarint(int64(node.Level))
+		enc.writeFloat(node.DecreasePercent)
+		enc.writeValue(node.Mid)
+		enc.writeNode(node.Left)
+		enc.writeNode(node.Right)
+		enc.writeNode(node.Pass)
+	case *TypedHashNode[T]:
+		enc.write([]byte{nodeHash})
+		enc.writeValue(node.DimName)
+		enc.writeVarint(int64(node.Level))
+		enc.writeFloat(node.DecreasePercent)
+
+		keys := enc.sortedChildKeys(node)
+		enc.writeUvarint(uint64(len(keys)))
+		for _, key := range keys {
+			enc.writeValue(node.Tree.schema.Value(key))
+			enc.writeNode(node.child[key])
+		}
+		enc.writeNode(node.pass)
+		enc.writeNode(node.other)
+	case *TypedConjunctionNode[T]:
+		enc.write([]byte{nodeConjunction})
+		enc.writeValue(node.DimName)
+		enc.writeVarint(int64(node.Level))
+		enc.writeFloat(node.DecreasePercent)
+		enc.writeSegmentIndexes(node.segments)
+		enc.writeInts(node.unconstrained)
+
+		var dims [][]byte
+		var dimNodes = make(map[string]ConjunctionDimNode)
+		for dimName, dimNode := range node.dimNode {
+			b := enc.valueBytes(dimName)
+			dims = append(dims, b)
+			dimNodes[string(b)] = dimNode
+		}
+		sort.Slice(dims, func(i, j int) bool { return bytes.Compare(dims[i], dims[j]) < 0 })
+		enc.writeUvarint(uint64(len(dims)))
+		for _, dim := range dims {
+			enc.write(dim)
+			enc.writeConjunctionDimNode(dimNodes[string(dim)])
+		}
+	default:
+		enc.write([]byte{nodeNil})
+	}
+}
+
+func (enc *treeEncoder[T]) writeConjunctionDimNode(dimNode ConjunctionDimNode) {
+	switch dimNode := dimNode.(type) {
+	case *ConjunctionDimRealNode:
+		if dimNode == nil {
+			break
+		}
+		enc.write([]byte{conjunctionDimReal})
+		enc.writeValue(dimNode.dimName)
+		enc.write(enc.appendMeasures(nil, dimNode.splitPoints))
+		enc.writeUvarint(uint64(len(dimNode.segments)))
+		for _, segments := range dimNode.segments {
+			enc.writeInts(segments)
+		}
+		return
+	case *ConjunctionDimDiscreteNode:
+		if dimNode == nil {
+			break
+		}
+		enc.write([]byte{conjunctionDimDiscrete})
+		enc.writeValue(dimNode.dimName)
+		enc.writeMeasureInts(dimNode.segments)
+		enc.writeInts(dimNode.excluded)
+		enc.writeMeasureInts(dimNode.excludedBy)
+		return
+	}
+	enc.write([]byte{conjunctionDimNil})
+}
+
+func (enc *treeEncoder[T]) writeMeasureInts(m map[Measure][]int) {
+	keys := make(map[string]Measure)
+	var keyBytes []string
+	for key := range m {
+		b := string(enc.valueBytes(key))
+		keys[b] = key
+		keyBytes = append(keyBytes, b)
+	}
+	sort.Strings(keyBytes)
+	enc.writeUvarint(uint64(len(keyBytes)))
+	for _, b := range keyBytes {
+		enc.write([]byte(b))
+		enc.writeInts(m[keys[b]])
+	}
+}
+
+type treeDecoder[T comparable] struct {
+	r     *bufio.Reader
+	codec *TreeCodec[T]
+	err   error
+
+	tree     *TypedTree[T]
+	segments []*TypedSegment[T]
+}
+
+func (dec *treeDecoder[T]) fail(err error) {
+	if dec.err == nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		dec.err = err
+	}
+}
+
+func (dec *treeDecoder[T]) read(b []byte) {
+	if dec.err != nil {
+		return
+	}
+	if _, err := io.ReadFull(dec.r, b); err != nil {
+		dec.fail(err)
+	}
+}
+
+func (dec *treeDecoder[T]) readByte() byte {
+	if dec.err != nil {
+		return 0
+	}
+	b, err := dec.r.ReadByte()
+	if err != nil {
+		dec.fail(err)
+	}
+	return b
+}
+
+func (dec *treeDecoder[T]) readUvarint() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	x, err := binary.ReadUvarint(dec.r)
+	if err != nil {
+		dec.fail(err)
+	}
+	return x
+}
+
+func (dec *treeDecoder[T]) readVarint() int64 {
+	if dec.err != nil {
+		return 0
+	}
+	x, err := binary.ReadVarint(dec.r)
+	if err != nil {
+		dec.fail(err)
+	}
+	return x
+}
+
+// readLen reads a length, rejecting the ones above MaxInt32.
+func (dec *treeDecoder[T]) readLen() int {
+	n := dec.readUvarint()
+	if n > math.MaxInt32 {
+		dec.fail(errors.New(fmt.Sprintf("tree file length overflow:%v", n)))
+		return 0
+	}
+	return int(n)
+}
+
+func (dec *treeDecoder[T]) readFloat() float64 {
+	var b [8]byte
+	dec.read(b[:])
+	return math.Float64frombits(binary.LittleEndian.Uint64(b[:]))
+}
+
+func (dec *treeDecoder[T]) readBytes() []byte {
+	n := dec.readLen()
+	if dec.err != nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, dec.r, int64(n)); err != nil {
+		dec.fail(err)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// readMeasure reads a scalar measure, the only ones used as split points,
+// discrete values and hash keys: a builtin one, or a custom one made of
+// scalars.
+func (dec *treeDecoder[T]) readMeasure() Measure {
+	v := dec.readValue()
+	switch m := v.(type) {
+	case nil:
+		return nil
+	case MeasureFloat, MeasureString, MeasureTime, MeasureInt, MeasureUint:
+		return m.(Measure)
+	case Exclusive, Interval, MeasureSet:
+	case Measure:
+		if hashableValue(reflect.ValueOf(m)) {
+			return m
+		}
+	}
+	dec.fail(errors.New(fmt.Sprintf("not a scalar measure:%T", v)))
+	return nil
+}
+
+// readBound reads an interval endpoint: a scalar measure, possibly exclusive.
+func (dec *treeDecoder[T]) readBound() Measure {
+	if dec.peekByte() == valueExclusive {
+		return dec.readValue().(Measure)
+	}
+	return dec.readMeasure()
+}
+
+// peekByte returns the next byte without reading it, 0 at the end.
+func (dec *treeDecoder[T]) peekByte() byte {
+	if dec.err != nil {
+		return 0
+	}
+	b, err := dec.r.Peek(1)
+	if err != nil {
+		return 0
+	}
+	return b[0]
+}
+
+// readKey reads a dim name, failing for values that cannot be map keys.
+func (dec *treeDecoder[T]) readKey() interface{} {
+	v := dec.readValue()
+	if v != nil && hashableValue(reflect.ValueOf(v)) == false {
+		dec.fail(errors.New(fmt.Sprintf("not a hashable dim name:%T", v)))
+		return nil
+	}
+	return v
+}
+
+// hashableValue reports whether the value can be a map key, made of scalars
+// only.
+func hashableValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128,
+		reflect.String, reflect.Pointer, reflect.Chan, reflect.UnsafePointer:
+		return true
+	case reflect.Interface:
+		return v.IsNil() || hashableValue(v.Elem())
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if hashableValue(v.Index(i)) == false {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if hashableValue(v.Field(i)) == false {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (dec *treeDecoder[T]) readMeasures() []Measure {
+	var measures []Measure
+	for i := dec.readLen(); i > 0 && dec.err == nil; i-- {
+		measures = append(measures, dec.readMeasure())
+	}
+	return measures
+}
+
+func (dec *treeDecoder[T]) readInterval() Interval {
+	return Interval{dec.readBound(), dec.readBound()}
+}
+
+func (dec *treeDecoder[T]) readValue() interface{} {
+	switch tag := dec.readByte(); tag {
+	case valueNil:
+		return nil
+	case valueMeasureFloat:
+		return MeasureFloat(dec.readFloat())
+	case valueMeasureString:
+		return MeasureString(dec.readBytes())
+	case valueMeasureTime:
+		var t time.Time
+		if err := t.UnmarshalBinary(dec.readBytes()); err != nil {
+			dec.fail(err)
+		}
+		return MeasureTime(t)
+	case valueMeasureInt:
+		return MeasureInt(dec.readVarint())
+	case valueMeasureUint:
+		return MeasureUint(dec.readUvarint())
+	case valueExclusive:
+		return Exclusive{dec.readMeasure()}
+	case valueInterval:
+		return dec.readInterval()
+	case valueIntervals:
+		var intervals Intervals
+		for i := dec.readLen(); i > 0 && dec.err == nil; i-- {
+			intervals = append(intervals, dec.readInterval())
+		}
+		return intervals
+	case valueMeasures:
+		return Measures(dec.readMeasures())
+	case valueExcludedMeasures:
+		return ExcludedMeasures(dec.readMeasures())
+	case valueMeasureSet:
+		return MeasureSet(dec.readMeasures())
+	case valueString:
+		return string(dec.readBytes())
+	case valueInt:
+		return int(dec.readVarint())
+	case valueInt64:
+		return dec.readVarint()
+	case valueUint64:
+		return dec.readUvarint()
+	case valueFloat64:
+		return dec.readFloat()
+	case valueCustom:
+		name := string(dec.readBytes())
+		data := dec.readBytes()
+		if dec.err != nil {
+			return nil
+		}
+		for _, valueCodec := range dec.codec.Values {
+			if valueCodec.Name() == name {
+				v, err := valueCodec.Decode(bytes.NewReader(data))
+				if err != nil {
+					dec.fail(err)
+				}
+				return v
+			}
+		}
+		dec.fail(errors.New(fmt.Sprintf("no value codec:%v", name)))
+	default:
+		dec.fail(errors.New(fmt.Sprintf("not support value tag:%v", tag)))
+	}
+	return nil
+}
+
+func (dec *treeDecoder[T]) readSegment() *TypedSegment[T] {
+	seg := &TypedSegment[T]{
+		ID:   string(dec.readBytes()),
+		Rect: make(Rect),
+		Data: mapset.NewSet[T](),
+	}
+
+	for i := dec.readLen(); i > 0 && dec.err == nil; i-- {
+		dimName := dec.readKey()
+		seg.Rect[dimName] = dec.readValue()
+	}
+
+	for i := dec.readLen(); i > 0 && dec.err == nil; i-- {
+		data := dec.readBytes()
+		if dec.err != nil {
+			break
+		}
+		d, err := dec.codec.Payload.Decode(bytes.NewReader(data))
+		if err != nil {
+			dec.fail(err)
+			break
+		}
+		seg.Data.Add(d)
+	}
+	return seg
+}
+
+func (dec *treeDecoder[T]) readSegmentIndexes() []*TypedSegment[T] {
+	var segments []*TypedSegment[T]
+	for i := dec.readLen(); i > 0 && dec.err == nil; i-- {
+		index := dec.readLen()
+		if index >= len(dec.segments) {
+			dec.fail(errors.New(fmt.Sprintf("segment index out of range:%v", index)))
+			break
+		}
+		segments = append(segments, dec.segments[index])
+	}
+	return segments
+}
+
+func (dec *treeDecoder[T]) readInts() []int {
+	var ints []int
+	for i := dec.readLen(); i > 0 && dec.err == nil; i-- {
+		ints = append(ints, dec.readLen())
+	}
+	return ints
+}
+
+func (dec *treeDecoder[T]) readNode() TypedTreeNode[T] {
+	switch kind := dec.readByte(); kind {
+	case nodeNil:
+		return nil
+	case nodeLeaf:
+		node := &TypedLeafNode[T]{
+			Segments: dec.readSegmentIndexes(),
+		}
+		node.debt.built = len(node.Segments)
+		return node
+	case nodeBinary:
+		node := &TypedBinaryNode[T]{
+			Tree:            dec.tree,
+			DimName:         dec.readKey(),
+			Level:           int(dec.readVarint()),
+			DecreasePercent: dec.readFloat(),
+			Mid:             dec.readMeasure(),
+		}
+		node.dim = dec.tree.schema.dimIndexOrNone(node.DimName)
+		node.Left = dec.readNode()
+		node.Right = dec.readNode()
+		node.Pass = dec.readNode()
+		node.debt = builtDebt(node.Left, node.Right, node.Pass)
+		return node
+	case nodeHash:
+		node := &TypedHashNode[T]{
+			Tree:            dec.tree,
+			DimName:         dec.readKey(),
+			Level:           int(dec.readVarint()),
+			DecreasePercent: dec.readFloat(),
+			child:           make(map[int32]TypedTreeNode[T]),
+		}
+		node.dim = dec.tree.schema.dimIndexOrNone(node.DimName)
+		for i := dec.readLen(); i > 0 && dec.err == nil; i-- {
+			key := dec.readMeasure()
+			if child := dec.readNode(); child != nil && key != nil {
+				node.child[dec.tree.schema.intern(key)] = child
+			}
+		}
+		node.pass = dec.readNode()
+		node.other = dec.readNode()
+		children := []TypedTreeNode[T]{node.pass, node.other}
+		for _, child := range node.child {
+			children = append(children, child)
+		}
+		node.debt = builtDebt(children...)
+		return node
+	case nodeConjunction:
+		node := &TypedConjunctionNode[T]{
+			Tree:            dec.tree,
+			DimName:         dec.readKey(),
+			Level:           int(dec.readVarint()),
+			DecreasePercent: dec.readFloat(),
+			segments:        dec.readSegmentIndexes(),
+			dimNode:         make(map[interface{}]ConjunctionDimNode),
+		}
+		node.unconstrained = dec.checkInts(dec.readInts(), len(node.segments))
+		for i := dec.readLen(); i > 0 && dec.err == nil; i-- {
+			dimName := dec.readKey()
+			node.dimNode[dimName] = dec.readConjunctionDimNode(len(node.segments))
+		}
+		node.indexDims()
+		node.debt.built = len(node.segments)
+		return node
+	default:
+		dec.fail(errors.New(fmt.Sprintf("not support node kind:%v", kind)))
+	}
+	return nil
+}
+
+func (dec *treeDecoder[T]) readConjunctionDimNode(segmentNum int) ConjunctionDimNode {
+	switch kind := dec.readByte(); kind {
+	case conjunctionDimNil:
+		return nil
+	case conjunctionDimReal:
+		dimNode := &ConjunctionDimRealNode{
+			dimName:     dec.readKey(),
+			splitPoints: dec.readMeasures(),
+		}
+		for i := dec.readLen(); i > 0 && dec.err == nil; i-- {
+			dimNode.segments = append(dimNode.segments, dec.checkInts(dec.readInts(), segmentNum))
+		}
+		if dec.err == nil && len(dimNode.segments) != 2*len(dimNode.splitPoints)+1 {
+			dec.fail(errors.New("conjunction split points mismatch"))
+		}
+		return dimNode
+	case conjunctionDimDiscrete:
+		return &ConjunctionDimDiscreteNode{
+			dimName:    dec.readKey(),
+			segments:   dec.readMeasureInts(segmentNum),
+			excluded:   dec.checkInts(dec.readInts(), segmentNum),
+			excludedBy: dec.readMeasureInts(segmentNum),
+		}
+	default:
+		dec.fail(errors.New(fmt.Sprintf("not support conjunction node kind:%v", kind)))
+	}
+	return nil
+}
+
+func (dec *treeDecoder[T]) readMeasureInts(segmentNum int) map[Measure][]int {
+	m := make(map[Measure][]int)
+	for i := dec.readLen(); i > 0 && dec.err == nil; i-- {
+		key := dec.readMeasure()
+		ints := dec.checkInts(dec.readInts(), segmentNum)
+		if key != nil {
+			m[key] = ints
+		}
+	}
+	return m
+}
+
+// checkInts checks that segment positions stay within the node's segments.
+func (dec *treeDecoder[T]) checkInts(ints []int, segmentNum int) []int {
+	for _, i := range ints {
+		if i >= segmentNum {
+			dec.fail(errors.New(fmt.Sprintf("segment position out of range:%v", i)))
+			return nil
+		}
+	}
+	return ints
+}
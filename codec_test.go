@@ -0,0 +1,237 @@
+package go_kd_segment_tree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+type testDim struct{ Name string }
+
+type testDimCodec struct{}
+
+func (testDimCodec) Name() string { return "testDim" }
+
+func (testDimCodec) Encode(w io.Writer, v interface{}) (bool, error) {
+	dim, ok := v.(testDim)
+	if !ok {
+		return false, nil
+	}
+	_, err := io.WriteString(w, dim.Name)
+	return true, err
+}
+
+func (testDimCodec) Decode(r io.Reader) (interface{}, error) {
+	b, err := io.ReadAll(r)
+	return testDim{Name: string(b)}, err
+}
+
+// testMeasure is a custom discrete measure.
+type testMeasure struct{ Code string }
+
+func (a testMeasure) Bigger(b interface{}) bool         { return false }
+func (a testMeasure) Smaller(b interface{}) bool        { return false }
+func (a testMeasure) Equal(b interface{}) bool          { return a == b }
+func (a testMeasure) BiggerOrEqual(b interface{}) bool  { return a == b }
+func (a testMeasure) SmallerOrEqual(b interface{}) bool { return a == b }
+
+// testCodesMeasure is a custom measure that cannot be a hash key.
+type testCodesMeasure []string
+
+func (a testCodesMeasure) Bigger(b interface{}) bool         { return false }
+func (a testCodesMeasure) Smaller(b interface{}) bool        { return false }
+func (a testCodesMeasure) Equal(b interface{}) bool          { return false }
+func (a testCodesMeasure) BiggerOrEqual(b interface{}) bool  { return false }
+func (a testCodesMeasure) SmallerOrEqual(b interface{}) bool { return false }
+
+type testMeasureCodec struct{ codes bool }
+
+func (testMeasureCodec) Name() string { return "testMeasure" }
+
+func (testMeasureCodec) Encode(w io.Writer, v interface{}) (bool, error) {
+	m, ok := v.(testMeasure)
+	if !ok {
+		return false, nil
+	}
+	_, err := io.WriteString(w, m.Code)
+	return true, err
+}
+
+func (c testMeasureCodec) Decode(r io.Reader) (interface{}, error) {
+	b, err := io.ReadAll(r)
+	if c.codes {
+		return testCodesMeasure{string(b)}, err
+	}
+	return testMeasure{Code: string(b)}, err
+}
+
+type testPayloadCodec struct{}
+
+func (testPayloadCodec) Encode(w io.Writer, data int) error {
+	return binary.Write(w, binary.LittleEndian, int64(data))
+}
+
+func (testPayloadCodec) Decode(r io.Reader) (int, error) {
+	var data int64
+	err := binary.Read(r, binary.LittleEndian, &data)
+	return int(data), err
+}
+
+func TestTree_SaveLoad(t *testing.T) {
+	rnd := rand.New(rand.NewSource(4))
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	dimTypes := DimTypes{
+		testDim{"country"}: DimTypeDiscrete,
+		"tag":              DimTypeDiscrete,
+		"time":             DimTypeReal,
+		3:                  DimTypeReal,
+	}
+
+	var rects []Rect
+	for i := 0; i < 400; i++ {
+		rect := Rect{}
+		switch rnd.Intn(3) {
+		case 0:
+			rect[testDim{"country"}] = Measures{MeasureString(fmt.Sprint("c", rnd.Intn(8)))}
+		case 1:
+			rect[testDim{"country"}] = ExcludedMeasures{MeasureString(fmt.Sprint("c", rnd.Intn(8)))}
+		}
+		if rnd.Intn(2) == 0 {
+			rect["tag"] = Measures{MeasureUint(rnd.Intn(20)), MeasureInt(rnd.Intn(20))}
+		}
+		if rnd.Intn(2) == 0 {
+			from := start.Add(time.Duration(rnd.Intn(100)) * time.Hour)
+			rect["time"] = Interval{MeasureTime(from), Exclusive{MeasureTime(from.Add(time.Duration(rnd.Intn(30)) * time.Hour))}}
+		}
+		if rnd.Intn(2) == 0 {
+			rect[3] = Interval{MeasureFloat(rnd.Float64()), nil}
+		}
+		rects = append(rects, rect)
+	}
+
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.6, ConjunctionTargetRateMin: 1.0},
+	} {
+		tree := NewTypedTree[int](dimTypes, opts)
+		for i, rect := range rects {
+			if i%2 == 0 {
+				_ = tree.Add(rect, i)
+			} else {
+				_ = tree.Upsert(fmt.Sprint("id", i), rect, i)
+			}
+		}
+		tree.Build()
+
+		codec := &TreeCodec[int]{Payload: testPayloadCodec{}, Values: []ValueCodec{testDimCodec{}}}
+		var buf bytes.Buffer
+		if err := tree.Save(&buf, codec); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		loaded, err := LoadTypedTree[int](bytes.NewReader(data), codec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// saving the loaded tree writes the same bytes
+		buf.Reset()
+		if err := loaded.Save(&buf, codec); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(buf.Bytes(), data) == false {
+			t.Fatal("saving the loaded tree is not stable")
+		}
+
+		for i := 0; i < 300; i++ {
+			p := Point{
+				testDim{"country"}: MeasureString(fmt.Sprint("c", rnd.Intn(9))),
+				"tag":              MeasureInt(rnd.Intn(20)),
+				"time":             MeasureTime(start.Add(time.Duration(rnd.Intn(140)) * time.Hour)),
+				3:                  MeasureFloat(rnd.Float64()),
+			}
+			expected := tree.Search(p)
+			result := loaded.Search(p)
+			sort.Ints(expected)
+			sort.Ints(result)
+			if fmt.Sprint(result) != fmt.Sprint(expected) {
+				t.Fatal("loaded tree search error:", p, result, expected)
+			}
+		}
+
+		if seg, ok := loaded.Get("id1"); !ok || seg.Data.Contains(1) == false {
+			t.Fatal("loaded tree lost segment ids")
+		}
+
+		if _, err := LoadTypedTree[int](bytes.NewReader(append([]byte("XXXX"), data[4:]...)), codec); err == nil {
+			t.Fatal("bad magic should fail to load")
+		}
+		if _, err := LoadTypedTree[int](bytes.NewReader(append(append([]byte{}, data[:4]...), 99)), codec); err == nil {
+			t.Fatal("unknown version should fail to load")
+		}
+		for cut := 0; cut < len(data); cut += len(data)/50 + 1 {
+			if _, err := LoadTypedTree[int](bytes.NewReader(data[:cut]), codec); err == nil {
+				t.Fatal("truncated tree file should fail to load")
+			}
+		}
+		// a corrupted tree file fails to load or loads, but never panics
+		for i := 4; i < len(data); i += len(data)/100 + 1 {
+			for _, mask := range []byte{0x01, 0xff} {
+				corrupted := append([]byte{}, data...)
+				corrupted[i] ^= mask
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Fatal("corrupted tree file panics:", i, mask, r)
+						}
+					}()
+					if loaded, err := LoadTypedTree[int](bytes.NewReader(corrupted), codec); err == nil {
+						_ = loaded.Search(Point{"tag": MeasureInt(1)})
+					}
+				}()
+			}
+		}
+	}
+
+	// untyped trees use gob for payloads by default
+	untyped := NewTree(DimTypes{"tag": DimTypeDiscrete}, nil)
+	_ = untyped.Add(Rect{"tag": Measures{MeasureString("a")}}, "target1")
+	untyped.Build()
+	var buf bytes.Buffer
+	if err := untyped.Save(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadTree(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := loaded.Search(Point{"tag": MeasureString("a")}); len(result) != 1 || result[0] != "target1" {
+		t.Fatal("untyped loaded tree search error:", result)
+	}
+
+	// value codecs encode custom measures, kept only when they are hashable
+	custom := NewTypedTree[int](DimTypes{"tag": DimTypeDiscrete}, nil)
+	_ = custom.Add(Rect{"tag": Measures{testMeasure{"a"}}}, 1)
+	_ = custom.Add(Rect{"tag": Measures{testMeasure{"b"}}}, 2)
+	custom.Build()
+	buf.Reset()
+	if err := custom.Save(&buf, &TreeCodec[int]{Values: []ValueCodec{testMeasureCodec{}}}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	loadedCustom, err := LoadTypedTree[int](bytes.NewReader(data), &TreeCodec[int]{Values: []ValueCodec{testMeasureCodec{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := loadedCustom.Search(Point{"tag": testMeasure{"b"}}); len(result) != 1 || result[0] != 2 {
+		t.Fatal("custom measure loaded tree search error:", result)
+	}
+	if _, err := LoadTypedTree[int](bytes.NewReader(data), &TreeCodec[int]{Values: []ValueCodec{testMeasureCodec{codes: true}}}); err == nil {
+		t.Fatal("unhashable custom measure should fail to load")
+	}
+}
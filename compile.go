@@ -0,0 +1,632 @@
+package go_kd_segment_tree
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// CompiledTree is the untyped compiled tree kept for compatibility with interface{} payloads.
+type CompiledTree = TypedCompiledTree[interface{}]
+
+// TypedCompiledTree is a built index lowered into flat arrays: a node table
+// with integer children, sorted key tables of schema value ids for the
+// children of hash nodes and integer segment and payload ids. It is immutable
+// and returns the same results as Search on the index it was compiled from;
+// compile again to follow later updates.
+type TypedCompiledTree[T comparable] struct {
+	schema *Schema
+
+	nodes       []compiledNode
+	mids        []Measure
+	hashEdges   []compiledEdge
+	leafSegs    []int32
+	segments    []compiledSegment
+	constraints []compiledConstraint
+	valueIDs    []int32
+	data        []T
+	dataIDs     []int32
+
+	conjunctions  []compiledConjunction
+	conjSegs      []int32
+	invertedDims  []compiledInvertedDim
+	splitPoints   []Measure
+	invertedKeys  []compiledInvertedKey
+	invertedLists []compiledSpan
+	postings      []int32
+	maxConjSegs   int
+
+	pool sync.Pool
+}
+
+const (
+	compiledNodeLeaf = iota
+	compiledNodeBinary
+	compiledNodeHash
+	compiledNodeConjunction
+)
+
+// compiledSpan delimits the entries [from, to) of one of the flat arrays.
+type compiledSpan struct {
+	from, to int32
+}
+
+// compiledNode is a node of the node table; absent children are -1. Leaf
+// nodes list their segments in leafSegs, binary nodes index their mid in mids,
+// hash nodes list their children in hashEdges and conjunction nodes index
+// conjunctions.
+type compiledNode struct {
+	kind  uint8
+	dim   int32
+	index int32
+	span  compiledSpan
+
+	left, right, pass, other int32
+}
+
+// compiledEdge is the child of a hash node for a key, sorted by key.
+type compiledEdge struct {
+	key  int32
+	node int32
+}
+
+type compiledSegment struct {
+	constraints compiledSpan
+	data        compiledSpan
+}
+
+// compiledConstraint is a segmentDim with its value ids in valueIDs.
+type compiledConstraint struct {
+	kind     uint8
+	dim      int32
+	interval Interval
+	values   compiledSpan
+}
+
+// compiledConjunction is a conjunction node. Its segments and unconstrained
+// segments are listed in conjSegs, and the inverted lists of its dims hold
+// positions in its segments.
+type compiledConjunction struct {
+	segments      compiledSpan
+	unconstrained compiledSpan
+	dims          compiledSpan
+}
+
+// compiledInvertedDim is a dim of a conjunction node: the split points and
+// atom lists of a real dim, or the key table and excluded list of a discrete
+// dim.
+type compiledInvertedDim struct {
+	dim      int32
+	real     bool
+	points   compiledSpan
+	atoms    compiledSpan
+	keys     compiledSpan
+	excluded compiledSpan
+}
+
+// compiledInvertedKey is a key of a discrete conjunction dim, sorted by key,
+// with the segments listing it and the excluding segments excluding it.
+type compiledInvertedKey struct {
+	key        int32
+	segments   compiledSpan
+	excludedBy compiledSpan
+}
+
+// Compile lowers the latest built index into a compiled tree.
+func (tree *TypedTree[T]) Compile() (*TypedCompiledTree[T], error) {
+	root := tree.snapshot()
+	if root == nil {
+		return nil, errors.New("tree is not built")
+	}
+
+	c := &compiler[T]{
+		compiled: &TypedCompiledTree[T]{
+			schema: tree.schema,
+		},
+		segIndex:  make(map[*TypedSegment[T]]int32),
+		dataIndex: make(map[T]int32),
+	}
+
+	compiled := c.compiled
+	if _, err := c.compileNode(root); err != nil {
+		return nil, err
+	}
+
+	compiled.pool.New = func() interface{} {
+		return compiled.newSearch()
+	}
+	return compiled, nil
+}
+
+type compiler[T comparable] struct {
+	compiled  *TypedCompiledTree[T]
+	segIndex  map[*TypedSegment[T]]int32
+	dataIndex map[T]int32
+}
+
+func (c *compiler[T]) dim(dim int, dimName interface{}) (int32, error) {
+	if dim < 0 {
+		return 0, errors.New(fmt.Sprintf("compile unknown dim:%v", dimName))
+	}
+	return int32(dim), nil
+}
+
+// segment returns the id of the segment, compiling it the first time.
+func (c *compiler[T]) segment(seg *TypedSegment[T]) (int32, error) {
+	if id, ok := c.segIndex[seg]; ok {
+		return id, nil
+	}
+
+	if seg.encoded == false {
+		return 0, errors.New(fmt.Sprintf("compile rect out of schema:%v", seg.Rect))
+	}
+
+	compiled := c.compiled
+	compiledSeg := compiledSegment{}
+	compiledSeg.constraints.from = int32(len(compiled.constraints))
+	for _, d := range seg.dims {
+		constraint := compiledConstraint{kind: d.kind, dim: int32(d.dim), interval: d.interval}
+		constraint.values.from = int32(len(compiled.valueIDs))
+		compiled.valueIDs = append(compiled.valueIDs, d.ids...)
+		constraint.values.to = int32(len(compiled.valueIDs))
+		compiled.constraints = append(compiled.constraints, constraint)
+	}
+	compiledSeg.constraints.to = int32(len(compiled.constraints))
+
+	compiledSeg.data.from = int32(len(compiled.dataIDs))
+	seg.Data.Each(func(data T) bool {
+		id, ok := c.dataIndex[data]
+		if ok == false {
+			id = int32(len(compiled.data))
+			c.dataIndex[data] = id
+			compiled.data = append(compiled.data, data)
+		}
+		compiled.dataIDs = append(compiled.dataIDs, id)
+		return false
+	})
+	compiledSeg.data.to = int32(len(compiled.dataIDs))
+
+	id := int32(len(compiled.segments))
+	compiled.segments = append(compiled.segments, compiledSeg)
+	c.segIndex[seg] = id
+	return id, nil
+}
+
+// compileNode appends the node and its children to the node table and
+// returns its index, -1 for a nil node.
+func (c *compiler[T]) compileNode(node TypedTreeNode[T]) (int32, error) {
+	if isNilNode(node) {
+		return -1, nil
+	}
+
+	compiled := c.compiled
+	index := int32(len(compiled.nodes))
+	flat := compiledNode{left: -1, right: -1, pass: -1, other: -1}
+	// the children follow their parent in the table
+	compiled.nodes = append(compiled.nodes, flat)
+
+	var err error
+	switch node := node.(type) {
+	case *TypedLeafNode[T]:
+		flat.kind = compiledNodeLeaf
+		var segs []int32
+		for _, seg := range node.Segments {
+			id, err := c.segment(seg)
+			if err != nil {
+				return 0, err
+			}
+			segs = append(segs, id)
+		}
+		flat.span.from = int32(len(compiled.leafSegs))
+		compiled.leafSegs = append(compiled.leafSegs, segs...)
+		flat.span.to = int32(len(compiled.leafSegs))
+	case *TypedBinaryNode[T]:
+		flat.kind = compiledNodeBinary
+		if flat.dim, err = c.dim(node.dim, node.DimName); err != nil {
+			return 0, err
+		}
+		flat.index = int32(len(compiled.mids))
+		compiled.mids = append(compiled.mids, node.Mid)
+		if flat.left, err = c.compileNode(node.Left); err != nil {
+			return 0, err
+		}
+		if flat.right, err = c.compileNode(node.Right); err != nil {
+			return 0, err
+		}
+		if flat.pass, err = c.compileNode(node.Pass); err != nil {
+			return 0, err
+		}
+	case *TypedHashNode[T]:
+		flat.kind = compiledNodeHash
+		if flat.dim, err = c.dim(node.dim, node.DimName); err != nil {
+			return 0, err
+		}
+		var edges []compiledEdge
+		for key, child := range node.child {
+			childIndex, err := c.compileNode(child)
+			if err != nil {
+				return 0, err
+			}
+			edges = append(edges, compiledEdge{key: key, node: childIndex})
+		}
+		sort.Slice(edges, func(i, j int) bool { return edges[i].key < edges[j].key })
+		flat.span.from = int32(len(compiled.hashEdges))
+		compiled.hashEdges = append(compiled.hashEdges, edges...)
+		flat.span.to = int32(len(compiled.hashEdges))
+		if flat.pass, err = c.compileNode(node.pass); err != nil {
+			return 0, err
+		}
+		if flat.other, err = c.compileNode(node.other); err != nil {
+			return 0, err
+		}
+	case *TypedConjunctionNode[T]:
+		flat.kind = compiledNodeConjunction
+		flat.index = int32(len(compiled.conjunctions))
+		conjunction, err := c.compileConjunction(node)
+		if err != nil {
+			return 0, err
+		}
+		compiled.conjunctions = append(compiled.conjunctions, conjunction)
+	default:
+		return 0, errors.New(fmt.Sprintf("compile not support node type:%T", node))
+	}
+
+	compiled.nodes[index] = flat
+	return index, nil
+}
+
+func (c *compiler[T]) appendPostings(list []int) compiledSpan {
+	span := compiledSpan{from: int32(len(c.compiled.postings))}
+	for _, segIndex := range list {
+		c.compiled.postings = append(c.compiled.postings, int32(segIndex))
+	}
+	span.to = int32(len(c.compiled.postings))
+	return span
+}
+
+func (c *compiler[T]) compileConjunction(node *TypedConjunctionNode[T]) (compiledConjunction, error) {
+	compiled := c.compiled
+	conjunction := compiledConjunction{}
+
+	var segs []int32
+	for _, seg := range node.segments {
+		id, err := c.segment(seg)
+		if err != nil {
+			return conjunction, err
+		}
+		segs = append(segs, id)
+	}
+	conjunction.segments.from = int32(len(compiled.conjSegs))
+	compiled.conjSegs = append(compiled.conjSegs, segs...)
+	conjunction.segments.to = int32(len(compiled.conjSegs))
+	if len(segs) > compiled.maxConjSegs {
+		compiled.maxConjSegs = len(segs)
+	}
+
+	conjunction.unconstrained.from = int32(len(compiled.conjSegs))
+	for _, segIndex := range node.unconstrained {
+		compiled.conjSegs = append(compiled.conjSegs, int32(segIndex))
+	}
+	conjunction.unconstrained.to = int32(len(compiled.conjSegs))
+
+	var dims []compiledInvertedDim
+	for _, conjunctionDim := range node.dims {
+		dim, err := c.dim(conjunctionDim.dim, conjunctionDim.node)
+		if err != nil {
+			return conjunction, err
+		}
+
+		switch dimNode := conjunctionDim.node.(type) {
+		case *ConjunctionDimRealNode:
+			if len(dimNode.segments) == 0 {
+				continue
+			}
+			invertedDim := compiledInvertedDim{dim: dim, real: true}
+			invertedDim.points.from = int32(len(compiled.splitPoints))
+			compiled.splitPoints = append(compiled.splitPoints, dimNode.splitPoints...)
+			invertedDim.points.to = int32(len(compiled.splitPoints))
+
+			invertedDim.atoms.from = int32(len(compiled.invertedLists))
+			for _, list := range dimNode.segments {
+				compiled.invertedLists = append(compiled.invertedLists, c.appendPostings(list))
+			}
+			invertedDim.atoms.to = int32(len(compiled.invertedLists))
+			dims = append(dims, invertedDim)
+		case *ConjunctionDimDiscreteNode:
+			if dimNode.segments == nil {
+				continue
+			}
+			invertedDim := compiledInvertedDim{dim: dim}
+
+			var keys []compiledInvertedKey
+			for key, list := range dimNode.segments {
+				keys = append(keys, compiledInvertedKey{
+					key:        compiled.schema.intern(key),
+					segments:   c.appendPostings(list),
+					excludedBy: c.appendPostings(dimNode.excludedBy[key]),
+				})
+			}
+			sort.Slice(keys, func(i, j int) bool { return keys[i].key < keys[j].key })
+			invertedDim.keys.from = int32(len(compiled.invertedKeys))
+			compiled.invertedKeys = append(compiled.invertedKeys, keys...)
+			invertedDim.keys.to = int32(len(compiled.invertedKeys))
+
+			invertedDim.excluded = c.appendPostings(dimNode.excluded)
+			dims = append(dims, invertedDim)
+		}
+	}
+	conjunction.dims.from = int32(len(compiled.invertedDims))
+	compiled.invertedDims = append(compiled.invertedDims, dims...)
+	conjunction.dims.to = int32(len(compiled.invertedDims))
+
+	return conjunction, nil
+}
+
+// compiledSearch holds the buffers of one search: the point encoded by dim
+// index, and epoch stamps of the visited segments, of the returned data and of
+// the conjunction node counters.
+type compiledSearch[T comparable] struct {
+	point EncodedPoint
+
+	epoch      uint32
+	segStamps  []uint32
+	dataStamps []uint32
+
+	counter conjunctionCounter
+
+	results []T
+}
+
+func (compiled *TypedCompiledTree[T]) newSearch() *compiledSearch[T] {
+	s := &compiledSearch[T]{
+		segStamps:  make([]uint32, len(compiled.segments)),
+		dataStamps: make([]uint32, len(compiled.data)),
+	}
+	s.counter.reset(compiled.maxConjSegs)
+	return s
+}
+
+// Search returns the distinct data of the segments containing the point.
+func (compiled *TypedCompiledTree[T]) Search(p Point) []T {
+	s := compiled.pool.Get().(*compiledSearch[T])
+	s.epoch = nextEpoch(s.epoch, s.segStamps)
+	if s.epoch == 1 {
+		for i := range s.dataStamps {
+			s.dataStamps[i] = 0
+		}
+	}
+
+	compiled.schema.EncodeInto(&s.point, p)
+	s.results = s.results[:0]
+	if len(compiled.nodes) > 0 {
+		compiled.walk(s, 0)
+	}
+
+	var result []T
+	if len(s.results) > 0 {
+		result = append(result, s.results...)
+	}
+	s.point.release()
+	compiled.pool.Put(s)
+	return result
+}
+
+func (compiled *TypedCompiledTree[T]) walk(s *compiledSearch[T], index int32) {
+	if index < 0 {
+		return
+	}
+
+	node := &compiled.nodes[index]
+	switch node.kind {
+	case compiledNodeLeaf:
+		for _, segIndex := range compiled.leafSegs[node.span.from:node.span.to] {
+			if s.segStamps[segIndex] == s.epoch {
+				continue
+			}
+			s.segStamps[segIndex] = s.epoch
+			if compiled.contains(s, segIndex) {
+				compiled.emit(s, segIndex)
+			}
+		}
+	case compiledNodeBinary:
+		compiled.walk(s, node.pass)
+
+		x := s.point.Value(int(node.dim))
+		if x == nil {
+			return
+		}
+
+		mid := compiled.mids[node.index]
+		searchLeft, searchRight := false, false
+		if set, ok := x.(MeasureSet); ok {
+			for _, m := range set {
+				if m.Smaller(mid) {
+					searchLeft = true
+				} else {
+					searchRight = true
+				}
+			}
+		} else if x.Smaller(mid) {
+			searchLeft = true
+		} else {
+			searchRight = true
+		}
+
+		if searchLeft {
+			compiled.walk(s, node.left)
+		}
+		if searchRight {
+			compiled.walk(s, node.right)
+		}
+	case compiledNodeHash:
+		compiled.walk(s, node.pass)
+
+		if s.point.Value(int(node.dim)) == nil {
+			return
+		}
+
+		edges := compiled.hashEdges[node.span.from:node.span.to]
+		searchOther := matchHashValues(s.point.ValueIDs(int(node.dim)), func(id int32) bool {
+			child, ok := searchEdges(edges, id)
+			if ok {
+				compiled.walk(s, child)
+			}
+			return ok
+		})
+		if searchOther {
+			compiled.walk(s, node.other)
+		}
+	case compiledNodeConjunction:
+		compiled.walkConjunction(s, &compiled.conjunctions[node.index])
+	}
+}
+
+// searchEdges returns the child of the key and whether there is one.
+func searchEdges(edges []compiledEdge, key int32) (int32, bool) {
+	if key < 0 {
+		return -1, false
+	}
+	lo, hi := 0, len(edges)
+	for lo < hi {
+		h := int(uint(lo+hi) >> 1)
+		if edges[h].key < key {
+			lo = h + 1
+		} else {
+			hi = h
+		}
+	}
+	if lo < len(edges) && edges[lo].key == key {
+		return edges[lo].node, true
+	}
+	return -1, false
+}
+
+// searchKeys returns the position of the key in the key table, -1 when it is
+// not there.
+func searchKeys(keys []compiledInvertedKey, key int32) int {
+	if key < 0 {
+		return -1
+	}
+	lo, hi := 0, len(keys)
+	for lo < hi {
+		h := int(uint(lo+hi) >> 1)
+		if keys[h].key < key {
+			lo = h + 1
+		} else {
+			hi = h
+		}
+	}
+	if lo < len(keys) && keys[lo].key == key {
+		return lo
+	}
+	return -1
+}
+
+// contains is Rect.Contains for the encoded point.
+func (compiled *TypedCompiledTree[T]) contains(s *compiledSearch[T], segIndex int32) bool {
+	seg := &compiled.segments[segIndex]
+	for i := seg.constraints.from; i < seg.constraints.to; i++ {
+		constraint := &compiled.constraints[i]
+		x := s.point.Value(int(constraint.dim))
+		if x == nil {
+			return false
+		}
+
+		switch constraint.kind {
+		case segmentDimInterval:
+			if constraint.interval.Contains(x) == false {
+				return false
+			}
+		case segmentDimMeasures, segmentDimExcluded:
+			values := compiled.valueIDs[constraint.values.from:constraint.values.to]
+			excluded := constraint.kind == segmentDimExcluded
+			found := false
+			for _, id := range s.point.ValueIDs(int(constraint.dim)) {
+				if containsID(values, id) != excluded {
+					found = true
+					break
+				}
+			}
+			if found == false {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (compiled *TypedCompiledTree[T]) emit(s *compiledSearch[T], segIndex int32) {
+	seg := &compiled.segments[segIndex]
+	for _, dataIndex := range compiled.dataIDs[seg.data.from:seg.data.to] {
+		if s.dataStamps[dataIndex] != s.epoch {
+			s.dataStamps[dataIndex] = s.epoch
+			s.results = append(s.results, compiled.data[dataIndex])
+		}
+	}
+}
+
+func (compiled *TypedCompiledTree[T]) walkConjunction(s *compiledSearch[T], conjunction *compiledConjunction) {
+	segs := compiled.conjSegs[conjunction.segments.from:conjunction.segments.to]
+	for _, pos := range compiled.conjSegs[conjunction.unconstrained.from:conjunction.unconstrained.to] {
+		if segIndex := segs[pos]; s.segStamps[segIndex] != s.epoch {
+			s.segStamps[segIndex] = s.epoch
+			compiled.emit(s, segIndex)
+		}
+	}
+
+	s.counter.reset(len(segs))
+
+	for _, invertedDim := range compiled.invertedDims[conjunction.dims.from:conjunction.dims.to] {
+		x := s.point.Value(int(invertedDim.dim))
+		if x == nil {
+			continue
+		}
+
+		s.counter.nextDim()
+		if invertedDim.real {
+			points := compiled.splitPoints[invertedDim.points.from:invertedDim.points.to]
+			atoms := compiled.invertedLists[invertedDim.atoms.from:invertedDim.atoms.to]
+			for _, m := range pointValues(x) {
+				atom := atoms[splitAtomPos(points, m)]
+				s.counter.countPostings(compiled.postings[atom.from:atom.to])
+			}
+			continue
+		}
+
+		keys := compiled.invertedKeys[invertedDim.keys.from:invertedDim.keys.to]
+		excluded := compiled.postings[invertedDim.excluded.from:invertedDim.excluded.to]
+		for _, id := range s.point.ValueIDs(int(invertedDim.dim)) {
+			var excludedBy []int32
+			if pos := searchKeys(keys, id); pos >= 0 {
+				s.counter.countPostings(compiled.postings[keys[pos].segments.from:keys[pos].segments.to])
+				excludedBy = compiled.postings[keys[pos].excludedBy.from:keys[pos].excludedBy.to]
+			}
+			for _, segPos := range excluded {
+				for len(excludedBy) > 0 && excludedBy[0] < segPos {
+					excludedBy = excludedBy[1:]
+				}
+				if len(excludedBy) > 0 && excludedBy[0] == segPos {
+					continue
+				}
+				s.counter.count(int(segPos))
+			}
+		}
+	}
+
+	for _, pos := range s.counter.touched {
+		segIndex := segs[pos]
+		seg := &compiled.segments[segIndex]
+		if s.counter.counters[pos] == int(seg.constraints.to-seg.constraints.from) && s.segStamps[segIndex] != s.epoch {
+			s.segStamps[segIndex] = s.epoch
+			compiled.emit(s, segIndex)
+		}
+	}
+}
+
+// countPostings counts the current dim for the segments at the positions.
+func (c *conjunctionCounter) countPostings(positions []int32) {
+	for _, pos := range positions {
+		c.count(int(pos))
+	}
+}
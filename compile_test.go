@@ -0,0 +1,123 @@
+package go_kd_segment_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestTree_Compile(t *testing.T) {
+	rnd := rand.New(rand.NewSource(18))
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "tag": DimTypeDiscrete, "age": DimTypeReal, "score": DimTypeReal}
+
+	randRect := func() Rect {
+		rect := Rect{}
+		switch rnd.Intn(3) {
+		case 0:
+			rect["country"] = Measures{MeasureString(fmt.Sprint("c", rnd.Intn(6)))}
+		case 1:
+			rect["country"] = ExcludedMeasures{MeasureString(fmt.Sprint("c", rnd.Intn(6))), MeasureString(fmt.Sprint("c", rnd.Intn(6)))}
+		}
+		if rnd.Intn(2) == 0 {
+			rect["tag"] = Measures{MeasureInt(rnd.Intn(10)), MeasureUint(rnd.Intn(10))}
+		}
+		if rnd.Intn(3) > 0 {
+			from := rnd.Intn(60)
+			rect["age"] = Interval{MeasureInt(from), Exclusive{MeasureInt(from + rnd.Intn(30))}}
+		}
+		switch rnd.Intn(4) {
+		case 0:
+			rect["score"] = Interval{MeasureFloat(rnd.Float64()), nil}
+		case 1:
+			rect["score"] = Interval{nil, Exclusive{MeasureFloat(rnd.Float64())}}
+		}
+		return rect
+	}
+	randPoint := func() Point {
+		p := Point{}
+		if rnd.Intn(5) > 0 {
+			p["country"] = MeasureString(fmt.Sprint("c", rnd.Intn(7)))
+		}
+		switch rnd.Intn(3) {
+		case 0:
+			p["tag"] = MeasureSet{MeasureInt(rnd.Intn(10)), MeasureUint(rnd.Intn(10)), MeasureInt(rnd.Intn(12))}
+		case 1:
+			p["tag"] = MeasureInt(rnd.Intn(12))
+		}
+		if rnd.Intn(5) > 0 {
+			p["age"] = MeasureInt(rnd.Intn(90))
+		} else if rnd.Intn(2) == 0 {
+			p["age"] = MeasureSet{MeasureInt(rnd.Intn(90)), MeasureInt(rnd.Intn(90))}
+		}
+		if rnd.Intn(3) > 0 {
+			p["score"] = MeasureFloat(rnd.Float64())
+		}
+		return p
+	}
+
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 4, TreeLevelMax: 4},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+	} {
+		tree := NewTypedTree[int](dimTypes, opts)
+		if _, err := tree.Compile(); err == nil {
+			t.Fatal("compile of a tree not built error")
+		}
+
+		for i := 0; i < 500; i++ {
+			// several segments share each data
+			_ = tree.Add(randRect(), i%200)
+		}
+		_ = tree.Add(Rect{}, 1000)
+		tree.Build()
+
+		check := func() {
+			compiled, err := tree.Compile()
+			if err != nil {
+				t.Fatal("compile error:", err)
+			}
+			for i := 0; i < 500; i++ {
+				p := randPoint()
+				result := compiled.Search(p)
+				expected := tree.Search(p)
+				sort.Ints(result)
+				sort.Ints(expected)
+				if fmt.Sprint(result) != fmt.Sprint(expected) {
+					t.Fatal("compiled search error:", p, result, expected)
+				}
+			}
+		}
+		check()
+
+		for i := 0; i < 50; i++ {
+			_ = tree.Insert(randRect(), 200+i)
+			_ = tree.Upsert(fmt.Sprint("rule", i%10), randRect(), 300+i)
+		}
+		tree.Remove(5)
+		tree.Delete("rule3")
+		check()
+
+		for i := 0; i < 100; i++ {
+			_ = tree.Add(randRect(), 400+i)
+		}
+		tree.Build()
+		check()
+	}
+}
+
+func BenchmarkCompiledTree_Search(b *testing.B) {
+	compiled, err := tree.Compile()
+	if err != nil {
+		b.Fatal("compile error:", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		p := searchPoint[i%len(searchPoint)]
+		_ = compiled.Search(p)
+	}
+}
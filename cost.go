@@ -0,0 +1,257 @@
+package go_kd_segment_tree
+
+import (
+	"sort"
+	"sync"
+)
+
+// encodeTraffic encodes the sampled queries of the options, nil without any.
+func (tree *TypedTree[T]) encodeTraffic() []*EncodedPoint {
+	var traffic []*EncodedPoint
+	for _, p := range tree.options.TrafficSample {
+		traffic = append(traffic, tree.schema.Encode(p))
+	}
+	return traffic
+}
+
+// findCheapestBranchingDim returns the split minimizing the number of segments
+// the sampled queries examine on average: the dim, the share of the segments
+// they skip, and the mid of a real dim. On a tie the first dim by schema index
+// and the smallest mid win.
+func findCheapestBranchingDim[T comparable](
+	segments []*TypedSegment[T],
+	traffic []*EncodedPoint,
+	tree *TypedTree[T],
+) (interface{}, float64, Measure) {
+	if len(segments) == 0 {
+		return nil, 0, nil
+	}
+
+	dims := tree.schema.dims
+	costs := make([]float64, len(dims))
+	mids := make([]Measure, len(dims))
+	var wg sync.WaitGroup
+	for i := range dims {
+		i := i
+		tree.goBuild(&wg, func() {
+			switch tree.schema.dimTypes[i].Type {
+			case DimTypeReal.Type:
+				mids[i], costs[i] = binaryCost(segments, dims[i], i, traffic)
+			case DimTypeDiscrete.Type:
+				costs[i] = hashCost(segments, dims[i], i, traffic, tree.schema)
+			}
+		})
+	}
+	wg.Wait()
+
+	var minCostDimName interface{}
+	var minCostMid Measure
+	var minCost = float64(len(segments))
+	for i, cost := range costs {
+		if cost < minCost {
+			minCost = cost
+			minCostDimName = dims[i]
+			minCostMid = mids[i]
+		}
+	}
+
+	p := (float64(len(segments)) - minCost) / float64(len(segments))
+	return minCostDimName, p, minCostMid
+}
+
+// binaryCost returns the mid of the real dim minimizing the number of segments
+// the queries examine on average in a binary node, and that number; the number
+// of segments when no mid splits them.
+func binaryCost[T comparable](segments []*TypedSegment[T], dimName interface{}, dim int, traffic []*EncodedPoint) (Measure, float64) {
+	var lowers, uppers []bound
+	var candidates []Measure
+	for _, seg := range segments {
+		if interval, ok := seg.Rect[dimName].(Interval); ok {
+			lower, upper := interval.lowerBound(), interval.upperBound()
+			lowers = append(lowers, lower)
+			uppers = append(uppers, upper)
+			if lower.m != nil {
+				candidates = append(candidates, lower.m)
+			}
+			if upper.m != nil {
+				candidates = append(candidates, upper.m)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, float64(len(segments))
+	}
+	sort.Sort(sortBounds(lowers))
+	sort.Sort(sortBounds(uppers))
+	sort.Stable(&sortMeasures{measures: candidates})
+
+	// a query goes left when its smallest value is below the mid and right
+	// when its biggest one is not. Values of another type than the bounds
+	// never compare, so that they go right whatever the mid and are kept out
+	// of the sorted values.
+	var mins, maxs []Measure
+	var alwaysRight int
+	for _, p := range traffic {
+		var min, max Measure
+		incomparable := false
+		for _, m := range pointValues(p.Value(dim)) {
+			if comparableMeasures(m, candidates[0]) == false {
+				incomparable = true
+				continue
+			}
+			if min == nil || m.Smaller(min) {
+				min = m
+			}
+			if max == nil || max.Smaller(m) {
+				max = m
+			}
+		}
+		if min != nil {
+			mins = append(mins, min)
+		}
+		if incomparable {
+			alwaysRight++
+		} else if max != nil {
+			maxs = append(maxs, max)
+		}
+	}
+	sort.Stable(&sortMeasures{measures: mins})
+	sort.Stable(&sortMeasures{measures: maxs})
+
+	var minCostMid Measure
+	var minCost = float64(len(segments))
+	for i, mid := range candidates {
+		if i > 0 && mid.Equal(candidates[i-1]) {
+			continue
+		}
+
+		midBound := bound{m: mid}
+		left := sort.Search(len(uppers), func(i int) bool { return uppers[i].compare(midBound) >= 0 })
+		right := len(lowers) - sort.Search(len(lowers), func(i int) bool { return lowers[i].compare(midBound) >= 0 })
+		if left == 0 && right == 0 {
+			continue
+		}
+
+		leftQueries := sort.Search(len(mins), func(i int) bool { return mins[i].Smaller(mid) == false })
+		rightQueries := alwaysRight + len(maxs) - sort.Search(len(maxs), func(i int) bool { return maxs[i].Smaller(mid) == false })
+
+		pass := len(segments) - left - right
+		cost := float64(pass) + float64(left*leftQueries+right*rightQueries)/float64(len(traffic))
+		if cost < minCost {
+			minCost = cost
+			minCostMid = mid
+		}
+	}
+	return minCostMid, minCost
+}
+
+// comparableMeasures reports whether the measures are ordered against each
+// other, as measures of the same type are.
+func comparableMeasures(a, b Measure) bool {
+	return a.Smaller(b) || a.Bigger(b) || a.Equal(b)
+}
+
+// hashCost returns the number of segments the queries examine on average in a
+// hash node on the discrete dim.
+func hashCost[T comparable](segments []*TypedSegment[T], dimName interface{}, dim int, traffic []*EncodedPoint, schema *Schema) float64 {
+	passSegments, children, otherSegments := partitionHashSegments(segments, dimName)
+	if len(passSegments) == len(segments) {
+		return float64(len(segments))
+	}
+
+	childSizes := make(map[int32]int, len(children))
+	for key, childSegments := range children {
+		if id, ok := schema.ValueID(key); ok {
+			childSizes[id] = len(childSegments)
+		}
+	}
+
+	var examined int
+	for _, p := range traffic {
+		if p.Value(dim) == nil {
+			continue
+		}
+
+		searchOther := matchHashValues(p.ValueIDs(dim), func(id int32) bool {
+			size, ok := childSizes[id]
+			examined += size
+			return ok
+		})
+		if searchOther {
+			examined += len(otherSegments)
+		}
+	}
+	return float64(len(passSegments)) + float64(examined)/float64(len(traffic))
+}
+
+// splitBinaryTraffic returns the queries searched on the left and on the right
+// of the binary node.
+func splitBinaryTraffic[T comparable](traffic []*EncodedPoint, node *TypedBinaryNode[T]) ([]*EncodedPoint, []*EncodedPoint) {
+	if node == nil {
+		return nil, nil
+	}
+
+	var left, right []*EncodedPoint
+	for _, p := range traffic {
+		x := p.Value(node.dim)
+		if x == nil {
+			continue
+		}
+
+		searchLeft, searchRight := false, false
+		if set, ok := x.(MeasureSet); ok {
+			for _, m := range set {
+				if m.Smaller(node.Mid) {
+					searchLeft = true
+				} else {
+					searchRight = true
+				}
+			}
+		} else if x.Smaller(node.Mid) {
+			searchLeft = true
+		} else {
+			searchRight = true
+		}
+
+		if searchLeft {
+			left = append(left, p)
+		}
+		if searchRight {
+			right = append(right, p)
+		}
+	}
+	return left, right
+}
+
+// splitHashTraffic returns the queries searched in the children with the ids,
+// by child, and in the other branch of a hash node on the dim.
+func splitHashTraffic(traffic []*EncodedPoint, dim int, childIDs []int32) ([][]*EncodedPoint, []*EncodedPoint) {
+	children := make([][]*EncodedPoint, len(childIDs))
+	if len(traffic) == 0 {
+		return children, nil
+	}
+
+	childIndex := make(map[int32]int, len(childIDs))
+	for i, id := range childIDs {
+		childIndex[id] = i
+	}
+
+	var other []*EncodedPoint
+	for _, p := range traffic {
+		if p.Value(dim) == nil {
+			continue
+		}
+
+		searchOther := matchHashValues(p.ValueIDs(dim), func(id int32) bool {
+			child, ok := childIndex[id]
+			if ok {
+				children[child] = append(children[child], p)
+			}
+			return ok
+		})
+		if searchOther {
+			other = append(other, p)
+		}
+	}
+	return children, other
+}
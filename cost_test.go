@@ -0,0 +1,266 @@
+package go_kd_segment_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// skewedRules returns rules spread evenly over the countries and the ages,
+// and points where most of the traffic comes from a few countries.
+func skewedRules(rnd *rand.Rand) ([]Rect, []Point) {
+	var rects []Rect
+	for i := 0; i < 5000; i++ {
+		from := rnd.Intn(100)
+		rects = append(rects, Rect{
+			"country": Measures{MeasureString(fmt.Sprint("c", rnd.Intn(50)))},
+			"age":     Interval{MeasureInt(from), Exclusive{MeasureInt(from + 1 + rnd.Intn(20))}},
+			"device":  Measures{MeasureString(fmt.Sprint("d", rnd.Intn(3)))},
+		})
+	}
+
+	var points []Point
+	for i := 0; i < 2000; i++ {
+		country := rnd.Intn(50)
+		if rnd.Intn(10) > 0 {
+			country = rnd.Intn(2)
+		}
+		points = append(points, Point{
+			"country": MeasureString(fmt.Sprint("c", country)),
+			"age":     MeasureInt(20 + rnd.Intn(5)),
+			"device":  MeasureString(fmt.Sprint("d", rnd.Intn(3))),
+		})
+	}
+	return rects, points
+}
+
+// examinedSegments returns the number of segments the search of the point
+// examines in the node.
+func examinedSegments[T comparable](node TypedTreeNode[T], p *EncodedPoint) int {
+	if isNilNode(node) {
+		return 0
+	}
+
+	switch node := node.(type) {
+	case *TypedLeafNode[T]:
+		return len(node.Segments)
+	case *TypedConjunctionNode[T]:
+		return len(node.segments)
+	case *TypedBinaryNode[T]:
+		examined := examinedSegments(node.Pass, p)
+		left, right := splitBinaryTraffic([]*EncodedPoint{p}, node)
+		if len(left) > 0 {
+			examined += examinedSegments(node.Left, p)
+		}
+		if len(right) > 0 {
+			examined += examinedSegments(node.Right, p)
+		}
+		return examined
+	case *TypedHashNode[T]:
+		examined := examinedSegments(node.pass, p)
+		var childIDs []int32
+		for id := range node.child {
+			childIDs = append(childIDs, id)
+		}
+		children, other := splitHashTraffic([]*EncodedPoint{p}, node.dim, childIDs)
+		for i, child := range children {
+			if len(child) > 0 {
+				examined += examinedSegments(node.child[childIDs[i]], p)
+			}
+		}
+		if len(other) > 0 {
+			examined += examinedSegments(node.other, p)
+		}
+		return examined
+	}
+	return 0
+}
+
+func TestTree_TrafficSample(t *testing.T) {
+	rnd := rand.New(rand.NewSource(22))
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "age": DimTypeReal, "device": DimTypeDiscrete}
+
+	randRect := func() Rect {
+		rect := Rect{}
+		switch rnd.Intn(3) {
+		case 0:
+			rect["country"] = Measures{MeasureString(fmt.Sprint("c", rnd.Intn(8)))}
+		case 1:
+			rect["country"] = ExcludedMeasures{MeasureString(fmt.Sprint("c", rnd.Intn(8)))}
+		}
+		if rnd.Intn(3) > 0 {
+			from := rnd.Intn(60)
+			rect["age"] = Interval{MeasureInt(from), Exclusive{MeasureInt(from + rnd.Intn(30))}}
+		} else if rnd.Intn(2) == 0 {
+			rect["age"] = Interval{nil, MeasureInt(rnd.Intn(60))}
+		}
+		if rnd.Intn(2) == 0 {
+			rect["device"] = Measures{MeasureString(fmt.Sprint("d", rnd.Intn(3))), MeasureString(fmt.Sprint("d", rnd.Intn(3)))}
+		}
+		return rect
+	}
+	randPoint := func() Point {
+		p := Point{}
+		if rnd.Intn(5) > 0 {
+			p["country"] = MeasureString(fmt.Sprint("c", rnd.Intn(2)))
+		} else if rnd.Intn(2) == 0 {
+			p["country"] = MeasureSet{MeasureString(fmt.Sprint("c", rnd.Intn(10))), MeasureString(fmt.Sprint("c", rnd.Intn(10)))}
+		}
+		if rnd.Intn(5) > 0 {
+			p["age"] = MeasureInt(20 + rnd.Intn(10))
+		} else if rnd.Intn(2) == 0 {
+			p["age"] = MeasureSet{MeasureInt(rnd.Intn(90)), MeasureInt(rnd.Intn(90))}
+		}
+		if rnd.Intn(3) > 0 {
+			p["device"] = MeasureString(fmt.Sprint("d", rnd.Intn(4)))
+		}
+		return p
+	}
+
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 2, BuildWorkers: 4},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+	} {
+		for i := 0; i < 200; i++ {
+			opts.TrafficSample = append(opts.TrafficSample, randPoint())
+		}
+		tree := NewTypedTree[int](dimTypes, opts)
+		var rects []Rect
+		for i := 0; i < 500; i++ {
+			rects = append(rects, randRect())
+			_ = tree.Add(rects[i], i)
+		}
+		tree.Build()
+
+		// inserted rects reach new keys of the hash nodes
+		for i := 500; i < 700; i++ {
+			rects = append(rects, randRect())
+			if err := tree.Insert(rects[i], i); err != nil {
+				t.Fatal("insert error:", err)
+			}
+		}
+
+		for i := 0; i < 300; i++ {
+			p := randPoint()
+			var expected []int
+			for data, rect := range rects {
+				if rect.Contains(p) {
+					expected = append(expected, data)
+				}
+			}
+			result := tree.Search(p)
+			sort.Ints(result)
+			if fmt.Sprint(result) != fmt.Sprint(expected) {
+				t.Fatal("sampled build search error:", p, result, expected)
+			}
+		}
+	}
+
+	// the sampled tree examines fewer segments for the skewed traffic
+	rects, points := skewedRules(rnd)
+	var examined []int
+	for _, sample := range [][]Point{nil, points[:500]} {
+		tree := NewTypedTree[int](dimTypes, &TreeOptions{Seed: 22, TreeLevelMax: 8, TrafficSample: sample})
+		for i, rect := range rects[:2000] {
+			_ = tree.Add(rect, i)
+		}
+		tree.Build()
+
+		n := 0
+		for _, p := range points[500:] {
+			n += examinedSegments(tree.snapshot(), tree.Schema().Encode(p))
+		}
+		examined = append(examined, n)
+	}
+	if examined[1] >= examined[0] {
+		t.Fatal("sampled build examines more segments:", examined)
+	}
+}
+
+func TestTree_MixedTrafficCost(t *testing.T) {
+	rnd := rand.New(rand.NewSource(22))
+	schema := NewSchema(DimTypes{"age": DimTypeReal})
+	var segments []*TypedSegment[int]
+	for i := 0; i < 200; i++ {
+		from := rnd.Intn(100)
+		segments = append(segments, &TypedSegment[int]{
+			Rect: Rect{"age": Interval{MeasureInt(from), Exclusive{MeasureInt(from + 1 + rnd.Intn(20))}}},
+		})
+	}
+
+	// floats never compare with the int bounds, so that their queries go right
+	var traffic []*EncodedPoint
+	for i := 0; i < 300; i++ {
+		var x Measure = MeasureInt(rnd.Intn(120))
+		switch rnd.Intn(4) {
+		case 0:
+			x = MeasureFloat(rnd.Float64() * 120)
+		case 1:
+			x = MeasureSet{MeasureInt(rnd.Intn(120)), MeasureFloat(rnd.Float64() * 120)}
+		}
+		traffic = append(traffic, schema.Encode(Point{"age": x}))
+	}
+
+	cost := func(mid Measure) float64 {
+		left, right := splitBinaryTraffic(traffic, &TypedBinaryNode[int]{dim: 0, Mid: mid})
+		leftSegments, rightSegments := 0, 0
+		for _, seg := range segments {
+			interval := seg.Rect["age"].(Interval)
+			if interval.upperBound().compare(bound{m: mid}) < 0 {
+				leftSegments++
+			} else if interval.lowerBound().compare(bound{m: mid}) >= 0 {
+				rightSegments++
+			}
+		}
+		pass := len(segments) - leftSegments - rightSegments
+		return float64(pass) + float64(leftSegments*len(left)+rightSegments*len(right))/float64(len(traffic))
+	}
+
+	mid, minCost := binaryCost(segments, "age", 0, traffic)
+	if mid == nil || cost(mid) != minCost {
+		t.Fatal("mixed traffic cost error:", mid, minCost, cost(mid))
+	}
+	for _, seg := range segments {
+		interval := seg.Rect["age"].(Interval)
+		for _, candidate := range []Measure{interval.lowerBound().m, interval.upperBound().m} {
+			if cost(candidate) < minCost {
+				t.Fatal("mixed traffic mid error:", mid, minCost, candidate, cost(candidate))
+			}
+		}
+	}
+}
+
+func BenchmarkTree_SkewedTraffic(b *testing.B) {
+	rnd := rand.New(rand.NewSource(22))
+	rects, points := skewedRules(rnd)
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "age": DimTypeReal, "device": DimTypeDiscrete}
+
+	for _, sampled := range []bool{false, true} {
+		opts := &TreeOptions{Seed: 22, TreeLevelMax: 8}
+		if sampled {
+			opts.TrafficSample = points[:500]
+		}
+		tree := NewTypedTree[int](dimTypes, opts)
+		for i, rect := range rects {
+			_ = tree.Add(rect, i)
+		}
+		tree.Build()
+
+		b.Run(fmt.Sprint("sampled=", sampled), func(b *testing.B) {
+			var examined int
+			for _, p := range points[500:] {
+				examined += examinedSegments(tree.snapshot(), tree.Schema().Encode(p))
+			}
+
+			searcher := tree.NewSearcher()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = searcher.Search(points[500+i%1500])
+			}
+			b.ReportMetric(float64(examined)/float64(len(points[500:])), "segments/op")
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package go_kd_segment_tree
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Explanation tells why a search for a point did or did not return some data.
+type Explanation struct {
+	// Matched reports whether Search returns the data for the point.
+	Matched  bool
+	Segments []SegmentExplanation
+}
+
+// SegmentExplanation checks one segment carrying the data against the point,
+// dim by dim, and lists the tree paths leading to the nodes holding it. A
+// segment added but not built yet has no path.
+type SegmentExplanation struct {
+	ID      string
+	Rect    Rect
+	Matched bool
+	Dims    []DimExplanation
+	Paths   []ExplainPath
+}
+
+// DimExplanation is the check of one dim of a segment rect; Value is nil when
+// the point lacks the dim, which fails any constraint.
+type DimExplanation struct {
+	DimName    interface{}
+	Constraint interface{}
+	Value      Measure
+	Passed     bool
+}
+
+// ExplainPath is the path from the root to a node holding the segment. Reached
+// reports whether a search for the point follows every step of the path, and
+// Matched whether the last node then returns the segment data.
+type ExplainPath struct {
+	Steps   []ExplainStep
+	Reached bool
+	Matched bool
+}
+
+// ExplainStep is one node of a path. Binary nodes go to the Left or Right of
+// Key, their mid, or to their Pass branch; hash nodes go to the child of Key,
+// to the Other branch of the excluded values or to their Pass branch.
+// Conjunction nodes count the dims of the segment matched by the point.
+type ExplainStep struct {
+	Node     string
+	Level    int
+	DimName  interface{}
+	Branch   string
+	Key      Measure
+	Value    Measure
+	Followed bool
+
+	Counter  int
+	Required int
+}
+
+const (
+	ExplainNodeLeaf        = "leaf"
+	ExplainNodeBinary      = "binary"
+	ExplainNodeHash        = "hash"
+	ExplainNodeConjunction = "conjunction"
+
+	ExplainBranchLeft  = "left"
+	ExplainBranchRight = "right"
+	ExplainBranchPass  = "pass"
+	ExplainBranchKey   = "key"
+	ExplainBranchOther = "other"
+)
+
+func (e *Explanation) String() string {
+	var msgs []string
+	msgs = append(msgs, fmt.Sprintf("matched:%v", e.Matched))
+	for _, seg := range e.Segments {
+		msgs = append(msgs, fmt.Sprintf("  segment{id:%q, matched:%v}", seg.ID, seg.Matched))
+		for _, dim := range seg.Dims {
+			msgs = append(msgs, fmt.Sprintf("    dim %v %v: value %v, passed:%v",
+				dim.DimName, dim.Constraint, dim.Value, dim.Passed))
+		}
+		if len(seg.Paths) == 0 {
+			msgs = append(msgs, "    not built")
+		}
+		for _, path := range seg.Paths {
+			var steps []string
+			for _, step := range path.Steps {
+				steps = append(steps, step.String())
+			}
+			msgs = append(msgs, fmt.Sprintf("    path{reached:%v, matched:%v}: %v",
+				path.Reached, path.Matched, strings.Join(steps, " -> ")))
+		}
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (s ExplainStep) String() string {
+	switch s.Node {
+	case ExplainNodeBinary:
+		if s.Branch == ExplainBranchPass {
+			return fmt.Sprintf("bnode{dim:%v} pass", s.DimName)
+		}
+		return fmt.Sprintf("bnode{dim:%v, mid:%v} %v of %v:%v", s.DimName, s.Key, s.Value, s.Branch, s.Followed)
+	case ExplainNodeHash:
+		switch s.Branch {
+		case ExplainBranchPass:
+			return fmt.Sprintf("hnode{dim:%v} pass", s.DimName)
+		case ExplainBranchOther:
+			return fmt.Sprintf("hnode{dim:%v} %v other:%v", s.DimName, s.Value, s.Followed)
+		}
+		return fmt.Sprintf("hnode{dim:%v} %v key %v:%v", s.DimName, s.Value, s.Key, s.Followed)
+	case ExplainNodeConjunction:
+		return fmt.Sprintf("conjunction_node %v/%v dims", s.Counter, s.Required)
+	}
+	return "leaf"
+}
+
+// Explain reports why a search for the point does or does not return data:
+// it checks every segment carrying data dim by dim, and follows the tree paths
+// to the nodes holding the segment to show where the search leaves them.
+func (tree *TypedTree[T]) Explain(p Point, data T) *Explanation {
+	root := tree.snapshot()
+
+	explanation := &Explanation{}
+	if root != nil {
+		for _, d := range root.Search(p) {
+			if d == data {
+				explanation.Matched = true
+			}
+		}
+	}
+
+	e := &explainer[T]{
+		p:     p,
+		data:  data,
+		index: make(map[*TypedSegment[T]]int),
+		keys:  make(map[string]bool),
+	}
+	e.explainNode(root, nil, true)
+
+	// segments not built yet
+	tree.updateMu.Lock()
+	for _, seg := range tree.segments {
+		if seg.Data.Contains(data) && e.keys[e.segmentKey(seg)] == false {
+			e.segment(seg)
+		}
+	}
+	tree.updateMu.Unlock()
+
+	explanation.Segments = e.segments
+	return explanation
+}
+
+type explainer[T comparable] struct {
+	p    Point
+	data T
+
+	segments []SegmentExplanation
+	index    map[*TypedSegment[T]]int
+	keys     map[string]bool
+}
+
+func (e *explainer[T]) segmentKey(seg *TypedSegment[T]) string {
+	return fmt.Sprintf("%q@%v", seg.ID, seg.Rect.Key())
+}
+
+// segment returns the explanation of the segment, checking its dims the first
+// time it is seen.
+func (e *explainer[T]) segment(seg *TypedSegment[T]) *SegmentExplanation {
+	if i, ok := e.index[seg]; ok {
+		return &e.segments[i]
+	}
+
+	explanation := SegmentExplanation{
+		ID:      seg.ID,
+		Rect:    seg.Rect.Clone(),
+		Matched: seg.Rect.Contains(e.p),
+	}
+	for dimName, constraint := range seg.Rect {
+		explanation.Dims = append(explanation.Dims, DimExplanation{
+			DimName:    dimName,
+			Constraint: constraint,
+			Value:      e.p[dimName],
+			Passed:     Rect{dimName: constraint}.Contains(e.p),
+		})
+	}
+	sort.Slice(explanation.Dims, func(i, j int) bool {
+		return fmt.Sprint(explanation.Dims[i].DimName) < fmt.Sprint(explanation.Dims[j].DimName)
+	})
+
+	e.index[seg] = len(e.segments)
+	e.keys[e.segmentKey(seg)] = true
+	e.segments = append(e.segments, explanation)
+	return &e.segments[len(e.segments)-1]
+}
+
+func (e *explainer[T]) addPath(seg *TypedSegment[T], steps []ExplainStep, reached bool, matched bool) {
+	explanation := e.segment(seg)
+	explanation.Paths = append(explanation.Paths, ExplainPath{
+		Steps:   steps,
+		Reached: reached,
+		Matched: reached && matched,
+	})
+}
+
+func (e *explainer[T]) explainNode(node TypedTreeNode[T], steps []ExplainStep, reached bool) {
+	next := func(step ExplainStep) []ExplainStep {
+		return append(append([]ExplainStep{}, steps...), step)
+	}
+
+	switch node := node.(type) {
+	case *TypedLeafNode[T]:
+		if node == nil {
+			return
+		}
+		for _, seg := range node.Segments {
+			if seg.Data.Contains(e.data) {
+				e.addPath(seg, next(ExplainStep{Node: ExplainNodeLeaf, Followed: reached}),
+					reached, seg.Rect.Contains(e.p))
+			}
+		}
+	case *TypedBinaryNode[T]:
+		if node == nil {
+			return
+		}
+		x := e.p[node.DimName]
+		left, right := false, false
+		for _, m := range pointValues(x) {
+			if m.Smaller(node.Mid) {
+				left = true
+			} else {
+				right = true
+			}
+		}
+
+		step := ExplainStep{Node: ExplainNodeBinary, Level: node.Level, DimName: node.DimName, Key: node.Mid, Value: x}
+		for _, branch := range []struct {
+			name     string
+			child    TypedTreeNode[T]
+			followed bool
+		}{
+			{ExplainBranchPass, node.Pass, true},
+			{ExplainBranchLeft, node.Left, left},
+			{ExplainBranchRight, node.Right, right},
+		} {
+			step.Branch, step.Followed = branch.name, branch.followed
+			e.explainNode(branch.child, next(step), reached && branch.followed)
+		}
+	case *TypedHashNode[T]:
+		if node == nil {
+			return
+		}
+		x := e.p[node.DimName]
+		keys := make(map[int32]bool)
+		other := false
+		for _, m := range pointValues(x) {
+			key, _ := node.Tree.schema.ValueID(m)
+			if _, ok := node.child[key]; ok {
+				keys[key] = true
+			} else {
+				other = true
+			}
+		}
+
+		step := ExplainStep{Node: ExplainNodeHash, Level: node.Level, DimName: node.DimName, Value: x}
+		step.Branch, step.Followed = ExplainBranchPass, true
+		e.explainNode(node.pass, next(step), reached)
+		step.Branch, step.Followed = ExplainBranchOther, other
+		e.explainNode(node.other, next(step), reached && other)
+		var childKeys []int32
+		for key := range node.child {
+			childKeys = append(childKeys, key)
+		}
+		schema := node.Tree.schema
+		sort.Slice(childKeys, func(i, j int) bool {
+			return fmt.Sprint(schema.Value(childKeys[i])) < fmt.Sprint(schema.Value(childKeys[j]))
+		})
+		for _, key := range childKeys {
+			step.Branch, step.Key, step.Followed = ExplainBranchKey, schema.Value(key), keys[key]
+			e.explainNode(node.child[key], next(step), reached && keys[key])
+		}
+	case *TypedConjunctionNode[T]:
+		if node == nil {
+			return
+		}
+		for i, seg := range node.segments {
+			if seg.Data.Contains(e.data) == false {
+				continue
+			}
+
+			counter := 0
+			for dimName := range seg.Rect {
+				if node.dimNode[dimName] == nil {
+					continue
+				}
+			values:
+				for _, m := range pointValues(e.p[dimName]) {
+					for _, segIndex := range node.dimNode[dimName].Search(m) {
+						if segIndex == i {
+							counter++
+							break values
+						}
+					}
+				}
+			}
+
+			step := ExplainStep{
+				Node:     ExplainNodeConjunction,
+				Level:    node.Level,
+				DimName:  node.DimName,
+				Followed: reached,
+				Counter:  counter,
+				Required: len(seg.Rect),
+			}
+			e.addPath(seg, next(step), reached, counter == len(seg.Rect))
+		}
+	}
+}
+
+// pointValues returns the values of a point dim, none when it is missing.
+func pointValues(x Measure) []Measure {
+	switch x := x.(type) {
+	case nil:
+		return nil
+	case MeasureSet:
+		return x
+	}
+	return []Measure{x}
+}
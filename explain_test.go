@@ -0,0 +1,110 @@
+package go_kd_segment_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestTree_Explain(t *testing.T) {
+	rnd := rand.New(rand.NewSource(13))
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "os": DimTypeDiscrete, "age": DimTypeReal}
+
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 1},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+	} {
+		tree := NewTypedTree[string](dimTypes, opts)
+		for i := 0; i < 100; i++ {
+			rect := Rect{
+				"country": Measures{MeasureString(fmt.Sprint("c", rnd.Intn(4)))},
+				"age":     Interval{MeasureInt(i % 50), MeasureInt(i%50 + 10)},
+			}
+			if rnd.Intn(3) == 0 {
+				rect["os"] = ExcludedMeasures{MeasureString("ios")}
+			}
+			_ = tree.Add(rect, fmt.Sprint("campaign", i%60))
+		}
+		_ = tree.Add(Rect{"country": Measures{MeasureString("c0")}}, "campaign0")
+		tree.Build()
+		_ = tree.Add(Rect{"age": Interval{MeasureInt(0), nil}}, "pending")
+
+		conjunction := false
+		for i := 0; i < 300; i++ {
+			p := Point{"country": MeasureString(fmt.Sprint("c", rnd.Intn(5)))}
+			if rnd.Intn(4) > 0 {
+				p["age"] = MeasureInt(rnd.Intn(70))
+			}
+			if rnd.Intn(2) > 0 {
+				p["os"] = MeasureString([]string{"ios", "android"}[rnd.Intn(2)])
+			}
+			data := fmt.Sprint("campaign", rnd.Intn(60))
+
+			e := tree.Explain(p, data)
+			segMatched, pathMatched := false, false
+			for _, seg := range e.Segments {
+				passed := true
+				for _, dim := range seg.Dims {
+					if dim.Value != p[dim.DimName] {
+						t.Fatal("explain dim value error:", dim)
+					}
+					if dim.Value == nil && dim.Passed {
+						t.Fatal("missing dim passed:", dim)
+					}
+					passed = passed && dim.Passed
+				}
+				if passed != seg.Matched || len(seg.Dims) != len(seg.Rect) {
+					t.Fatal("explain segment error:", e)
+				}
+				segMatched = segMatched || seg.Matched
+
+				if len(seg.Paths) == 0 {
+					t.Fatal("built segment without path:", e)
+				}
+				for _, path := range seg.Paths {
+					reached := true
+					for _, step := range path.Steps {
+						reached = reached && step.Followed
+						if step.Node == ExplainNodeConjunction {
+							conjunction = true
+						}
+						if (step.Node == ExplainNodeBinary || step.Node == ExplainNodeHash) &&
+							step.Branch != ExplainBranchPass && step.Value == nil && step.Followed {
+							t.Fatal("branch followed without the dim:", e)
+						}
+					}
+					if reached != path.Reached || (path.Matched && seg.Matched == false) {
+						t.Fatal("explain path error:", e)
+					}
+					pathMatched = pathMatched || path.Matched
+				}
+			}
+			if e.Matched != segMatched || e.Matched != pathMatched {
+				t.Fatal("explain match error:", p, data, e)
+			}
+		}
+		if opts.ConjunctionTargetRateMin > 0 && conjunction == false {
+			t.Fatal("no conjunction node explained")
+		}
+
+		e := tree.Explain(Point{"age": MeasureInt(5)}, "pending")
+		if e.Matched || len(e.Segments) != 1 || len(e.Segments[0].Paths) != 0 || e.Segments[0].Matched == false {
+			t.Fatal("explain pending segment error:", e)
+		}
+	}
+
+	// a point lacking the dim of a hash node only follows its pass branch
+	tree := NewTypedTree[string](dimTypes, &TreeOptions{LeafNodeDataMax: 1})
+	for i := 0; i < 10; i++ {
+		_ = tree.Add(Rect{"country": Measures{MeasureString(fmt.Sprint("c", i))}}, fmt.Sprint("campaign", i))
+	}
+	tree.Build()
+	e := tree.Explain(Point{"age": MeasureInt(5)}, "campaign3")
+	if e.Matched || len(e.Segments) != 1 || e.Segments[0].Dims[0].Value != nil || e.Segments[0].Dims[0].Passed {
+		t.Fatal("explain missing dim error:", e)
+	}
+	step := e.Segments[0].Paths[0].Steps[0]
+	if step.Node != ExplainNodeHash || step.Branch != ExplainBranchKey || step.Key != MeasureString("c3") || step.Followed {
+		t.Fatal("explain missing dim step error:", e)
+	}
+}
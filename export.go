@@ -0,0 +1,243 @@
+package go_kd_segment_tree
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ExportOptions truncates exported trees: nodes at MaxDepth keep no edge and
+// hash nodes keep at most MaxFanOut keyed edges. Zero means no limit.
+type ExportOptions struct {
+	MaxDepth  int
+	MaxFanOut int
+}
+
+// ExportNode is a node of an exported tree; Type is one of the ExplainNode
+// names. Truncated is the number of edges left out by the export options.
+type ExportNode struct {
+	ID        int                 `json:"id"`
+	Type      string              `json:"type"`
+	Level     int                 `json:"level"`
+	Dim       string              `json:"dim,omitempty"`
+	Mid       string              `json:"mid,omitempty"`
+	Segments  int                 `json:"segments,omitempty"`
+	Dims      []ExportInvertedDim `json:"dims,omitempty"`
+	Edges     []ExportEdge        `json:"edges,omitempty"`
+	Truncated int                 `json:"truncated,omitempty"`
+}
+
+// ExportEdge links a node to a child: left, right, <PASS>, <OTHER> or the
+// key of a hash node child.
+type ExportEdge struct {
+	Label string      `json:"label"`
+	Node  *ExportNode `json:"node"`
+}
+
+// ExportInvertedDim sizes the inverted lists of a conjunction node dim.
+type ExportInvertedDim struct {
+	Dim     string `json:"dim"`
+	Lists   int    `json:"lists"`
+	Entries int    `json:"entries"`
+}
+
+const (
+	ExportEdgeLeft  = "left"
+	ExportEdgeRight = "right"
+	ExportEdgePass  = "<PASS>"
+	ExportEdgeOther = "<OTHER>"
+)
+
+// Export returns the node graph of the latest built index, nil when the tree
+// is not built.
+func (tree *TypedTree[T]) Export(opts *ExportOptions) *ExportNode {
+	if opts == nil {
+		opts = &ExportOptions{}
+	}
+	e := &exporter[T]{opts: opts}
+	return e.export(tree.snapshot(), 1)
+}
+
+// ExportJSON writes the node graph of the latest built index as JSON.
+func (tree *TypedTree[T]) ExportJSON(w io.Writer, opts *ExportOptions) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(tree.Export(opts))
+}
+
+// ExportDOT writes the node graph of the latest built index in the Graphviz
+// DOT language.
+func (tree *TypedTree[T]) ExportDOT(w io.Writer, opts *ExportOptions) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph tree {")
+	fmt.Fprintln(bw, "  node [shape=box];")
+	if root := tree.Export(opts); root != nil {
+		writeDOTNode(bw, root)
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+func writeDOTNode(w io.Writer, node *ExportNode) {
+	var lines []string
+	switch node.Type {
+	case ExplainNodeLeaf:
+		lines = append(lines, fmt.Sprintf("leaf{size=%v}", node.Segments))
+	case ExplainNodeBinary:
+		lines = append(lines, fmt.Sprintf("bnode{dim:%v, mid:%v}", node.Dim, node.Mid))
+	case ExplainNodeHash:
+		lines = append(lines, fmt.Sprintf("hnode{dim:%v}", node.Dim))
+	case ExplainNodeConjunction:
+		lines = append(lines, fmt.Sprintf("conjunction_node{size=%v}", node.Segments))
+		for _, dim := range node.Dims {
+			lines = append(lines, fmt.Sprintf("%v: %v lists, %v entries", dim.Dim, dim.Lists, dim.Entries))
+		}
+	}
+	if node.Truncated > 0 {
+		lines = append(lines, fmt.Sprintf("(%v edges truncated)", node.Truncated))
+	}
+
+	var label []string
+	for _, line := range lines {
+		label = append(label, dotEscape(line))
+	}
+	fmt.Fprintf(w, "  n%v [label=\"%v\"];\n", node.ID, strings.Join(label, "\\n"))
+
+	for _, edge := range node.Edges {
+		writeDOTNode(w, edge.Node)
+		fmt.Fprintf(w, "  n%v -> n%v [label=\"%v\"];\n", node.ID, edge.Node.ID, dotEscape(edge.Label))
+	}
+}
+
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+type exporter[T comparable] struct {
+	opts   *ExportOptions
+	nextID int
+}
+
+func (e *exporter[T]) export(node TypedTreeNode[T], level int) *ExportNode {
+	exported := &ExportNode{Level: level}
+
+	var edges []ExportEdge
+	var children []TypedTreeNode[T]
+	addEdge := func(label string, child TypedTreeNode[T]) {
+		if isNilNode(child) == false {
+			edges = append(edges, ExportEdge{Label: label})
+			children = append(children, child)
+		}
+	}
+
+	switch node := node.(type) {
+	case *TypedLeafNode[T]:
+		if node == nil {
+			return nil
+		}
+		exported.Type = ExplainNodeLeaf
+		exported.Segments = len(node.Segments)
+	case *TypedBinaryNode[T]:
+		if node == nil {
+			return nil
+		}
+		exported.Type = ExplainNodeBinary
+		exported.Dim = fmt.Sprint(node.DimName)
+		exported.Mid = fmt.Sprint(node.Mid)
+		addEdge(ExportEdgeLeft, node.Left)
+		addEdge(ExportEdgeRight, node.Right)
+		addEdge(ExportEdgePass, node.Pass)
+	case *TypedHashNode[T]:
+		if node == nil {
+			return nil
+		}
+		exported.Type = ExplainNodeHash
+		exported.Dim = fmt.Sprint(node.DimName)
+
+		var keys []int32
+		for key := range node.child {
+			keys = append(keys, key)
+		}
+		schema := node.Tree.schema
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(schema.Value(keys[i])) < fmt.Sprint(schema.Value(keys[j]))
+		})
+		if e.opts.MaxFanOut > 0 && len(keys) > e.opts.MaxFanOut {
+			exported.Truncated = len(keys) - e.opts.MaxFanOut
+			keys = keys[:e.opts.MaxFanOut]
+		}
+		for _, key := range keys {
+			addEdge(fmt.Sprint(schema.Value(key)), node.child[key])
+		}
+		addEdge(ExportEdgePass, node.pass)
+		addEdge(ExportEdgeOther, node.other)
+	case *TypedConjunctionNode[T]:
+		if node == nil {
+			return nil
+		}
+		exported.Type = ExplainNodeConjunction
+		exported.Segments = len(node.segments)
+		for dimName, dimNode := range node.dimNode {
+			if isNilDimNode(dimNode) {
+				continue
+			}
+			dim := ExportInvertedDim{Dim: fmt.Sprint(dimName)}
+			var lists [][]int
+			switch dimNode := dimNode.(type) {
+			case *ConjunctionDimRealNode:
+				lists = dimNode.segments
+			case *ConjunctionDimDiscreteNode:
+				for _, list := range dimNode.segments {
+					lists = append(lists, list)
+				}
+				for _, list := range dimNode.excludedBy {
+					lists = append(lists, list)
+				}
+				if len(dimNode.excluded) > 0 {
+					lists = append(lists, dimNode.excluded)
+				}
+			}
+			for _, list := range lists {
+				dim.Lists++
+				dim.Entries += len(list)
+			}
+			exported.Dims = append(exported.Dims, dim)
+		}
+		sort.Slice(exported.Dims, func(i, j int) bool { return exported.Dims[i].Dim < exported.Dims[j].Dim })
+	default:
+		return nil
+	}
+
+	exported.ID = e.nextID
+	e.nextID++
+
+	if e.opts.MaxDepth > 0 && level >= e.opts.MaxDepth {
+		exported.Truncated += len(edges)
+		return exported
+	}
+	for i := range edges {
+		edges[i].Node = e.export(children[i], level+1)
+	}
+	exported.Edges = edges
+	return exported
+}
+
+// isNilNode reports whether the node is nil, including a typed nil pointer.
+func isNilNode[T comparable](node TypedTreeNode[T]) bool {
+	switch node := node.(type) {
+	case nil:
+		return true
+	case *TypedLeafNode[T]:
+		return node == nil
+	case *TypedBinaryNode[T]:
+		return node == nil
+	case *TypedHashNode[T]:
+		return node == nil
+	case *TypedConjunctionNode[T]:
+		return node == nil
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package go_kd_segment_tree
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestTree_Export(t *testing.T) {
+	rnd := rand.New(rand.NewSource(15))
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "age": DimTypeReal}
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+	} {
+		tree := NewTypedTree[int](dimTypes, opts)
+		for i := 0; i < 300; i++ {
+			from := rnd.Intn(100)
+			rect := Rect{"age": Interval{MeasureInt(from), MeasureInt(from + rnd.Intn(30))}}
+			if rnd.Intn(4) > 0 {
+				rect["country"] = Measures{MeasureString(fmt.Sprint("c", rnd.Intn(8)))}
+			}
+			_ = tree.Add(rect, i)
+		}
+
+		var buf bytes.Buffer
+		if err := tree.ExportJSON(&buf, nil); err != nil || strings.TrimSpace(buf.String()) != "null" {
+			t.Fatal("export of a tree not built error:", err, buf.String())
+		}
+		tree.Build()
+		stats := tree.Stats()
+
+		buf.Reset()
+		if err := tree.ExportJSON(&buf, nil); err != nil {
+			t.Fatal(err)
+		}
+		var root ExportNode
+		if err := json.Unmarshal(buf.Bytes(), &root); err != nil {
+			t.Fatal(err)
+		}
+
+		counts := make(map[string]int)
+		var walk func(node *ExportNode, check func(node *ExportNode))
+		walk = func(node *ExportNode, check func(node *ExportNode)) {
+			counts[node.Type]++
+			check(node)
+			for _, edge := range node.Edges {
+				walk(edge.Node, check)
+			}
+		}
+		walk(&root, func(node *ExportNode) {
+			if node.Truncated > 0 {
+				t.Fatal("untruncated export error:", node)
+			}
+			if node.Type == ExplainNodeConjunction && len(node.Dims) == 0 {
+				t.Fatal("conjunction export without dims:", node)
+			}
+		})
+		if counts[ExplainNodeLeaf] != stats.LeafNodes || counts[ExplainNodeBinary] != stats.BinaryNodes ||
+			counts[ExplainNodeHash] != stats.HashNodes || counts[ExplainNodeConjunction] != stats.ConjunctionNodes {
+			t.Fatal("export node counts error:", counts, stats)
+		}
+		nodes := stats.LeafNodes + stats.BinaryNodes + stats.HashNodes + stats.ConjunctionNodes
+
+		buf.Reset()
+		if err := tree.ExportDOT(&buf, nil); err != nil {
+			t.Fatal(err)
+		}
+		dot := buf.String()
+		if strings.HasPrefix(dot, "digraph tree {") == false || strings.Count(dot, " -> ") != nodes-1 ||
+			strings.Count(dot, "[label=") != 2*nodes-1 {
+			t.Fatal("export dot error:", dot)
+		}
+
+		counts = make(map[string]int)
+		truncated := false
+		walk(tree.Export(&ExportOptions{MaxDepth: 2, MaxFanOut: 3}), func(node *ExportNode) {
+			keyed := 0
+			for _, edge := range node.Edges {
+				if edge.Label != ExportEdgePass && edge.Label != ExportEdgeOther {
+					keyed++
+				}
+			}
+			if node.Level > 2 || (node.Type == ExplainNodeHash && keyed > 3) {
+				t.Fatal("truncated export error:", node)
+			}
+			truncated = truncated || node.Truncated > 0
+		})
+		if stats.MaxDepth > 2 && truncated == false {
+			t.Fatal("export not truncated")
+		}
+	}
+
+	// dims no rect constrains are left out of the conjunction nodes
+	tree := NewTypedTree[int](DimTypes{"country": DimTypeDiscrete, "age": DimTypeReal, "os": DimTypeDiscrete},
+		&TreeOptions{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0})
+	for i := 0; i < 20; i++ {
+		_ = tree.Add(Rect{"country": Measures{MeasureString(fmt.Sprint("c", i%3))}}, i)
+	}
+	tree.Build()
+	root := tree.Export(nil)
+	if root == nil || root.Type != ExplainNodeConjunction || len(root.Dims) != 1 || root.Dims[0].Dim != "country" {
+		t.Fatal("unconstrained dim export error:", root)
+	}
+	var buf bytes.Buffer
+	if err := tree.ExportDOT(&buf, nil); err != nil || strings.Contains(buf.String(), "os:") {
+		t.Fatal("unconstrained dim export dot error:", err, buf.String())
+	}
+}
@@ -0,0 +1,687 @@
+package go_kd_segment_tree
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MaxExprConjuncts bounds the number of rects an expression compiles into.
+const MaxExprConjuncts = 1024
+
+// Expr is a parsed targeting expression such as
+//
+//	country in (US, CA) and age between 18 and 35 and not os = "ios"
+//
+// Conditions compare a dim with literal values: =, !=, <, <=, >, >=, in (...),
+// not in (...), between ... and ... and not between ... and .... They combine
+// with and, or, not and parentheses. Bare words and quoted strings are string
+// values, integers are MeasureInt, other numbers are MeasureFloat and quoted
+// RFC 3339 times are MeasureTime on real dims. Since measures of different
+// types never compare, a real dim takes one kind of literal in an expression:
+// write 18.0 to compare with MeasureFloat values.
+//
+// A condition never matches a point lacking its dim, negated or not.
+//
+// On a multi-valued point, a MeasureSet, not applies to each value: not is
+// pushed down to the conditions, not (a and b) being not a or not b, and the
+// conditions on a dim joined by and must then all hold for a single value of
+// the set. So os = ios and not os = ios both match {ios, android}: some value
+// is ios and some value is not.
+type Expr interface {
+	String() string
+}
+
+type exprAnd struct{ left, right Expr }
+
+type exprOr struct{ left, right Expr }
+
+type exprNot struct{ expr Expr }
+
+// exprCond is a "dim op values" condition; the negated operators !=, not in
+// and not between are parsed as exprNot of their positive form.
+type exprCond struct {
+	dim    string
+	op     string
+	values []exprToken
+	pos    int
+}
+
+func (e *exprAnd) String() string {
+	return fmt.Sprintf("(%v and %v)", e.left, e.right)
+}
+
+func (e *exprOr) String() string {
+	return fmt.Sprintf("(%v or %v)", e.left, e.right)
+}
+
+func (e *exprNot) String() string {
+	return fmt.Sprintf("not %v", e.expr)
+}
+
+func (e *exprCond) String() string {
+	var values []string
+	for _, v := range e.values {
+		values = append(values, v.String())
+	}
+	switch e.op {
+	case "in":
+		return fmt.Sprintf("%v in (%v)", e.dim, strings.Join(values, ", "))
+	case "between":
+		return fmt.Sprintf("%v between %v and %v", e.dim, values[0], values[1])
+	}
+	return fmt.Sprintf("%v %v %v", e.dim, e.op, values[0])
+}
+
+const (
+	exprTokenEnd = iota
+	exprTokenWord
+	exprTokenString
+	exprTokenNumber
+	exprTokenSymbol
+)
+
+type exprToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+func (t exprToken) String() string {
+	if t.kind == exprTokenString {
+		return strconv.Quote(t.text)
+	}
+	return t.text
+}
+
+func (t exprToken) is(keyword string) bool {
+	return (t.kind == exprTokenWord || t.kind == exprTokenSymbol) && strings.EqualFold(t.text, keyword)
+}
+
+func exprError(pos int, format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("expr error at %v: %v", pos+1, fmt.Sprintf(format, args...)))
+}
+
+func tokenizeExpr(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			var text []rune
+			j := i + 1
+			for ; j < len(runes) && runes[j] != c; j++ {
+				if runes[j] == '\\' && j+1 < len(runes) {
+					j++
+				}
+				text = append(text, runes[j])
+			}
+			if j == len(runes) {
+				return nil, exprError(i, "unterminated string")
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenString, text: string(text), pos: i})
+			i = j + 1
+		case unicode.IsDigit(c) || ((c == '-' || c == '+' || c == '.') && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			j := i + 1
+			for ; j < len(runes); j++ {
+				if unicode.IsDigit(runes[j]) || runes[j] == '.' ||
+					runes[j] == 'e' || runes[j] == 'E' ||
+					((runes[j] == '-' || runes[j] == '+') && (runes[j-1] == 'e' || runes[j-1] == 'E')) {
+					continue
+				}
+				break
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenNumber, text: string(runes[i:j]), pos: i})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for ; j < len(runes); j++ {
+				if unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) ||
+					runes[j] == '_' || runes[j] == '.' || runes[j] == '-' {
+					continue
+				}
+				break
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenWord, text: string(runes[i:j]), pos: i})
+			i = j
+		default:
+			symbol := string(c)
+			if i+1 < len(runes) {
+				switch two := string(runes[i : i+2]); two {
+				case "!=", "<>", "<=", ">=", "==":
+					symbol = two
+				}
+			}
+			switch symbol {
+			case "(", ")", ",", "=", "==", "!=", "<>", "<", "<=", ">", ">=":
+			default:
+				return nil, exprError(i, "unexpected character:%q", c)
+			}
+			tokens = append(tokens, exprToken{kind: exprTokenSymbol, text: symbol, pos: i})
+			i += len([]rune(symbol))
+		}
+	}
+	return append(tokens, exprToken{kind: exprTokenEnd, pos: len(runes)}), nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	next   int
+}
+
+// ParseExpr parses a targeting expression.
+func ParseExpr(s string) (Expr, error) {
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != exprTokenEnd {
+		return nil, exprError(t.pos, "unexpected %v", t)
+	}
+	return expr, nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.next]
+}
+
+func (p *exprParser) take() exprToken {
+	t := p.tokens[p.next]
+	if t.kind != exprTokenEnd {
+		p.next++
+	}
+	return t
+}
+
+func (p *exprParser) expect(keyword string) error {
+	if t := p.take(); t.is(keyword) == false {
+		return exprError(t.pos, "expect %v", keyword)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is("or") {
+		p.take()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprOr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (Expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is("and") {
+		p.take()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprAnd{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (Expr, error) {
+	if p.peek().is("not") {
+		p.take()
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNot{expr: expr}, nil
+	}
+
+	if p.peek().is("(") {
+		p.take()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return expr, nil
+	}
+	return p.parseCond()
+}
+
+func (p *exprParser) parseCond() (Expr, error) {
+	dim := p.take()
+	if dim.kind != exprTokenWord && dim.kind != exprTokenString {
+		return nil, exprError(dim.pos, "expect a dim")
+	}
+	cond := &exprCond{dim: dim.text, pos: dim.pos}
+
+	negate := false
+	if p.peek().is("not") {
+		p.take()
+		negate = true
+	}
+
+	op := p.take()
+	switch {
+	case op.is("in"):
+		cond.op = "in"
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		for {
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			cond.values = append(cond.values, value)
+			if p.peek().is(",") == false {
+				break
+			}
+			p.take()
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	case op.is("between"):
+		cond.op = "between"
+		from, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("and"); err != nil {
+			return nil, err
+		}
+		to, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		cond.values = []exprToken{from, to}
+	case negate == false && op.kind == exprTokenSymbol && op.text != "(" && op.text != ")" && op.text != ",":
+		cond.op = op.text
+		switch cond.op {
+		case "==":
+			cond.op = "="
+		case "!=", "<>":
+			cond.op = "="
+			negate = true
+		}
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		cond.values = []exprToken{value}
+	default:
+		return nil, exprError(op.pos, "expect an operator after %v", dim.text)
+	}
+
+	if negate {
+		return &exprNot{expr: cond}, nil
+	}
+	return cond, nil
+}
+
+func (p *exprParser) parseValue() (exprToken, error) {
+	t := p.take()
+	switch t.kind {
+	case exprTokenString, exprTokenNumber:
+		return t, nil
+	case exprTokenWord:
+		for _, keyword := range []string{"and", "or", "not", "in", "between"} {
+			if t.is(keyword) {
+				return t, exprError(t.pos, "expect a value")
+			}
+		}
+		return t, nil
+	}
+	return t, exprError(t.pos, "expect a value")
+}
+
+// exprAtom is a type checked condition on one dim: Measures or
+// ExcludedMeasures on discrete dims, Interval on real dims.
+type exprAtom struct {
+	dim        string
+	constraint interface{}
+}
+
+// CompileExpr type checks the expression against the dim types and turns it
+// into a disjunctive normal form: the expression matches a point when any of
+// the rects contains it.
+func CompileExpr(expr Expr, dimTypes DimTypes) ([]Rect, error) {
+	c := &exprCompiler{
+		dimTypes: dimTypes,
+		measures: make(map[string]string),
+	}
+
+	conjuncts, err := c.dnf(expr, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var rects []Rect
+	var keys = make(map[string]bool)
+	for _, conjunct := range conjuncts {
+		rect, ok := intersectAtoms(conjunct)
+		if ok == false {
+			continue
+		}
+		if key := rect.Key(); keys[key] == false {
+			keys[key] = true
+			rects = append(rects, rect)
+		}
+	}
+	if len(rects) == 0 {
+		return nil, errors.New(fmt.Sprintf("expr never matches:%v", expr))
+	}
+	return rects, nil
+}
+
+type exprCompiler struct {
+	dimTypes DimTypes
+	// measures keeps the measure type of the values of each real dim, since
+	// measures of different types never compare.
+	measures map[string]string
+}
+
+// dnf returns the conjuncts of the expression, or of its negation.
+func (c *exprCompiler) dnf(expr Expr, negate bool) ([][]exprAtom, error) {
+	switch expr := expr.(type) {
+	case *exprNot:
+		return c.dnf(expr.expr, negate == false)
+	case *exprAnd:
+		if negate {
+			return c.union(&exprNot{expr.left}, &exprNot{expr.right})
+		}
+		return c.product(expr.left, expr.right)
+	case *exprOr:
+		if negate {
+			return c.product(&exprNot{expr.left}, &exprNot{expr.right})
+		}
+		return c.union(expr.left, expr.right)
+	case *exprCond:
+		atom, err := c.atom(expr)
+		if err != nil {
+			return nil, err
+		}
+		if negate == false {
+			return [][]exprAtom{{atom}}, nil
+		}
+
+		var conjuncts [][]exprAtom
+		switch constraint := atom.constraint.(type) {
+		case Measures:
+			conjuncts = append(conjuncts, []exprAtom{{dim: atom.dim, constraint: ExcludedMeasures(constraint)}})
+		case Interval:
+			for _, interval := range complementInterval(constraint) {
+				conjuncts = append(conjuncts, []exprAtom{{dim: atom.dim, constraint: interval}})
+			}
+		}
+		return conjuncts, nil
+	}
+	return nil, errors.New(fmt.Sprintf("not support expr:%v", expr))
+}
+
+func (c *exprCompiler) union(left, right Expr) ([][]exprAtom, error) {
+	leftConjuncts, err := c.dnf(left, false)
+	if err != nil {
+		return nil, err
+	}
+	rightConjuncts, err := c.dnf(right, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(leftConjuncts)+len(rightConjuncts) > MaxExprConjuncts {
+		return nil, errors.New("expr too complex")
+	}
+	return append(leftConjuncts, rightConjuncts...), nil
+}
+
+func (c *exprCompiler) product(left, right Expr) ([][]exprAtom, error) {
+	leftConjuncts, err := c.dnf(left, false)
+	if err != nil {
+		return nil, err
+	}
+	rightConjuncts, err := c.dnf(right, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(leftConjuncts)*len(rightConjuncts) > MaxExprConjuncts {
+		return nil, errors.New("expr too complex")
+	}
+
+	var conjuncts [][]exprAtom
+	for _, l := range leftConjuncts {
+		for _, r := range rightConjuncts {
+			conjunct := make([]exprAtom, 0, len(l)+len(r))
+			conjunct = append(conjunct, l...)
+			conjuncts = append(conjuncts, append(conjunct, r...))
+		}
+	}
+	return conjuncts, nil
+}
+
+// atom type checks a condition against the dim types.
+func (c *exprCompiler) atom(cond *exprCond) (exprAtom, error) {
+	dimType, ok := c.dimTypes[cond.dim]
+	if ok == false {
+		return exprAtom{}, exprError(cond.pos, "unknown dim:%v", cond.dim)
+	}
+
+	var measures []Measure
+	for _, value := range cond.values {
+		m, err := c.measure(cond.dim, dimType, value)
+		if err != nil {
+			return exprAtom{}, err
+		}
+		measures = append(measures, m)
+	}
+
+	if dimType == DimTypeDiscrete {
+		switch cond.op {
+		case "=", "in":
+			return exprAtom{dim: cond.dim, constraint: Measures(measures)}, nil
+		}
+		return exprAtom{}, exprError(cond.pos, "operator %v not support discrete dim:%v", cond.op, cond.dim)
+	}
+
+	var interval Interval
+	switch cond.op {
+	case "=":
+		interval = Interval{measures[0], measures[0]}
+	case "<":
+		interval = Interval{nil, Exclusive{measures[0]}}
+	case "<=":
+		interval = Interval{nil, measures[0]}
+	case ">":
+		interval = Interval{Exclusive{measures[0]}, nil}
+	case ">=":
+		interval = Interval{measures[0], nil}
+	case "between":
+		interval = Interval{measures[0], measures[1]}
+	default:
+		return exprAtom{}, exprError(cond.pos, "operator %v not support real dim:%v", cond.op, cond.dim)
+	}
+	return exprAtom{dim: cond.dim, constraint: interval}, nil
+}
+
+func (c *exprCompiler) measure(dim string, dimType DimType, value exprToken) (Measure, error) {
+	if dimType == DimTypeDiscrete {
+		if value.kind == exprTokenNumber {
+			m, _, err := parseExprNumber(value)
+			return m, err
+		}
+		return MeasureString(value.text), nil
+	}
+
+	var m Measure
+	var measure string
+	switch value.kind {
+	case exprTokenNumber:
+		var err error
+		if m, measure, err = parseExprNumber(value); err != nil {
+			return nil, err
+		}
+	case exprTokenString:
+		t, err := time.Parse(time.RFC3339Nano, value.text)
+		if err != nil {
+			return nil, exprError(value.pos, "expect a number or a RFC 3339 time:%v", value)
+		}
+		m, measure = MeasureTime(t), "time"
+	default:
+		return nil, exprError(value.pos, "expect a number or a RFC 3339 time:%v", value)
+	}
+
+	if previous, ok := c.measures[dim]; ok && previous != measure {
+		return nil, exprError(value.pos, "dim %v mixes %v and %v values", dim, previous, measure)
+	}
+	c.measures[dim] = measure
+	return m, nil
+}
+
+// parseExprNumber returns a MeasureInt for an integer literal and a
+// MeasureFloat for any other number, with the name of its measure.
+func parseExprNumber(value exprToken) (Measure, string, error) {
+	if x, err := strconv.ParseInt(value.text, 10, 64); err == nil {
+		return MeasureInt(x), "integer", nil
+	}
+	if x, err := strconv.ParseFloat(value.text, 64); err == nil {
+		return MeasureFloat(x), "float", nil
+	}
+	return nil, "", exprError(value.pos, "bad number:%v", value.text)
+}
+
+// complementInterval returns the intervals covering the values outside the
+// interval.
+func complementInterval(interval Interval) []Interval {
+	var intervals []Interval
+	switch lower := interval.lowerBound(); {
+	case lower.m == nil:
+	case lower.side > 0:
+		intervals = append(intervals, Interval{nil, lower.m})
+	default:
+		intervals = append(intervals, Interval{nil, Exclusive{lower.m}})
+	}
+	switch upper := interval.upperBound(); {
+	case upper.m == nil:
+	case upper.side < 0:
+		intervals = append(intervals, Interval{upper.m, nil})
+	default:
+		intervals = append(intervals, Interval{Exclusive{upper.m}, nil})
+	}
+	return intervals
+}
+
+// intersectAtoms merges the atoms of a conjunct into a rect, reporting false
+// when no point satisfies all of them.
+func intersectAtoms(atoms []exprAtom) (Rect, bool) {
+	rect := Rect{}
+	for _, atom := range atoms {
+		previous, ok := rect[atom.dim]
+		if ok == false {
+			rect[atom.dim] = atom.constraint
+			continue
+		}
+
+		switch constraint := atom.constraint.(type) {
+		case Interval:
+			interval := previous.(Interval)
+			if lower := constraint.lowerBound(); lower.compare(interval.lowerBound()) > 0 {
+				interval[0] = constraint[0]
+			}
+			if upper := constraint.upperBound(); upper.compare(interval.upperBound()) < 0 {
+				interval[1] = constraint[1]
+			}
+			if interval.lowerBound().compare(interval.upperBound()) > 0 {
+				return nil, false
+			}
+			rect[atom.dim] = interval
+		case Measures:
+			rect[atom.dim] = intersectMeasures(constraint, previous)
+		case ExcludedMeasures:
+			rect[atom.dim] = intersectMeasures(previous, constraint)
+		}
+
+		if measures, ok := rect[atom.dim].(Measures); ok && len(measures) == 0 {
+			return nil, false
+		}
+	}
+	return rect, true
+}
+
+// intersectMeasures merges a discrete constraint with an other one: Measures
+// keep the values allowed by both, ExcludedMeasures exclude the values of both.
+func intersectMeasures(a interface{}, b interface{}) interface{} {
+	contains := func(measures []Measure, m Measure) bool {
+		for _, x := range measures {
+			if discreteKey(x) == discreteKey(m) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch a := a.(type) {
+	case Measures:
+		measures := Measures{}
+		for _, m := range a {
+			switch b := b.(type) {
+			case Measures:
+				if contains(b, m) {
+					measures = append(measures, m)
+				}
+			case ExcludedMeasures:
+				if contains(b, m) == false {
+					measures = append(measures, m)
+				}
+			}
+		}
+		return measures
+	case ExcludedMeasures:
+		if b, ok := b.(Measures); ok {
+			return intersectMeasures(b, a)
+		}
+		excluded := append(ExcludedMeasures{}, a...)
+		for _, m := range b.(ExcludedMeasures) {
+			if contains(excluded, m) == false {
+				excluded = append(excluded, m)
+			}
+		}
+		return excluded
+	}
+	return nil
+}
+
+// UpsertExpr compiles the targeting expression and sets it, with data, as the
+// segments of the stable id, replacing its previous version. A point matching
+// several conjuncts of the expression gets data once.
+func (tree *TypedTree[T]) UpsertExpr(id string, expr string, data T) error {
+	parsed, err := ParseExpr(expr)
+	if err != nil {
+		return err
+	}
+
+	rects, err := CompileExpr(parsed, tree.dimTypes)
+	if err != nil {
+		return err
+	}
+	return tree.UpsertRule(id, rects, data)
+}
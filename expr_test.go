@@ -0,0 +1,295 @@
+package go_kd_segment_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	for _, c := range []struct {
+		expr     string
+		expected string
+	}{
+		{`country in (US, CA) and age between 18 and 35 and not os = "ios"`,
+			`((country in (US, CA) and age between 18 and 35) and not os = "ios")`},
+		{`a = 1 or b != 2 and c >= 3`, `(a = 1 or (not b = 2 and c >= 3))`},
+		{`NOT (a < 1 OR a > 2)`, `not (a < 1 or a > 2)`},
+		{`os not in ('ios', "android") or age not between -1.5 and 2e3`,
+			`(not os in ("ios", "android") or not age between -1.5 and 2e3)`},
+	} {
+		expr, err := ParseExpr(c.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expr.String() != c.expected {
+			t.Fatal("parse expr error:", expr, c.expected)
+		}
+	}
+
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "age": DimTypeReal, "start": DimTypeReal}
+	for _, c := range []struct {
+		expr string
+		err  string
+	}{
+		{`country in (US, CA`, "expr error at 19: expect )"},
+		{`country = US and`, "expr error at 17: expect a dim"},
+		{`country US`, "expr error at 9: expect an operator after country"},
+		{`country = "US`, "expr error at 11: unterminated string"},
+		{`city = x`, "expr error at 1: unknown dim:city"},
+		{`country > x`, "expr error at 1: operator > not support discrete dim:country"},
+		{`age in (1, 2)`, "expr error at 1: operator in not support real dim:age"},
+		{`age = young`, "expr error at 7: expect a number or a RFC 3339 time:young"},
+		{`start > 0 and start < "2020-01-01T00:00:00Z"`, "expr error at 23: dim start mixes integer and time values"},
+		{`age > 1 and age < 2.5`, "expr error at 19: dim age mixes integer and float values"},
+		{`age > 3 and age < 2`, "expr never matches"},
+		{`country = US and not country in (US, CA)`, "expr never matches"},
+	} {
+		expr, err := ParseExpr(c.expr)
+		if err == nil {
+			_, err = CompileExpr(expr, dimTypes)
+		}
+		if err == nil || strings.HasPrefix(err.Error(), c.err) == false {
+			t.Fatal("expr error mismatch:", err, c.err)
+		}
+	}
+}
+
+// evalExpr evaluates the expression on a point without multi-valued dims
+// directly: conditions on dims missing from the point never match, negated or
+// not.
+func evalExpr(t *testing.T, c *exprCompiler, expr Expr, negate bool, p Point) bool {
+	switch expr := expr.(type) {
+	case *exprNot:
+		return evalExpr(t, c, expr.expr, negate == false, p)
+	case *exprAnd:
+		l, r := evalExpr(t, c, expr.left, negate, p), evalExpr(t, c, expr.right, negate, p)
+		if negate {
+			return l || r
+		}
+		return l && r
+	case *exprOr:
+		l, r := evalExpr(t, c, expr.left, negate, p), evalExpr(t, c, expr.right, negate, p)
+		if negate {
+			return l && r
+		}
+		return l || r
+	case *exprCond:
+		atom, err := c.atom(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p[expr.dim] == nil {
+			return false
+		}
+		switch constraint := atom.constraint.(type) {
+		case Measures:
+			return constraint.Contains(p[expr.dim]) != negate
+		case Interval:
+			return constraint.Contains(p[expr.dim]) != negate
+		}
+	}
+	t.Fatal("unknown expr:", expr)
+	return false
+}
+
+// evalConjuncts evaluates the expression on the point from its conjuncts,
+// without merging them into rects: a conjunct matches when, for each of its
+// dims, a single value of the point satisfies all its conditions on the dim.
+func evalConjuncts(t *testing.T, c *exprCompiler, expr Expr, p Point) bool {
+	conjuncts, err := c.dnf(expr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+conjuncts:
+	for _, conjunct := range conjuncts {
+		dims := make(map[string][]interface{ Contains(Measure) bool })
+		for _, atom := range conjunct {
+			dims[atom.dim] = append(dims[atom.dim], atom.constraint.(interface{ Contains(Measure) bool }))
+		}
+	dims:
+		for dim, constraints := range dims {
+		values:
+			for _, x := range pointValues(p[dim]) {
+				for _, constraint := range constraints {
+					if constraint.Contains(x) == false {
+						continue values
+					}
+				}
+				continue dims
+			}
+			continue conjuncts
+		}
+		return true
+	}
+	return false
+}
+
+func randomExpr(rnd *rand.Rand, depth int) string {
+	if depth > 0 && rnd.Intn(3) > 0 {
+		op := []string{"and", "or"}[rnd.Intn(2)]
+		expr := fmt.Sprintf("(%v %v %v)", randomExpr(rnd, depth-1), op, randomExpr(rnd, depth-1))
+		if rnd.Intn(4) == 0 {
+			expr = "not " + expr
+		}
+		return expr
+	}
+
+	switch rnd.Intn(6) {
+	case 0:
+		return fmt.Sprintf("country = C%v", rnd.Intn(4))
+	case 1:
+		return fmt.Sprintf("country not in (C%v, C%v)", rnd.Intn(4), rnd.Intn(4))
+	case 2:
+		return fmt.Sprintf("level in (%v, %v)", rnd.Intn(4), rnd.Intn(4))
+	case 3:
+		return fmt.Sprintf("age %v %v", []string{"=", "!=", "<", "<=", ">", ">="}[rnd.Intn(6)], rnd.Intn(10))
+	case 4:
+		from := rnd.Intn(10)
+		return fmt.Sprintf("age between %v and %v", from, from+rnd.Intn(5))
+	default:
+		return fmt.Sprintf("score not between %v and %v", rnd.Float64()/2, 0.5+rnd.Float64()/2)
+	}
+}
+
+func TestTree_UpsertExpr(t *testing.T) {
+	rnd := rand.New(rand.NewSource(11))
+	dimTypes := DimTypes{
+		"country": DimTypeDiscrete,
+		"level":   DimTypeDiscrete,
+		"age":     DimTypeReal,
+		"score":   DimTypeReal,
+	}
+
+	var exprs []Expr
+	for len(exprs) < 200 {
+		expr, err := ParseExpr(randomExpr(rnd, 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := CompileExpr(expr, dimTypes); err == nil {
+			exprs = append(exprs, expr)
+		}
+	}
+
+	for _, c := range []struct {
+		opts *TreeOptions
+		live bool
+	}{
+		{&TreeOptions{LeafNodeDataMax: 2}, true},
+		{&TreeOptions{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0}, true},
+		{&TreeOptions{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0}, false},
+	} {
+		tree := NewTypedTree[int](dimTypes, c.opts)
+		for i, expr := range exprs[:150] {
+			if err := tree.UpsertExpr(fmt.Sprint(i), expr.String(), i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.live {
+			tree.Build()
+		}
+		// overwrite some of the rules
+		for i, expr := range exprs[150:] {
+			if err := tree.UpsertExpr(fmt.Sprint(i*3), expr.String(), i*3); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.live == false {
+			tree.Build()
+		}
+		ruleExprs := make(map[int]Expr)
+		for i, expr := range exprs[:150] {
+			ruleExprs[i] = expr
+		}
+		for i, expr := range exprs[150:] {
+			ruleExprs[i*3] = expr
+		}
+
+		compiler := &exprCompiler{dimTypes: dimTypes, measures: make(map[string]string)}
+		for i := 0; i < 500; i++ {
+			p := Point{}
+			if rnd.Intn(5) > 0 {
+				p["country"] = MeasureString(fmt.Sprint("C", rnd.Intn(5)))
+			} else if rnd.Intn(2) == 0 {
+				p["country"] = MeasureSet{MeasureString(fmt.Sprint("C", rnd.Intn(5))), MeasureString(fmt.Sprint("C", rnd.Intn(5)))}
+			}
+			if rnd.Intn(5) > 0 {
+				p["level"] = MeasureInt(rnd.Intn(5))
+			} else if rnd.Intn(2) == 0 {
+				p["level"] = MeasureSet{MeasureInt(rnd.Intn(5)), MeasureInt(rnd.Intn(5))}
+			}
+			if rnd.Intn(5) > 0 {
+				p["age"] = MeasureInt(rnd.Intn(12))
+			} else if rnd.Intn(2) == 0 {
+				p["age"] = MeasureSet{MeasureInt(rnd.Intn(12)), MeasureInt(rnd.Intn(12))}
+			}
+			if rnd.Intn(5) > 0 {
+				p["score"] = MeasureFloat(rnd.Float64())
+			}
+
+			multiValued := false
+			for _, x := range p {
+				if _, ok := x.(MeasureSet); ok {
+					multiValued = true
+				}
+			}
+
+			var expected []int
+			for id, expr := range ruleExprs {
+				matched := evalConjuncts(t, compiler, expr, p)
+				if multiValued == false && evalExpr(t, compiler, expr, false, p) != matched {
+					t.Fatal("expr conjuncts error:", expr, p)
+				}
+				if matched {
+					expected = append(expected, id)
+				}
+			}
+			result := tree.Search(p)
+			sort.Ints(expected)
+			sort.Ints(result)
+			if fmt.Sprint(result) != fmt.Sprint(expected) {
+				t.Fatal("expr tree search error:", p, result, expected)
+			}
+		}
+	}
+
+	// a condition and its negation both match a point with values on both sides
+	tree := NewTypedTree[string](DimTypes{"os": DimTypeDiscrete, "age": DimTypeReal}, nil)
+	_ = tree.UpsertExpr("pos", "os = ios", "pos")
+	_ = tree.UpsertExpr("neg", "not os = ios", "neg")
+	_ = tree.UpsertExpr("between", "age between 18 and 35", "between")
+	_ = tree.UpsertExpr("not between", "age not between 18 and 35", "not between")
+	tree.Build()
+	result := tree.Search(Point{
+		"os":  MeasureSet{MeasureString("ios"), MeasureString("android")},
+		"age": MeasureSet{MeasureInt(20), MeasureInt(40)},
+	})
+	sort.Strings(result)
+	if fmt.Sprint(result) != "[between neg not between pos]" {
+		t.Fatal("negated expr search error:", result)
+	}
+
+	// integer literals compare with MeasureInt values, decimal ones with
+	// MeasureFloat values
+	tree = NewTypedTree[string](DimTypes{"age": DimTypeReal}, nil)
+	_ = tree.UpsertExpr("int", "age >= 18", "int")
+	_ = tree.UpsertExpr("float", "age >= 18.0", "float")
+	tree.Build()
+	for _, c := range []struct {
+		p        Point
+		expected string
+	}{
+		{Point{"age": MeasureInt(20)}, "[int]"},
+		{Point{"age": MeasureUint(20)}, "[int]"},
+		{Point{"age": MeasureFloat(20)}, "[float]"},
+		{Point{"age": MeasureInt(17)}, "[]"},
+	} {
+		if result := tree.Search(c.p); fmt.Sprint(result) != c.expected {
+			t.Fatal("expr literal types error:", c.p, result, c.expected)
+		}
+	}
+}
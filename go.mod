@@ -1,5 +1,7 @@
 module github.com/boostlearn/go-kd-segment-tree
 
-go 1.11
+go 1.20
 
-require github.com/deckarep/golang-set v1.7.1
+require github.com/deckarep/golang-set/v2 v2.8.0
+
+require gopkg.in/yaml.v3 v3.0.1
@@ -0,0 +1,137 @@
+package go_kd_segment_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestTree_InsertDifferential(t *testing.T) {
+	rnd := rand.New(rand.NewSource(25))
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "tag": DimTypeDiscrete, "age": DimTypeReal}
+
+	randRect := func(keys int) Rect {
+		rect := Rect{}
+		switch rnd.Intn(4) {
+		case 0:
+			rect["country"] = Measures{MeasureString(fmt.Sprint("c", rnd.Intn(keys))), MeasureString(fmt.Sprint("c", rnd.Intn(keys)))}
+		case 1:
+			rect["country"] = ExcludedMeasures{MeasureString(fmt.Sprint("c", rnd.Intn(keys)))}
+		}
+		if rnd.Intn(2) == 0 {
+			rect["tag"] = Measures{MeasureInt(rnd.Intn(keys)), MeasureUint(rnd.Intn(keys))}
+		}
+		switch rnd.Intn(4) {
+		case 0:
+			from := rnd.Intn(100)
+			rect["age"] = Interval{MeasureInt(from), Exclusive{MeasureInt(from + 1 + rnd.Intn(20))}}
+		case 1:
+			rect["age"] = Interval{nil, nil}
+		case 2:
+			rect["age"] = Interval{MeasureInt(rnd.Intn(100)), nil}
+		}
+		return rect
+	}
+	randPoint := func() Point {
+		p := Point{}
+		if rnd.Intn(5) > 0 {
+			p["country"] = MeasureString(fmt.Sprint("c", rnd.Intn(24)))
+		} else if rnd.Intn(2) == 0 {
+			p["country"] = MeasureSet{MeasureString(fmt.Sprint("c", rnd.Intn(24))), MeasureString(fmt.Sprint("c", rnd.Intn(24)))}
+		}
+		if rnd.Intn(3) > 0 {
+			p["tag"] = MeasureInt(rnd.Intn(24))
+		}
+		if rnd.Intn(5) > 0 {
+			p["age"] = MeasureInt(rnd.Intn(130))
+		}
+		return p
+	}
+
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 2, RebuildInsertRate: 0.5},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.2, ConjunctionTargetRateMin: 1.0},
+	} {
+		tree := NewTypedTree[int](dimTypes, opts)
+		rects := make(map[int]Rect)
+		checkSearch := func(step string) {
+			for i := 0; i < 200; i++ {
+				p := randPoint()
+				var expected []int
+				for data, rect := range rects {
+					if rect.Contains(p) {
+						expected = append(expected, data)
+					}
+				}
+				result := tree.Search(p)
+				sort.Ints(result)
+				sort.Ints(expected)
+				if fmt.Sprint(result) != fmt.Sprint(expected) {
+					t.Fatal(step, "search error:", p, result, expected)
+				}
+			}
+		}
+
+		// the first insert into an unbuilt tree also builds the added rects
+		for i := 0; i < 50; i++ {
+			rects[i] = randRect(8)
+			_ = tree.Add(rects[i], i)
+		}
+		rects[50] = randRect(8)
+		if err := tree.Insert(rects[50], 50); err != nil {
+			t.Fatal("unbuilt insert error:", err)
+		}
+		checkSearch("bootstrap")
+
+		// later rects bring values no hash child was built for
+		for i := 51; i < 400; i++ {
+			rects[i] = randRect(8 + i/20)
+			if err := tree.Insert(rects[i], i); err != nil {
+				t.Fatal("insert error:", err)
+			}
+		}
+		checkSearch("insert")
+
+		tree.Build()
+		for i := 400; i < 600; i++ {
+			rects[i] = randRect(24)
+			if err := tree.Insert(rects[i], i); err != nil {
+				t.Fatal("insert error:", err)
+			}
+		}
+		checkSearch("rebuilt insert")
+
+		// a tree emptied by removals takes inserts and upserts again
+		for i := 0; i < 600; i++ {
+			tree.Remove(i)
+		}
+		rects = make(map[int]Rect)
+		if tree.snapshot() != nil {
+			t.Fatal("removals left a root")
+		}
+		rects[1000] = randRect(24)
+		if err := tree.Upsert("rule", rects[1000], 1000); err != nil {
+			t.Fatal("upsert error:", err)
+		}
+		for i := 1001; i < 1100; i++ {
+			rects[i] = randRect(24)
+			if err := tree.Insert(rects[i], i); err != nil {
+				t.Fatal("insert error:", err)
+			}
+		}
+		checkSearch("emptied")
+	}
+
+	// a rejected rect is not kept pending either
+	tree := NewTypedTree[int](dimTypes, nil)
+	if err := tree.Insert(Rect{"age": Measures{MeasureInt(1)}}, 1); err == nil {
+		t.Fatal("insert of a wrong rect error")
+	}
+	tree.Build()
+	if result := tree.Search(Point{"age": MeasureInt(1)}); len(result) != 0 {
+		t.Fatal("wrong rect inserted:", result)
+	}
+}
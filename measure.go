@@ -2,6 +2,8 @@ package go_kd_segment_tree
 
 import (
 	"fmt"
+	"math"
+	"sort"
 	"strings"
 	"time"
 )
@@ -105,7 +107,7 @@ type MeasureTime time.Time
 func (f MeasureTime) Bigger(b interface{}) bool {
 	switch b.(type) {
 	case MeasureTime:
-		return time.Time(f).After(b.(time.Time))
+		return time.Time(f).After(time.Time(b.(MeasureTime)))
 	}
 	return false
 }
@@ -113,7 +115,7 @@ func (f MeasureTime) Bigger(b interface{}) bool {
 func (f MeasureTime) Smaller(b interface{}) bool {
 	switch b.(type) {
 	case MeasureTime:
-		return time.Time(f).Before(b.(time.Time))
+		return time.Time(f).Before(time.Time(b.(MeasureTime)))
 	}
 	return false
 
@@ -122,7 +124,7 @@ func (f MeasureTime) Smaller(b interface{}) bool {
 func (f MeasureTime) Equal(b interface{}) bool {
 	switch b.(type) {
 	case MeasureTime:
-		return time.Time(f).Equal(b.(time.Time))
+		return time.Time(f).Equal(time.Time(b.(MeasureTime)))
 	}
 	return false
 }
@@ -130,7 +132,7 @@ func (f MeasureTime) Equal(b interface{}) bool {
 func (f MeasureTime) BiggerOrEqual(b interface{}) bool {
 	switch b.(type) {
 	case MeasureTime:
-		return time.Time(f).After(b.(time.Time)) || time.Time(f).Equal(b.(time.Time))
+		return time.Time(f).After(time.Time(b.(MeasureTime))) || time.Time(f).Equal(time.Time(b.(MeasureTime)))
 	}
 	return false
 }
@@ -138,20 +140,252 @@ func (f MeasureTime) BiggerOrEqual(b interface{}) bool {
 func (f MeasureTime) SmallerOrEqual(b interface{}) bool {
 	switch b.(type) {
 	case MeasureTime:
-		return time.Time(f).Before(b.(time.Time)) || time.Time(f).Equal(b.(time.Time))
+		return time.Time(f).Before(time.Time(b.(MeasureTime))) || time.Time(f).Equal(time.Time(b.(MeasureTime)))
 	}
 	return false
 }
 
+// MeasureInt is an exact signed integer measure. It compares exactly with
+// MeasureInt and MeasureUint values; like the other measure types, every
+// comparison against a different measure type (including MeasureFloat) is false.
+type MeasureInt int64
+
+func (a MeasureInt) compare(b interface{}) (int, bool) {
+	switch b.(type) {
+	case MeasureInt:
+		return compareInt64(int64(a), int64(b.(MeasureInt))), true
+	case MeasureUint:
+		if a < 0 {
+			return -1, true
+		}
+		return compareUint64(uint64(a), uint64(b.(MeasureUint))), true
+	}
+	return 0, false
+}
+
+func (a MeasureInt) Bigger(b interface{}) bool {
+	c, ok := a.compare(b)
+	return ok && c > 0
+}
+
+func (a MeasureInt) Smaller(b interface{}) bool {
+	c, ok := a.compare(b)
+	return ok && c < 0
+}
+
+func (a MeasureInt) Equal(b interface{}) bool {
+	c, ok := a.compare(b)
+	return ok && c == 0
+}
+
+func (a MeasureInt) BiggerOrEqual(b interface{}) bool {
+	c, ok := a.compare(b)
+	return ok && c >= 0
+}
+
+func (a MeasureInt) SmallerOrEqual(b interface{}) bool {
+	c, ok := a.compare(b)
+	return ok && c <= 0
+}
+
+// MeasureUint is an exact unsigned integer measure, comparable with MeasureInt
+// and MeasureUint under the same rules as MeasureInt.
+type MeasureUint uint64
+
+func (a MeasureUint) compare(b interface{}) (int, bool) {
+	switch b.(type) {
+	case MeasureUint:
+		return compareUint64(uint64(a), uint64(b.(MeasureUint))), true
+	case MeasureInt:
+		if b.(MeasureInt) < 0 {
+			return 1, true
+		}
+		return compareUint64(uint64(a), uint64(b.(MeasureInt))), true
+	}
+	return 0, false
+}
+
+func (a MeasureUint) Bigger(b interface{}) bool {
+	c, ok := a.compare(b)
+	return ok && c > 0
+}
+
+func (a MeasureUint) Smaller(b interface{}) bool {
+	c, ok := a.compare(b)
+	return ok && c < 0
+}
+
+func (a MeasureUint) Equal(b interface{}) bool {
+	c, ok := a.compare(b)
+	return ok && c == 0
+}
+
+func (a MeasureUint) BiggerOrEqual(b interface{}) bool {
+	c, ok := a.compare(b)
+	return ok && c >= 0
+}
+
+func (a MeasureUint) SmallerOrEqual(b interface{}) bool {
+	c, ok := a.compare(b)
+	return ok && c <= 0
+}
+
+func compareInt64(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareUint64(a, b uint64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// discreteKey returns the measure used as hash key on discrete dims, so that
+// equal MeasureInt and MeasureUint values land in the same bucket.
+func discreteKey(m Measure) Measure {
+	if u, ok := m.(MeasureUint); ok && uint64(u) <= math.MaxInt64 {
+		return MeasureInt(u)
+	}
+	return m
+}
+
+// Interval is a range on a real dim. Both endpoints are closed by default; wrap
+// an endpoint in Exclusive to open it, or leave it nil to make that side
+// unbounded: Interval{MeasureFloat(18), nil} is "age >= 18" and
+// Interval{start, Exclusive{end}} is the half-open window [start, end).
 type Interval [2]Measure
 type Intervals []Interval
 
+// Exclusive marks an interval endpoint as open.
+type Exclusive struct {
+	Measure
+}
+
+func (e Exclusive) String() string {
+	return fmt.Sprintf("(%v)", e.Measure)
+}
+
 func (i Interval) Contains(p Measure) bool {
 	if p == nil {
 		return true
 	}
 
-	return p.BiggerOrEqual(i[0]) && p.SmallerOrEqual(i[1])
+	if set, ok := p.(MeasureSet); ok {
+		for _, x := range set {
+			if i.Contains(x) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if lower := i.lowerBound(); lower.m != nil {
+		if lower.side > 0 && p.Bigger(lower.m) == false {
+			return false
+		}
+		if lower.side == 0 && p.BiggerOrEqual(lower.m) == false {
+			return false
+		}
+	}
+
+	if upper := i.upperBound(); upper.m != nil {
+		if upper.side < 0 && p.Smaller(upper.m) == false {
+			return false
+		}
+		if upper.side == 0 && p.SmallerOrEqual(upper.m) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// Intersects reports whether both intervals share at least one point.
+func (i Interval) Intersects(o Interval) bool {
+	lower, upper := i.lowerBound(), i.upperBound()
+	if oLower := o.lowerBound(); oLower.compare(lower) > 0 {
+		lower = oLower
+	}
+	if oUpper := o.upperBound(); oUpper.compare(upper) < 0 {
+		upper = oUpper
+	}
+	return lower.compare(upper) <= 0
+}
+
+func (i Interval) lowerBound() bound {
+	switch m := i[0].(type) {
+	case nil:
+		return bound{side: -1}
+	case Exclusive:
+		if m.Measure == nil {
+			return bound{side: -1}
+		}
+		return bound{m: m.Measure, side: 1}
+	default:
+		return bound{m: m}
+	}
+}
+
+func (i Interval) upperBound() bound {
+	switch m := i[1].(type) {
+	case nil:
+		return bound{side: 1}
+	case Exclusive:
+		if m.Measure == nil {
+			return bound{side: 1}
+		}
+		return bound{m: m.Measure, side: -1}
+	default:
+		return bound{m: m}
+	}
+}
+
+// bound is an interval endpoint placed on the measure axis: side -1 sits just
+// below m, 0 at m and 1 just above m. A nil m is -inf or +inf by side.
+type bound struct {
+	m    Measure
+	side int
+}
+
+func (a bound) compare(b bound) int {
+	if a.m == nil || b.m == nil {
+		aRank, bRank := 0, 0
+		if a.m == nil {
+			aRank = a.side
+		}
+		if b.m == nil {
+			bRank = b.side
+		}
+		return compareInt64(int64(aRank), int64(bRank))
+	}
+
+	if a.m.Smaller(b.m) {
+		return -1
+	} else if a.m.Bigger(b.m) {
+		return 1
+	}
+	return compareInt64(int64(a.side), int64(b.side))
+}
+
+type sortBounds []bound
+
+func (s sortBounds) Len() int {
+	return len(s)
+}
+
+func (s sortBounds) Less(i, j int) bool {
+	return s[i].compare(s[j]) < 0
+}
+
+func (s sortBounds) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
 }
 
 type Measures []Measure
@@ -161,6 +395,15 @@ func (s Measures) Contains(p Measure) bool {
 		return true
 	}
 
+	if set, ok := p.(MeasureSet); ok {
+		for _, x := range set {
+			if s.Contains(x) {
+				return true
+			}
+		}
+		return false
+	}
+
 	for _, m := range s {
 		if m.Equal(p) {
 			return true
@@ -169,6 +412,86 @@ func (s Measures) Contains(p Measure) bool {
 	return false
 }
 
+// ExcludedMeasures is a negative constraint on a discrete dim: it matches every
+// value except the listed ones, e.g. "any country except CN, RU".
+type ExcludedMeasures []Measure
+
+// Contains reports whether p is allowed by the exclusion. A missing value never
+// satisfies an exclusion, just as it never satisfies a Measures constraint in
+// Rect.Contains.
+func (s ExcludedMeasures) Contains(p Measure) bool {
+	if p == nil {
+		return false
+	}
+
+	if set, ok := p.(MeasureSet); ok {
+		for _, x := range set {
+			if s.Contains(x) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, m := range s {
+		if m.Equal(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// MeasureSet carries several values of one point dim, like the tags of a
+// request, with any-of semantics: a constraint is satisfied when at least one
+// of the values satisfies it, and each comparison holds when it holds for at
+// least one value.
+type MeasureSet []Measure
+
+func (s MeasureSet) Bigger(b interface{}) bool {
+	for _, m := range s {
+		if m.Bigger(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s MeasureSet) Smaller(b interface{}) bool {
+	for _, m := range s {
+		if m.Smaller(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s MeasureSet) Equal(b interface{}) bool {
+	for _, m := range s {
+		if m.Equal(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s MeasureSet) BiggerOrEqual(b interface{}) bool {
+	for _, m := range s {
+		if m.BiggerOrEqual(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s MeasureSet) SmallerOrEqual(b interface{}) bool {
+	for _, m := range s {
+		if m.SmallerOrEqual(b) {
+			return true
+		}
+	}
+	return false
+}
+
 type Point map[interface{}]Measure
 
 type Rect map[interface{}]interface{}
@@ -185,36 +508,86 @@ func (rect Rect) Clone() Rect {
 				newSc = append(newSc, s)
 			}
 			newRect[name] = newSc
+		case ExcludedMeasures:
+			var newSc ExcludedMeasures
+			for _, s := range d.(ExcludedMeasures) {
+				newSc = append(newSc, s)
+			}
+			newRect[name] = newSc
 		}
 
 	}
 	return newRect
 }
 
+// Key returns a canonical string of the rect: rects with the same key match the
+// same points. Measures keep their type, so that MeasureInt(5) and
+// MeasureString("5") differ.
 func (rect Rect) Key() string {
 	var dimKeys []string
 	for name, d := range rect {
+		name := fmt.Sprintf("%T(%v)", name, name)
 		switch d.(type) {
 		case Interval:
 			dimKeys = append(dimKeys, fmt.Sprintf("%v=%v_%v",
-				name, d.(Interval)[0], d.(Interval)[1]))
+				name, measureKey(d.(Interval)[0]), measureKey(d.(Interval)[1])))
+		case Intervals:
+			var intervals []string
+			for _, interval := range d.(Intervals) {
+				intervals = append(intervals, fmt.Sprintf("%v_%v", measureKey(interval[0]), measureKey(interval[1])))
+			}
+			dimKeys = append(dimKeys, fmt.Sprintf("%v=%v",
+				name, intervals))
+		case Measure:
+			dimKeys = append(dimKeys, fmt.Sprintf("%v_[%v]",
+				name, measureKey(d.(Measure))))
 		case Measures:
 			dimKeys = append(dimKeys, fmt.Sprintf("%v_%v",
-				name, d.(Measures)))
+				name, measureKeys(d.(Measures))))
+		case ExcludedMeasures:
+			dimKeys = append(dimKeys, fmt.Sprintf("%v!%v",
+				name, measureKeys(d.(ExcludedMeasures))))
 		}
 
 	}
+	sort.Strings(dimKeys)
 	return strings.Join(dimKeys, ":")
 }
 
+// measureKey formats the measure with its type, discrete values and interval
+// bounds comparing equal getting the same key.
+func measureKey(m Measure) string {
+	switch m := m.(type) {
+	case nil:
+		return "nil"
+	case Exclusive:
+		return fmt.Sprintf("(%v)", measureKey(m.Measure))
+	}
+	m = discreteKey(m)
+	return fmt.Sprintf("%T(%v)", m, m)
+}
+
+// measureKeys returns the sorted keys of the distinct measures.
+func measureKeys(measures []Measure) []string {
+	var keys []string
+	for _, m := range uniqueDiscreteKeys(measures) {
+		keys = append(keys, measureKey(m))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (rect Rect) Contains(p Point) bool {
 	for name, d := range rect {
 		switch d.(type) {
 		case Interval:
-			if d.(Interval).Contains(p[name]) == false {
+			if p[name] == nil || d.(Interval).Contains(p[name]) == false {
 				return false
 			}
 		case Intervals:
+			if p[name] == nil {
+				return false
+			}
 			found := false
 			for _, interval := range d.(Intervals) {
 				if interval.Contains(p[name]) {
@@ -226,18 +599,15 @@ func (rect Rect) Contains(p Point) bool {
 				return false
 			}
 		case Measure:
-			if d.(Measure).Equal(p[name]) == false {
+			if p[name] == nil || (Measures{d.(Measure)}).Contains(p[name]) == false {
 				return false
 			}
 		case Measures:
-			found := false
-			for _, dD := range d.(Measures) {
-				if dD.Equal(p[name]) {
-					found = true
-					break
-				}
+			if p[name] == nil || d.(Measures).Contains(p[name]) == false {
+				return false
 			}
-			if found == false {
+		case ExcludedMeasures:
+			if d.(ExcludedMeasures).Contains(p[name]) == false {
 				return false
 			}
 		}
@@ -257,14 +627,14 @@ func (rect Rect) HasIntersect(s Rect) bool {
 		case Interval:
 			switch p.(type) {
 			case Interval:
-				if d.(Interval).Contains(p.(Interval)[0]) == false && d.(Interval).Contains(p.(Interval)[1]) == false {
+				if d.(Interval).Intersects(p.(Interval)) == false {
 					return false
 				}
 			case Intervals:
 				found := false
 				for _, pInterval := range p.(Intervals) {
-					if d.(Interval).Contains(pInterval[0])  || d.(Interval).Contains(pInterval[1])  {
-						found  = true
+					if d.(Interval).Intersects(pInterval) {
+						found = true
 						break
 					}
 				}
@@ -279,8 +649,8 @@ func (rect Rect) HasIntersect(s Rect) bool {
 			case Interval:
 				found := false
 				for _, dInterval := range d.(Intervals) {
-					if dInterval.Contains(p.(Interval)[0])  || d.(Interval).Contains(p.(Interval)[1])  {
-						found  = true
+					if dInterval.Intersects(p.(Interval)) {
+						found = true
 						break
 					}
 				}
@@ -291,7 +661,7 @@ func (rect Rect) HasIntersect(s Rect) bool {
 				found := false
 				for _, dInterval := range d.(Intervals) {
 					for _, pInterval := range p.(Intervals) {
-						if dInterval.Contains(pInterval[0]) || dInterval.Contains(pInterval[1]) {
+						if dInterval.Intersects(pInterval) {
 							found = true
 							break
 						}
@@ -323,6 +693,10 @@ func (rect Rect) HasIntersect(s Rect) bool {
 				if found == false {
 					return false
 				}
+			case ExcludedMeasures:
+				if p.(ExcludedMeasures).Contains(d.(Measure)) == false {
+					return false
+				}
 			default:
 				return false
 			}
@@ -355,6 +729,38 @@ func (rect Rect) HasIntersect(s Rect) bool {
 				if found == false {
 					return false
 				}
+			case ExcludedMeasures:
+				found := false
+				for _, dD := range d.(Measures) {
+					if p.(ExcludedMeasures).Contains(dD) {
+						found = true
+						break
+					}
+				}
+				if found == false {
+					return false
+				}
+			default:
+				return false
+			}
+		case ExcludedMeasures:
+			switch p.(type) {
+			case Measure:
+				if d.(ExcludedMeasures).Contains(p.(Measure)) == false {
+					return false
+				}
+			case Measures:
+				found := false
+				for _, pP := range p.(Measures) {
+					if d.(ExcludedMeasures).Contains(pP) {
+						found = true
+						break
+					}
+				}
+				if found == false {
+					return false
+				}
+			case ExcludedMeasures:
 			default:
 				return false
 			}
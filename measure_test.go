@@ -2,6 +2,8 @@ package go_kd_segment_tree
 
 import (
 	"fmt"
+	mapset "github.com/deckarep/golang-set/v2"
+	"math"
 	"testing"
 )
 
@@ -27,3 +29,132 @@ func TestInterval_Contains(t *testing.T) {
 		fmt.Println("Interval")
 	}
 }
+
+func TestMeasureInt_Compare(t *testing.T) {
+	big := MeasureInt(1<<53 + 1)
+	if big.Equal(MeasureInt(1<<53)) || big.SmallerOrEqual(MeasureInt(1<<53)) {
+		t.Fatal("int measure lost precision")
+	}
+
+	if !MeasureInt(5).Equal(MeasureUint(5)) || !MeasureUint(5).Equal(MeasureInt(5)) {
+		t.Fatal("int and uint measures should be equal")
+	}
+	if !MeasureInt(-1).Smaller(MeasureUint(0)) || !MeasureUint(0).Bigger(MeasureInt(-1)) {
+		t.Fatal("negative int should be smaller than any uint")
+	}
+	if !MeasureUint(math.MaxUint64).Bigger(MeasureInt(math.MaxInt64)) {
+		t.Fatal("max uint should be bigger than max int")
+	}
+
+	// different measure families never compare
+	if MeasureInt(1).Equal(MeasureFloat(1)) || MeasureInt(1).Smaller(MeasureFloat(2)) ||
+		MeasureUint(1).BiggerOrEqual(MeasureFloat(0)) || MeasureFloat(1).Equal(MeasureInt(1)) {
+		t.Fatal("int measures should not compare with float measures")
+	}
+}
+
+func TestMeasureInt_Tree(t *testing.T) {
+	tree := NewTree(DimTypes{
+		"user":     DimTypeDiscrete,
+		"campaign": DimTypeReal,
+	}, &TreeOptions{LeafNodeDataMax: 1})
+
+	base := int64(1 << 60)
+	for i := int64(0); i < 32; i++ {
+		err := tree.Add(Rect{
+			"user":     Measures{MeasureUint(base + i%4)},
+			"campaign": Interval{MeasureInt(base + i*10), MeasureInt(base + i*10 + 9)},
+		}, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree.Build()
+
+	result := tree.Search(Point{"user": MeasureInt(base + 1), "campaign": MeasureUint(base + 53)})
+	if len(result) != 1 || result[0] != int64(5) {
+		t.Fatal("int tree search error:", result)
+	}
+
+	result = tree.Search(Point{"user": MeasureInt(base + 2), "campaign": MeasureInt(base + 53)})
+	if len(result) != 0 {
+		t.Fatal("int tree search error:", result)
+	}
+}
+
+func TestInterval_Bounds(t *testing.T) {
+	closed := Interval{MeasureInt(1), MeasureInt(3)}
+	halfOpen := Interval{MeasureInt(1), Exclusive{MeasureInt(3)}}
+	atLeast := Interval{MeasureInt(18), nil}
+	below := Interval{nil, Exclusive{MeasureInt(0)}}
+
+	cases := []struct {
+		interval Interval
+		p        Measure
+		contains bool
+	}{
+		{closed, MeasureInt(1), true},
+		{closed, MeasureInt(3), true},
+		{halfOpen, MeasureInt(1), true},
+		{halfOpen, MeasureInt(3), false},
+		{Interval{Exclusive{MeasureInt(1)}, MeasureInt(3)}, MeasureInt(1), false},
+		{atLeast, MeasureInt(18), true},
+		{atLeast, MeasureInt(1 << 40), true},
+		{atLeast, MeasureInt(17), false},
+		{below, MeasureInt(-1 << 40), true},
+		{below, MeasureInt(0), false},
+		{Interval{nil, nil}, MeasureString("any"), true},
+	}
+	for i, c := range cases {
+		if c.interval.Contains(c.p) != c.contains {
+			t.Fatal("interval contains error:", i, c.interval, c.p)
+		}
+	}
+
+	if halfOpen.Intersects(Interval{MeasureInt(3), MeasureInt(5)}) {
+		t.Fatal("[1,3) should not intersect [3,5]")
+	}
+	if !closed.Intersects(Interval{MeasureInt(3), MeasureInt(5)}) {
+		t.Fatal("[1,3] should intersect [3,5]")
+	}
+	if !atLeast.Intersects(Interval{MeasureInt(0), MeasureInt(20)}) || !atLeast.Intersects(Interval{nil, nil}) {
+		t.Fatal("unbounded interval intersect error")
+	}
+	if !(Rect{"a": Interval{MeasureInt(0), MeasureInt(10)}}).HasIntersect(Rect{"a": Interval{MeasureInt(2), MeasureInt(3)}}) {
+		t.Fatal("rect should intersect a contained interval")
+	}
+}
+
+func TestRect_KeyTypes(t *testing.T) {
+	rects := []Rect{
+		{"tag": Measures{MeasureInt(5)}},
+		{"tag": Measures{MeasureFloat(5)}},
+		{"tag": Measures{MeasureString("5")}},
+		{"age": Interval{MeasureInt(5), nil}},
+		{"age": Interval{MeasureFloat(5), nil}},
+		{"age": Interval{Exclusive{MeasureInt(5)}, nil}},
+	}
+
+	keys := make(map[string]bool)
+	for _, rect := range rects {
+		keys[rect.Key()] = true
+	}
+	if len(keys) != len(rects) {
+		t.Fatal("rects of different measure types share a key:", keys)
+	}
+
+	// equal discrete values and bounds keep the same key
+	if (Rect{"tag": Measures{MeasureUint(5), MeasureInt(6)}}).Key() != (Rect{"tag": Measures{MeasureInt(6), MeasureInt(5)}}).Key() ||
+		(Rect{"age": Interval{MeasureUint(5), nil}}).Key() != (Rect{"age": Interval{MeasureInt(5), nil}}).Key() {
+		t.Fatal("equal rects get different keys")
+	}
+
+	// rects of one rule are not merged when their types differ
+	var segs []*TypedSegment[int]
+	for i, rect := range rects {
+		segs = append(segs, &TypedSegment[int]{ID: "rule", Rect: rect, Data: mapset.NewSet[int](i)})
+	}
+	if merged := MergeSegments(segs); len(merged) != len(rects) {
+		t.Fatal("rects of different measure types merged:", merged)
+	}
+}
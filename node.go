@@ -1,28 +1,65 @@
 package go_kd_segment_tree
 
-type TreeNode interface {
-	Search(p Point) []interface{}
-	Insert(seg *Segment) error
-	SearchRect(rect Rect) []interface{}
+import (
+	mapset "github.com/deckarep/golang-set/v2"
+	"sync"
+)
+
+// TreeNode is the untyped tree node kept for compatibility with interface{} payloads.
+type TreeNode = TypedTreeNode[interface{}]
+
+type TypedTreeNode[T comparable] interface {
+	Search(p Point) []T
+	// SearchEncoded is Search for a point encoded by the schema of the tree.
+	SearchEncoded(p *EncodedPoint) []T
+	// Insert returns a new version of the node holding seg. The receiver is
+	// left unchanged, so searches running on an older snapshot stay valid.
+	Insert(seg *TypedSegment[T]) (TypedTreeNode[T], error)
+	// Remove returns a new version of the node without data, the node itself
+	// when it does not hold data, or nil when nothing is left in it.
+	Remove(data T) TypedTreeNode[T]
+	// Delete is like Remove for the segments with the stable id.
+	Delete(id string) TypedTreeNode[T]
+	SearchRect(rect Rect) []T
 	Dumps(prefix string) string
 }
 
-func NewNode(segments []*Segment,
-	tree *Tree,
+func NewNode[T comparable](segments []*TypedSegment[T],
+	tree *TypedTree[T],
+	level int,
+) TypedTreeNode[T] {
+	return newNode(segments, tree.encodeTraffic(), tree, level)
+}
+
+// newNode is NewNode for the sampled queries reaching the node.
+func newNode[T comparable](segments []*TypedSegment[T],
+	traffic []*EncodedPoint,
+	tree *TypedTree[T],
 	level int,
-) TreeNode {
+) TypedTreeNode[T] {
 	if len(segments) == 0 {
 		return nil
 	}
 
 	if len(segments) <= tree.options.LeafNodeDataMax || level >= tree.options.TreeLevelMax {
 		mergedSegments := MergeSegments(segments)
-		return &LeafNode{
+		tree.indexSegments(mergedSegments)
+		return &TypedLeafNode[T]{
 			Segments: mergedSegments,
+			debt:     insertDebt{built: len(mergedSegments)},
 		}
 	}
 
-	dimName, decreasePercent := findBestBranchingDim(segments, tree.dimTypes)
+	// the cost model needs queries, a node no sampled query reaches falls back
+	// to counting segments
+	var dimName interface{}
+	var decreasePercent float64
+	var mid Measure
+	if len(traffic) > 0 {
+		dimName, decreasePercent, mid = findCheapestBranchingDim(segments, traffic, tree)
+	} else {
+		dimName, decreasePercent = findBestBranchingDim(segments, tree)
+	}
 	if decreasePercent < tree.options.BranchingDecreasePercentMin {
 		if tree.options.ConjunctionTargetRateMin > 0 {
 			conjunctionNode := NewConjunctionNode(tree, segments, nil, 1.0, level+1)
@@ -32,64 +69,185 @@ func NewNode(segments []*Segment,
 			}
 		}
 		mergedSegments := MergeSegments(segments)
-		return &LeafNode{
+		tree.indexSegments(mergedSegments)
+		return &TypedLeafNode[T]{
 			Segments: mergedSegments,
+			debt:     insertDebt{built: len(mergedSegments)},
 		}
 	}
 
+	// sibling subtrees are built by the free workers of a parallel build
+	var wg sync.WaitGroup
 	switch tree.dimTypes[dimName].Type {
 	case DimTypeReal.Type:
-		node, pass, left, right := NewBinaryNode(tree, segments, dimName, decreasePercent, level)
+		var node *TypedBinaryNode[T]
+		var pass, left, right []*TypedSegment[T]
+		if mid != nil {
+			node, pass, left, right = newBinaryNodeAt(tree, segments, dimName, decreasePercent, level, mid)
+		} else {
+			node, pass, left, right = NewBinaryNode(tree, segments, dimName, decreasePercent, level)
+		}
+		leftTraffic, rightTraffic := splitBinaryTraffic(traffic, node)
 		if len(pass) > 0 {
-			node.Pass = NewNode(pass, tree, level+1)
+			tree.goBuild(&wg, func() { node.Pass = newNode(pass, traffic, tree, level+1) })
 		}
 		if len(left) > 0 {
-			node.Left = NewNode(left, tree, level+1)
+			tree.goBuild(&wg, func() { node.Left = newNode(left, leftTraffic, tree, level+1) })
 		}
 		if len(right) > 0 {
-			node.Right = NewNode(right, tree, level+1)
+			tree.goBuild(&wg, func() { node.Right = newNode(right, rightTraffic, tree, level+1) })
 		}
+		wg.Wait()
 		return node
 	case DimTypeDiscrete.Type:
-		node, passSegments, children := NewHashNode(tree, segments, dimName, decreasePercent, level)
-		for childKey, childSegments := range children {
-			node.child[childKey] = NewNode(childSegments, tree, level+1)
+		node, passSegments, children, otherSegments := NewHashNode(tree, segments, dimName, decreasePercent, level)
+		var childKeys []Measure
+		var childIDs []int32
+		for childKey := range children {
+			childKeys = append(childKeys, childKey)
+			childIDs = append(childIDs, tree.schema.intern(childKey))
+		}
+		childTraffic, otherTraffic := splitHashTraffic(traffic, node.dim, childIDs)
+		childNodes := make([]TypedTreeNode[T], len(childKeys))
+		for i := range childKeys {
+			i := i
+			tree.goBuild(&wg, func() { childNodes[i] = newNode(children[childKeys[i]], childTraffic[i], tree, level+1) })
 		}
 		if len(passSegments) > 0 {
-			node.pass = NewNode(passSegments, tree, level+1)
+			tree.goBuild(&wg, func() { node.pass = newNode(passSegments, traffic, tree, level+1) })
+		}
+		if len(otherSegments) > 0 {
+			tree.goBuild(&wg, func() { node.other = newNode(otherSegments, otherTraffic, tree, level+1) })
+		}
+		wg.Wait()
+		for i, childID := range childIDs {
+			node.child[childID] = childNodes[i]
 		}
 		return node
 	}
 	return nil
 }
 
-func findBestBranchingDim(
-	segments []*Segment,
-	dimTypes map[interface{}]DimType,
+// findBestBranchingDim returns the dim whose split removes the most segments
+// from the biggest branch, the first one by schema index on a tie, along with
+// the removed share of the segments. The dims are evaluated by the free
+// workers of a parallel build.
+func findBestBranchingDim[T comparable](
+	segments []*TypedSegment[T],
+	tree *TypedTree[T],
 ) (interface{}, float64) {
 	if len(segments) == 0 {
 		return nil, 0
 	}
 
+	dims := tree.schema.dims
+	decreases := make([]int, len(dims))
+	var wg sync.WaitGroup
+	for i := range dims {
+		i := i
+		tree.goBuild(&wg, func() {
+			switch tree.schema.dimTypes[i].Type {
+			case DimTypeReal.Type:
+				decreases[i], _ = getRealDimSegmentsDecrease(segments, dims[i])
+			case DimTypeDiscrete.Type:
+				decreases[i], _ = getDiscreteDimSegmentsDecrease(segments, dims[i])
+			}
+		})
+	}
+	wg.Wait()
+
 	var maxDecreaseDimName interface{}
 	var maxDecrease int
-	for dimName, dimType := range dimTypes {
-		switch dimType.Type {
-		case DimTypeReal.Type:
-			decreaseC, _ := getRealDimSegmentsDecrease(segments, dimName)
-			if decreaseC > maxDecrease {
-				maxDecrease = decreaseC
-				maxDecreaseDimName = dimName
-			}
-		case DimTypeDiscrete.Type:
-			decreaseC, _ := getDiscreteDimSegmentsDecrease(segments, dimName)
-			if decreaseC > maxDecrease {
-				maxDecrease = decreaseC
-				maxDecreaseDimName = dimName
-			}
+	for i, decrease := range decreases {
+		if decrease > maxDecrease {
+			maxDecrease = decrease
+			maxDecreaseDimName = dims[i]
 		}
 	}
 
 	p := float64(maxDecrease) * 1.0 / float64(len(segments))
 	return maxDecreaseDimName, p
 }
+
+// insertNode inserts seg into a child node, creating a leaf for a missing child.
+func insertNode[T comparable](node TypedTreeNode[T], seg *TypedSegment[T]) (TypedTreeNode[T], error) {
+	if node == nil {
+		return &TypedLeafNode[T]{
+			Segments: []*TypedSegment[T]{seg},
+			debt:     insertDebt{inserted: 1},
+		}, nil
+	}
+	return node.Insert(seg)
+}
+
+// removeSegmentsData returns the segments without data and whether any of them
+// held it. Segments holding data are copied instead of being modified.
+func removeSegmentsData[T comparable](segments []*TypedSegment[T], data T) ([]*TypedSegment[T], bool) {
+	var newSegments []*TypedSegment[T]
+	var changed = false
+	for _, seg := range segments {
+		if seg.Data.Contains(data) == false {
+			newSegments = append(newSegments, seg)
+			continue
+		}
+
+		changed = true
+		newSeg := &TypedSegment[T]{
+			ID:    seg.ID,
+			Rect:  seg.Rect,
+			Data:  seg.Data.Clone(),
+			rnd:   seg.rnd,
+			index: seg.index,
+
+			dims:    seg.dims,
+			encoded: seg.encoded,
+		}
+		newSeg.Data.Remove(data)
+		if seg.merged != nil {
+			newSeg.merged, _ = removeSegmentsData(seg.merged, data)
+		}
+		if newSeg.Data.Cardinality() > 0 {
+			newSegments = append(newSegments, newSeg)
+		}
+	}
+	return newSegments, changed
+}
+
+// deleteSegments returns the segments without the ones with the stable id and
+// whether any of them had it.
+func deleteSegments[T comparable](segments []*TypedSegment[T], id string) ([]*TypedSegment[T], bool) {
+	var newSegments []*TypedSegment[T]
+	var changed = false
+	for _, seg := range segments {
+		if seg.ID == id {
+			changed = true
+			continue
+		}
+		newSegments = append(newSegments, seg)
+	}
+	return newSegments, changed
+}
+
+// unionResults merges the search results of sibling nodes, removing the
+// duplicates only when more than one of them is not empty.
+func unionResults[T comparable](results ...[]T) []T {
+	var merged []T
+	var set mapset.Set[T]
+	for _, result := range results {
+		if len(result) == 0 {
+			continue
+		}
+		if merged == nil {
+			merged = result
+			continue
+		}
+		if set == nil {
+			set = mapset.NewSet[T](merged...)
+		}
+		set.Append(result...)
+	}
+	if set != nil {
+		return set.ToSlice()
+	}
+	return merged
+}
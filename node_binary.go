@@ -3,66 +3,88 @@ package go_kd_segment_tree
 import (
 	"errors"
 	"fmt"
-	mapset "github.com/deckarep/golang-set"
+	mapset "github.com/deckarep/golang-set/v2"
 	"sort"
 )
 
-type BinaryNode struct {
-	TreeNode
+// BinaryNode is the untyped binary node kept for compatibility with interface{} payloads.
+type BinaryNode = TypedBinaryNode[interface{}]
 
-	Tree *Tree
+type TypedBinaryNode[T comparable] struct {
+	TypedTreeNode[T]
+
+	Tree *TypedTree[T]
 
 	DimName         interface{}
 	Level           int
 	DecreasePercent float64
 
+	debt insertDebt
+
+	// dim is the index of DimName in the schema of the tree
+	dim int
+
 	Mid Measure
 
-	Left  TreeNode
-	Right TreeNode
+	Left  TypedTreeNode[T]
+	Right TypedTreeNode[T]
 
-	Pass TreeNode
+	Pass TypedTreeNode[T]
 }
 
-func (node *BinaryNode) Search(p Point) []interface{} {
+func (node *TypedBinaryNode[T]) Search(p Point) []T {
 	if node == nil {
 		return nil
 	}
+	return node.SearchEncoded(node.Tree.schema.Encode(p))
+}
 
-	if _, ok := p[node.DimName]; ok == false {
+func (node *TypedBinaryNode[T]) SearchEncoded(p *EncodedPoint) []T {
+	if node == nil {
 		return nil
 	}
 
-	x := p[node.DimName]
+	// only the segments not constrained on the dim match a point lacking it
+	x := p.Value(node.dim)
+	if x == nil {
+		if node.Pass != nil {
+			return node.Pass.SearchEncoded(p)
+		}
+		return nil
+	}
 
-	var passResult []interface{}
+	var passResult []T
 	if node.Pass != nil {
-		passResult = node.Pass.Search(p)
+		passResult = node.Pass.SearchEncoded(p)
 	}
 
-	var childResult []interface{}
-	if x.Smaller(node.Mid) {
-		if node.Left == nil {
-			return nil
+	searchLeft, searchRight := false, false
+	if set, ok := x.(MeasureSet); ok {
+		for _, m := range set {
+			if m.Smaller(node.Mid) {
+				searchLeft = true
+			} else {
+				searchRight = true
+			}
 		}
-		childResult = node.Left.Search(p)
+	} else if x.Smaller(node.Mid) {
+		searchLeft = true
 	} else {
-		if node.Right == nil {
-			return nil
-		}
-		childResult = node.Right.Search(p)
+		searchRight = true
 	}
 
-	if len(passResult) == 0 {
-		return childResult
-	} else if len(childResult) == 0 {
-		return passResult
-	} else {
-		return mapset.NewSet(passResult...).Union(mapset.NewSet(childResult...)).ToSlice()
+	var leftResult, rightResult []T
+	if searchLeft && node.Left != nil {
+		leftResult = node.Left.SearchEncoded(p)
+	}
+	if searchRight && node.Right != nil {
+		rightResult = node.Right.SearchEncoded(p)
 	}
+
+	return unionResults(passResult, leftResult, rightResult)
 }
 
-func (node *BinaryNode) SearchRect(r Rect) []interface{} {
+func (node *TypedBinaryNode[T]) SearchRect(r Rect) []T {
 	if node == nil {
 		return nil
 	}
@@ -77,24 +99,17 @@ func (node *BinaryNode) SearchRect(r Rect) []interface{} {
 
 	dimInterval := r[node.DimName].(Interval)
 
-	var passResult []interface{}
+	var passResult []T
 	if node.Pass != nil {
 		passResult = node.Pass.SearchRect(r)
 	}
 
-	var childResult []interface{}
-	if dimInterval[1].Smaller(node.Mid) {
-		if node.Left == nil {
-			return nil
-		}
-		childResult = node.Left.SearchRect(r)
-	} else if dimInterval[0].Bigger(node.Mid) {
-		if node.Right == nil {
-			return nil
-		}
-		childResult = node.Right.SearchRect(r)
-	} else {
+	var childResult []T
+	side := binarySide(dimInterval, node.Mid)
+	if side <= 0 && node.Left != nil {
 		childResult = append(childResult, node.Left.SearchRect(r)...)
+	}
+	if side >= 0 && node.Right != nil {
 		childResult = append(childResult, node.Right.SearchRect(r)...)
 	}
 
@@ -103,120 +118,169 @@ func (node *BinaryNode) SearchRect(r Rect) []interface{} {
 	} else if len(childResult) == 0 {
 		return passResult
 	} else {
-		return mapset.NewSet(passResult...).Union(mapset.NewSet(childResult...)).ToSlice()
+		return mapset.NewSet[T](passResult...).Union(mapset.NewSet[T](childResult...)).ToSlice()
 	}
 }
 
-func (node *BinaryNode) Insert(seg *Segment) error {
+func (node *TypedBinaryNode[T]) Insert(seg *TypedSegment[T]) (TypedTreeNode[T], error) {
 	if node == nil || seg == nil {
-		return errors.New("binary node is None")
+		return nil, errors.New("binary node is None")
 	}
 
+	newNode := *node
+	newNode.debt.inserted++
+	var err error
+
 	if _, ok := seg.Rect[node.DimName]; ok == false {
-		if node.Pass != nil {
-			return node.Pass.Insert(seg)
-		} else {
-			node.Pass = &LeafNode{
-				Segments: []*Segment{seg},
-			}
-			return nil
+		newNode.Pass, err = insertNode(node.Pass, seg)
+		if err != nil {
+			return nil, err
 		}
+		newNode.Pass = node.Tree.rebuildDegraded(newNode.Pass, node.Level+1)
+		return &newNode, nil
 	}
 
 	if _, ok := seg.Rect[node.DimName].(Interval); ok == false {
-		return errors.New(fmt.Sprintf("wrong binary range: %v", node.DimName))
+		return nil, errors.New(fmt.Sprintf("wrong binary range: %v", node.DimName))
 	}
 
-	dimInterval := seg.Rect[node.DimName].(Interval)
-	if dimInterval[1].Smaller(node.Mid) {
-		if node.Left == nil {
-			node.Left = &LeafNode{
-				Segments: []*Segment{seg},
-			}
-			return nil
-		}
-		return node.Left.Insert(seg)
-	} else if dimInterval[0].Bigger(node.Mid) {
-		if node.Right == nil {
-			node.Right = &LeafNode{
-				Segments: []*Segment{seg},
-			}
-			return nil
-		}
-		return node.Right.Insert(seg)
-	} else {
-		if node.Left == nil {
-			node.Left = &LeafNode{
-				Segments: []*Segment{seg},
-			}
-			return nil
-		}
-		err := node.Left.Insert(seg)
+	side := binarySide(seg.Rect[node.DimName].(Interval), node.Mid)
+	if side <= 0 {
+		newNode.Left, err = insertNode(node.Left, seg)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if node.Right == nil {
-			node.Right = &LeafNode{
-				Segments: []*Segment{seg},
-			}
-			return nil
+		newNode.Left = node.Tree.rebuildDegraded(newNode.Left, node.Level+1)
+	}
+	if side >= 0 {
+		newNode.Right, err = insertNode(node.Right, seg)
+		if err != nil {
+			return nil, err
 		}
-		return node.Right.Insert(seg)
+		newNode.Right = node.Tree.rebuildDegraded(newNode.Right, node.Level+1)
 	}
+	return &newNode, nil
+}
+
+func (node *TypedBinaryNode[T]) Remove(data T) TypedTreeNode[T] {
+	return node.removeChildren(func(child TypedTreeNode[T]) TypedTreeNode[T] {
+		return child.Remove(data)
+	})
 }
 
-func (node *BinaryNode) Dumps(prefix string) string {
+func (node *TypedBinaryNode[T]) Delete(id string) TypedTreeNode[T] {
+	return node.removeChildren(func(child TypedTreeNode[T]) TypedTreeNode[T] {
+		return child.Delete(id)
+	})
+}
+
+func (node *TypedBinaryNode[T]) removeChildren(
+	remove func(TypedTreeNode[T]) TypedTreeNode[T],
+) TypedTreeNode[T] {
+	if node == nil {
+		return nil
+	}
+
+	var left, right, pass TypedTreeNode[T]
+	if node.Left != nil {
+		left = remove(node.Left)
+	}
+	if node.Right != nil {
+		right = remove(node.Right)
+	}
+	if node.Pass != nil {
+		pass = remove(node.Pass)
+	}
+	if left == node.Left && right == node.Right && pass == node.Pass {
+		return node
+	}
+
+	// without sides there is nothing left to split on
+	if left == nil && right == nil {
+		return pass
+	}
+
+	newNode := *node
+	newNode.Left, newNode.Right, newNode.Pass = left, right, pass
+	return &newNode
+}
+
+func (node *TypedBinaryNode[T]) Dumps(prefix string) string {
 	if node == nil {
 		return ""
 	}
 
-	return fmt.Sprintf("%s -bnode{dim:%d, decreasePercent:%v, mid:%v}\n%v\n%v\n", prefix,
+	return fmt.Sprintf("%s -bnode{dim:%v, decreasePercent:%v, mid:%v}\n%v\n%v\n", prefix,
 		node.DimName, node.DecreasePercent, node.Mid,
 		node.Left.Dumps(prefix+"    "), node.Right.Dumps(prefix+"    "))
 }
 
-func NewBinaryNode(tree *Tree,
-	segments []*Segment,
+func NewBinaryNode[T comparable](tree *TypedTree[T],
+	segments []*TypedSegment[T],
 	dimName interface{},
 	decreasePercent float64,
 	level int,
-) (*BinaryNode, []*Segment, []*Segment, []*Segment) {
-	sort.Stable(&sortSegments{dimName: dimName, segments: segments})
+) (*TypedBinaryNode[T], []*TypedSegment[T], []*TypedSegment[T], []*TypedSegment[T]) {
+	sort.Stable(&sortSegments[T]{dimName: dimName, segments: segments})
 
 	_, midMeasure := getRealDimSegmentsDecrease(segments, dimName)
 	if midMeasure == nil {
 		return nil, nil, nil, nil
 	}
 
-	node := &BinaryNode{
+	return newBinaryNodeAt(tree, segments, dimName, decreasePercent, level, midMeasure)
+}
+
+// newBinaryNodeAt is NewBinaryNode splitting the dim at the given mid.
+func newBinaryNodeAt[T comparable](tree *TypedTree[T],
+	segments []*TypedSegment[T],
+	dimName interface{},
+	decreasePercent float64,
+	level int,
+	midMeasure Measure,
+) (*TypedBinaryNode[T], []*TypedSegment[T], []*TypedSegment[T], []*TypedSegment[T]) {
+	node := &TypedBinaryNode[T]{
 		Tree:            tree,
 		DimName:         dimName,
 		Level:           level,
 		DecreasePercent: decreasePercent,
+		dim:             tree.schema.dimIndexOrNone(dimName),
 		Mid:             midMeasure,
+		debt:            insertDebt{built: len(segments)},
 	}
 
-	var left []*Segment
-	var right []*Segment
-	var pass []*Segment
+	var left []*TypedSegment[T]
+	var right []*TypedSegment[T]
+	var pass []*TypedSegment[T]
 	for _, seg := range segments {
 		if seg.Rect[dimName] == nil {
 			pass = append(pass, seg)
 			continue
 		}
 
-		mRange := seg.Rect[dimName].(Interval)
-
-		if mRange[1].Smaller(midMeasure) {
+		switch binarySide(seg.Rect[dimName].(Interval), midMeasure) {
+		case -1:
 			left = append(left, seg)
-			continue
-		} else if mRange[0].Bigger(midMeasure) {
+		case 1:
 			right = append(right, seg)
-			continue
-		} else {
+		default:
 			pass = append(pass, seg)
 		}
 	}
 
 	return node, pass, left, right
 }
+
+// binarySide reports whether an interval lies entirely left of mid (-1),
+// entirely right of it (1), or spans it (0). Points smaller than mid are
+// searched on the left side and all others on the right side.
+func binarySide(interval Interval, mid Measure) int {
+	midBound := bound{m: mid}
+	if interval.upperBound().compare(midBound) < 0 {
+		return -1
+	}
+	if interval.lowerBound().compare(midBound) >= 0 {
+		return 1
+	}
+	return 0
+}
@@ -3,39 +3,162 @@ package go_kd_segment_tree
 import (
 	"errors"
 	"fmt"
-	mapset "github.com/deckarep/golang-set"
+	mapset "github.com/deckarep/golang-set/v2"
 	"sort"
 )
 
-type ConjunctionNode struct {
-	TreeNode
+// ConjunctionNode is the untyped conjunction node kept for compatibility with interface{} payloads.
+type ConjunctionNode = TypedConjunctionNode[interface{}]
 
-	Tree *Tree
+type TypedConjunctionNode[T comparable] struct {
+	TypedTreeNode[T]
+
+	Tree *TypedTree[T]
 
 	DimName         interface{}
 	Level           int
 	DecreasePercent float64
 
-	segments []*Segment
+	debt insertDebt
+
+	segments []*TypedSegment[T]
+
+	// unconstrained lists the segments without any dim, matching every point
+	unconstrained []int
 
 	dimNode map[interface{}]ConjunctionDimNode
+
+	// dims lists the dim nodes by schema index for searches
+	dims []conjunctionDim
 }
 
-func (node *ConjunctionNode) Search(p Point) []interface{} {
-	segCounter := make(map[int]int)
-	for dimName, d := range p {
-		if node.dimNode[dimName] == nil {
+type conjunctionDim struct {
+	dim  int
+	node ConjunctionDimNode
+}
+
+// indexDims lists the dim nodes holding segments by schema index.
+func (node *TypedConjunctionNode[T]) indexDims() {
+	node.dims = nil
+	for dimName, dimNode := range node.dimNode {
+		if isNilDimNode(dimNode) {
+			continue
+		}
+		node.dims = append(node.dims, conjunctionDim{
+			dim:  node.Tree.schema.dimIndexOrNone(dimName),
+			node: dimNode,
+		})
+	}
+	sort.Slice(node.dims, func(i, j int) bool { return node.dims[i].dim < node.dims[j].dim })
+}
+
+// isNilDimNode reports whether the dim node is missing, as it is for the dims
+// no segment constrains.
+func isNilDimNode(dimNode ConjunctionDimNode) bool {
+	switch n := dimNode.(type) {
+	case nil:
+		return true
+	case *ConjunctionDimRealNode:
+		return n == nil
+	case *ConjunctionDimDiscreteNode:
+		return n == nil
+	}
+	return false
+}
+
+// countPoint counts for every segment the dims of its rect matching the point.
+func (node *TypedConjunctionNode[T]) countPoint(p *EncodedPoint, c *conjunctionCounter) {
+	c.reset(len(node.segments))
+	for _, dim := range node.dims {
+		x := p.Value(dim.dim)
+		if x == nil {
 			continue
 		}
 
-		for _, segIndex := range node.dimNode[dimName].Search(d) {
-			segCounter[segIndex] += 1
+		c.nextDim()
+		for _, m := range pointValues(x) {
+			var matches []int
+			if discreteNode, ok := dim.node.(*ConjunctionDimDiscreteNode); ok {
+				c.matches = discreteNode.appendSearch(c.matches[:0], m)
+				matches = c.matches
+			} else {
+				matches = dim.node.Search(m)
+			}
+			for _, segIndex := range matches {
+				c.count(segIndex)
+			}
 		}
 	}
+}
 
-	var result = mapset.NewSet()
-	for segIndex, matchNum := range segCounter {
-		if len(node.segments[segIndex].Rect) == matchNum {
+// conjunctionCounter counts the dims matching a point of the segments of a
+// conjunction node, by position. A segment matching several values of a dim
+// still counts once for the dim. Counters are reset by epoch, so that one
+// counter serves many nodes and searches.
+type conjunctionCounter struct {
+	countEpoch  uint32
+	countStamps []uint32
+	counters    []int
+	dimEpoch    uint32
+	dimStamps   []uint32
+
+	// touched lists the positions counted since the reset
+	touched []int
+	matches []int
+}
+
+// reset clears the counters for a node with the number of segments.
+func (c *conjunctionCounter) reset(segments int) {
+	if segments > len(c.counters) {
+		c.counters = make([]int, segments)
+		c.countStamps = make([]uint32, segments)
+		c.dimStamps = make([]uint32, segments)
+	}
+	c.countEpoch = nextEpoch(c.countEpoch, c.countStamps)
+	c.touched = c.touched[:0]
+}
+
+// nextDim starts counting the matches of another dim.
+func (c *conjunctionCounter) nextDim() {
+	c.dimEpoch = nextEpoch(c.dimEpoch, c.dimStamps)
+}
+
+// count counts the current dim for the segment at the position.
+func (c *conjunctionCounter) count(pos int) {
+	if c.dimStamps[pos] == c.dimEpoch {
+		return
+	}
+	c.dimStamps[pos] = c.dimEpoch
+
+	if c.countStamps[pos] != c.countEpoch {
+		c.countStamps[pos] = c.countEpoch
+		c.counters[pos] = 0
+		c.touched = append(c.touched, pos)
+	}
+	c.counters[pos]++
+}
+
+func (node *TypedConjunctionNode[T]) Search(p Point) []T {
+	if node == nil {
+		return nil
+	}
+	return node.SearchEncoded(node.Tree.schema.Encode(p))
+}
+
+func (node *TypedConjunctionNode[T]) SearchEncoded(p *EncodedPoint) []T {
+	if node == nil {
+		return nil
+	}
+
+	var c conjunctionCounter
+	node.countPoint(p, &c)
+
+	var result = mapset.NewSet[T]()
+	for _, segIndex := range node.unconstrained {
+		result = result.Union(node.segments[segIndex].Data)
+	}
+	for _, segIndex := range c.touched {
+		if len(node.segments[segIndex].Rect) == c.counters[segIndex] {
 			result = result.Union(node.segments[segIndex].Data)
 		}
 	}
@@ -43,7 +166,7 @@ func (node *ConjunctionNode) Search(p Point) []interface{} {
 	return result.ToSlice()
 }
 
-func (node *ConjunctionNode) SearchRect(r Rect) []interface{} {
+func (node *TypedConjunctionNode[T]) SearchRect(r Rect) []T {
 	segCounter := make(map[int]int)
 	for dimName, d := range r {
 		if node.dimNode[dimName] == nil {
@@ -55,7 +178,10 @@ func (node *ConjunctionNode) SearchRect(r Rect) []interface{} {
 		}
 	}
 
-	var result = mapset.NewSet()
+	var result = mapset.NewSet[T]()
+	for _, segIndex := range node.unconstrained {
+		result = result.Union(node.segments[segIndex].Data)
+	}
 	for segIndex, matchNum := range segCounter {
 		if len(node.segments[segIndex].Rect) == matchNum {
 			result = result.Union(node.segments[segIndex].Data)
@@ -65,23 +191,137 @@ func (node *ConjunctionNode) SearchRect(r Rect) []interface{} {
 	return result.ToSlice()
 }
 
-func (node *ConjunctionNode) Insert(seg *Segment) error {
-	return errors.New("conjunction node not support insert yet")
+func (node *TypedConjunctionNode[T]) Insert(seg *TypedSegment[T]) (TypedTreeNode[T], error) {
+	if node == nil || seg == nil {
+		return nil, errors.New("conjunction node is None")
+	}
+
+	// the new segment takes the next position, the lists it joins are copied
+	// so that searches on older snapshots keep theirs
+	segIndex := len(node.segments)
+	newNode := *node
+	newNode.debt.inserted++
+	newNode.segments = append(node.segments[:segIndex:segIndex], seg)
+	if len(seg.Rect) == 0 {
+		newNode.unconstrained = append(node.unconstrained[:len(node.unconstrained):len(node.unconstrained)], segIndex)
+	}
+
+	newNode.dimNode = make(map[interface{}]ConjunctionDimNode, len(node.dimNode))
+	for dimName, dimNode := range node.dimNode {
+		newNode.dimNode[dimName] = dimNode
+	}
+	for dimName, d := range seg.Rect {
+		if _, ok := node.Tree.dimTypes[dimName]; ok == false {
+			return nil, errors.New(fmt.Sprintf("wrong conjunction dim: %v", dimName))
+		}
+		dimNode := node.dimNode[dimName]
+
+		switch d := d.(type) {
+		case Interval:
+			realNode, _ := dimNode.(*ConjunctionDimRealNode)
+			newNode.dimNode[dimName] = realNode.insert(dimName, segIndex, d)
+		case Measures, ExcludedMeasures:
+			discreteNode, _ := dimNode.(*ConjunctionDimDiscreteNode)
+			newNode.dimNode[dimName] = discreteNode.insert(dimName, segIndex, d)
+		default:
+			return nil, errors.New(fmt.Sprintf("wrong conjunction scatters: %v", dimName))
+		}
+	}
+	newNode.indexDims()
+	return &newNode, nil
+}
+
+func (node *TypedConjunctionNode[T]) Remove(data T) TypedTreeNode[T] {
+	return node.removeSegments(func(segments []*TypedSegment[T]) ([]*TypedSegment[T], bool) {
+		return removeSegmentsData(segments, data)
+	})
+}
+
+func (node *TypedConjunctionNode[T]) Delete(id string) TypedTreeNode[T] {
+	return node.removeSegments(func(segments []*TypedSegment[T]) ([]*TypedSegment[T], bool) {
+		return deleteSegments(segments, id)
+	})
 }
 
-func NewConjunctionNode(tree *Tree,
-	segments []*Segment,
+func (node *TypedConjunctionNode[T]) removeSegments(
+	remove func([]*TypedSegment[T]) ([]*TypedSegment[T], bool),
+) TypedTreeNode[T] {
+	if node == nil {
+		return nil
+	}
+
+	// positions maps the position of each segment to its new one, -1 for a
+	// segment removed
+	var segments []*TypedSegment[T]
+	var positions = make([]int, len(node.segments))
+	var changed, moved = false, false
+	for i := range node.segments {
+		kept, segChanged := remove(node.segments[i : i+1])
+		changed = changed || segChanged
+		if len(kept) == 0 {
+			positions[i] = -1
+			moved = true
+			continue
+		}
+		positions[i] = len(segments)
+		segments = append(segments, kept[0])
+	}
+	if changed == false {
+		return node
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+
+	newNode := *node
+	newNode.segments = segments
+	if moved == false {
+		return &newNode
+	}
+
+	// inverted lists are indexed by segment position, renumber them
+	newNode.unconstrained = remapPositions(node.unconstrained, positions)
+	newNode.dimNode = make(map[interface{}]ConjunctionDimNode, len(node.dimNode))
+	for dimName, dimNode := range node.dimNode {
+		switch dimNode := dimNode.(type) {
+		case *ConjunctionDimRealNode:
+			newNode.dimNode[dimName] = dimNode.remap(positions)
+		case *ConjunctionDimDiscreteNode:
+			newNode.dimNode[dimName] = dimNode.remap(positions)
+		default:
+			newNode.dimNode[dimName] = dimNode
+		}
+	}
+	newNode.indexDims()
+	return &newNode
+}
+
+// remapPositions returns the list of segment positions renumbered by
+// positions, without the removed ones.
+func remapPositions(list []int, positions []int) []int {
+	var newList []int
+	for _, pos := range list {
+		if positions[pos] >= 0 {
+			newList = append(newList, positions[pos])
+		}
+	}
+	return newList
+}
+
+func NewConjunctionNode[T comparable](tree *TypedTree[T],
+	segments []*TypedSegment[T],
 	dimName interface{},
 	decreasePercent float64,
 	level int,
-) *ConjunctionNode {
-	var node = &ConjunctionNode{
+) *TypedConjunctionNode[T] {
+	var node = &TypedConjunctionNode[T]{
 		Tree:            tree,
 		DimName:         dimName,
 		Level:           level,
 		segments:        segments,
 		DecreasePercent: decreasePercent,
 		dimNode:         make(map[interface{}]ConjunctionDimNode),
+		debt:            insertDebt{built: len(segments)},
 	}
 
 	for dimName, dimType := range tree.dimTypes {
@@ -93,10 +333,17 @@ func NewConjunctionNode(tree *Tree,
 		}
 	}
 
+	for segIndex, seg := range segments {
+		if len(seg.Rect) == 0 {
+			node.unconstrained = append(node.unconstrained, segIndex)
+		}
+	}
+	node.indexDims()
+
 	return node
 }
 
-func (node *ConjunctionNode) MaxInvertNodeNum() int {
+func (node *TypedConjunctionNode[T]) MaxInvertNodeNum() int {
 	totalInvertNode := 0
 	for _, dimNode := range node.dimNode {
 		if dimNode == nil {
@@ -108,7 +355,7 @@ func (node *ConjunctionNode) MaxInvertNodeNum() int {
 	return totalInvertNode
 }
 
-func (node *ConjunctionNode) Dumps(prefix string) string {
+func (node *TypedConjunctionNode[T]) Dumps(prefix string) string {
 	return fmt.Sprintf("%v   conjunction_node{max_invert_node=%v}\n", prefix, node.MaxInvertNodeNum())
 }
 
@@ -122,47 +369,57 @@ type ConjunctionDimRealNode struct {
 	ConjunctionDimNode
 	dimName interface{}
 
+	// splitPoints are the distinct finite interval endpoints in ascending order.
+	// They cut the axis into 2*len(splitPoints)+1 atoms: atom 2k is the open gap
+	// below splitPoints[k] and atom 2k+1 is splitPoints[k] itself.
 	splitPoints []Measure
 
-	segments map[string][]int
+	segments [][]int
 }
 
 func (dimNode *ConjunctionDimRealNode) Search(measure Measure) []int {
-	if dimNode == nil || len(dimNode.splitPoints) == 0 {
+	if dimNode == nil || len(dimNode.segments) == 0 {
 		return nil
 	}
 
-	pos := dimNode.searchPos(measure)
-	if pos < 0 || pos >= len(dimNode.splitPoints) {
-		return nil
-	}
+	return dimNode.segments[dimNode.atomPos(measure)]
+}
 
-	return dimNode.segments[fmt.Sprintf("%v_%v",
-		dimNode.splitPoints[pos], dimNode.splitPoints[pos+1])]
+// atomPos returns the atom holding the measure.
+func (dimNode *ConjunctionDimRealNode) atomPos(measure Measure) int {
+	return splitAtomPos(dimNode.splitPoints, measure)
 }
 
-func (dimNode *ConjunctionDimRealNode) searchPos(measure Measure) int {
-	if dimNode == nil || len(dimNode.splitPoints) == 0 {
-		return -1
+// splitAtomPos returns the atom of the ascending split points holding the
+// measure.
+func splitAtomPos(splitPoints []Measure, measure Measure) int {
+	pos := sort.Search(len(splitPoints), func(i int) bool {
+		return splitPoints[i].BiggerOrEqual(measure)
+	})
+	if pos < len(splitPoints) && splitPoints[pos].Equal(measure) {
+		return 2*pos + 1
 	}
+	return 2 * pos
+}
+
+// atomRange returns the first and last atom intersecting the interval.
+func (dimNode *ConjunctionDimRealNode) atomRange(interval Interval) (int, int) {
+	first, last := 0, 2*len(dimNode.splitPoints)
 
-	start := 0
-	end := len(dimNode.splitPoints) - 1
-	for start < end {
-		mid := (start + end) / 2
-		if dimNode.splitPoints[mid].SmallerOrEqual(measure) &&
-			dimNode.splitPoints[mid+1].Bigger(measure) {
-			return mid
-		} else if dimNode.splitPoints[mid+1].SmallerOrEqual(measure) {
-			start = mid + 1
-		} else if dimNode.splitPoints[mid].Bigger(measure) {
-			end = mid
-		} else {
-			break
+	if lower := interval.lowerBound(); lower.m != nil {
+		first = dimNode.atomPos(lower.m)
+		if first%2 == 1 && lower.side > 0 {
+			first += 1
 		}
 	}
 
-	return -1
+	if upper := interval.upperBound(); upper.m != nil {
+		last = dimNode.atomPos(upper.m)
+		if last%2 == 1 && upper.side < 0 {
+			last -= 1
+		}
+	}
+	return first, last
 }
 
 func (dimNode *ConjunctionDimRealNode) MaxInvertNode() int {
@@ -180,7 +437,7 @@ func (dimNode *ConjunctionDimRealNode) MaxInvertNode() int {
 }
 
 func (dimNode *ConjunctionDimRealNode) SearchRect(measure interface{}) []int {
-	if dimNode == nil || len(dimNode.splitPoints) == 0 {
+	if dimNode == nil || len(dimNode.segments) == 0 {
 		return nil
 	}
 
@@ -188,96 +445,157 @@ func (dimNode *ConjunctionDimRealNode) SearchRect(measure interface{}) []int {
 		return nil
 	}
 
-	interval := measure.(Interval)
+	first, last := dimNode.atomRange(measure.(Interval))
 
-	matchSegments := mapset.NewSet()
-	for i, _ := range dimNode.splitPoints[:len(dimNode.splitPoints)-1] {
-		if interval.Contains(dimNode.splitPoints[i]) &&
-			interval.Contains(dimNode.splitPoints[i+1]) {
-			for _, seg := range dimNode.segments[fmt.Sprintf("%v_%v",
-				dimNode.splitPoints[i], dimNode.splitPoints[i+1])] {
-				matchSegments.Add(seg)
-			}
+	matchSegments := mapset.NewSet[int]()
+	for i := first; i <= last; i++ {
+		for _, seg := range dimNode.segments[i] {
+			matchSegments.Add(seg)
 		}
 	}
 
-	var result []int
-	for _, seg := range matchSegments.ToSlice() {
-		result = append(result, seg.(int))
-	}
-	return result
+	return matchSegments.ToSlice()
 }
 
-func NewConjunctionRealNode(segments []*Segment, dimName interface{}) *ConjunctionDimRealNode {
+func NewConjunctionRealNode[T comparable](segments []*TypedSegment[T], dimName interface{}) *ConjunctionDimRealNode {
 	var allSplit = []Measure{}
+	var constrained = false
 	for _, seg := range segments {
 		if seg.Rect[dimName] == nil {
 			continue
 		}
+		constrained = true
 
-		allSplit = append(allSplit, seg.Rect[dimName].(Interval)[0])
-		allSplit = append(allSplit, seg.Rect[dimName].(Interval)[1])
+		if lower := seg.Rect[dimName].(Interval).lowerBound(); lower.m != nil {
+			allSplit = append(allSplit, lower.m)
+		}
+		if upper := seg.Rect[dimName].(Interval).upperBound(); upper.m != nil {
+			allSplit = append(allSplit, upper.m)
+		}
 	}
 
 	var dimNode = &ConjunctionDimRealNode{
 		dimName:     dimName,
 		splitPoints: allSplit,
-		segments:    make(map[string][]int),
 	}
 
-	if len(dimNode.splitPoints) == 0 {
+	// unbounded intervals without any split point share a single atom
+	if constrained == false {
 		return nil
 	}
 
-	sort.Sort(&sortMeasures{measures: dimNode.splitPoints})
-	toIndex := 0
-	for _, m := range dimNode.splitPoints {
-		if dimNode.splitPoints[toIndex].Equal(m) {
-			continue
-		} else {
-			dimNode.splitPoints[toIndex+1] = m
-			toIndex += 1
+	if len(dimNode.splitPoints) > 0 {
+		sort.Stable(&sortMeasures{measures: dimNode.splitPoints})
+		toIndex := 0
+		for _, m := range dimNode.splitPoints {
+			if dimNode.splitPoints[toIndex].Equal(m) {
+				continue
+			} else {
+				dimNode.splitPoints[toIndex+1] = m
+				toIndex += 1
+			}
 		}
+		dimNode.splitPoints = dimNode.splitPoints[:toIndex+1]
 	}
-	dimNode.splitPoints = dimNode.splitPoints[:toIndex+1]
+	dimNode.segments = make([][]int, 2*len(dimNode.splitPoints)+1)
 
 	for index, seg := range segments {
 		if seg.Rect[dimName] == nil {
 			continue
 		}
 
-		pos := dimNode.searchPos(seg.Rect[dimName].(Interval)[0])
-		if pos < 0 || pos >= len(dimNode.splitPoints) {
-			continue
+		first, last := dimNode.atomRange(seg.Rect[dimName].(Interval))
+		for i := first; i <= last; i++ {
+			dimNode.segments[i] = append(dimNode.segments[i], index)
 		}
+	}
 
-		for i, m := range dimNode.splitPoints[pos : len(dimNode.splitPoints)-1] {
-			nextM := dimNode.splitPoints[i+pos+1]
-			if seg.Rect[dimName] == nil {
-				continue
-			}
+	return dimNode
+}
 
-			if seg.Rect[dimName].(Interval)[1].Smaller(m) {
-				break
-			}
+// insert returns a copy of the dim node, nil for none, also listing the
+// segment at the position with the interval. Its endpoints missing from the
+// split points split the gaps holding them: the gap below, the point and the
+// gap above all list the segments of the gap.
+func (dimNode *ConjunctionDimRealNode) insert(dimName interface{}, segIndex int, interval Interval) *ConjunctionDimRealNode {
+	newDimNode := &ConjunctionDimRealNode{
+		dimName:  dimName,
+		segments: [][]int{nil},
+	}
+	if dimNode != nil && len(dimNode.segments) > 0 {
+		newDimNode.splitPoints = dimNode.splitPoints
+		newDimNode.segments = append([][]int{}, dimNode.segments...)
+	}
 
-			if seg.Rect[dimName].(Interval)[0].SmallerOrEqual(m) &&
-				seg.Rect[dimName].(Interval)[1].BiggerOrEqual(nextM) {
-				key := fmt.Sprintf("%v_%v", m, nextM)
-				dimNode.segments[key] = append(dimNode.segments[key], index)
-			}
+	for _, b := range []bound{interval.lowerBound(), interval.upperBound()} {
+		if b.m == nil {
+			continue
 		}
+
+		splitPoints := newDimNode.splitPoints
+		pos := sort.Search(len(splitPoints), func(i int) bool {
+			return splitPoints[i].BiggerOrEqual(b.m)
+		})
+		if pos < len(splitPoints) && splitPoints[pos].Equal(b.m) {
+			continue
+		}
+
+		newDimNode.splitPoints = make([]Measure, 0, len(splitPoints)+1)
+		newDimNode.splitPoints = append(newDimNode.splitPoints, splitPoints[:pos]...)
+		newDimNode.splitPoints = append(newDimNode.splitPoints, b.m)
+		newDimNode.splitPoints = append(newDimNode.splitPoints, splitPoints[pos:]...)
+
+		gap := newDimNode.segments[2*pos]
+		segments := make([][]int, 0, len(newDimNode.segments)+2)
+		segments = append(segments, newDimNode.segments[:2*pos+1]...)
+		segments = append(segments, gap, gap)
+		segments = append(segments, newDimNode.segments[2*pos+1:]...)
+		newDimNode.segments = segments
+	}
+	// lists may be shared with older versions or between atoms, copy them
+	first, last := newDimNode.atomRange(interval)
+	for i := first; i <= last; i++ {
+		list := newDimNode.segments[i]
+		newDimNode.segments[i] = append(list[:len(list):len(list)], segIndex)
+	}
+	return newDimNode
+}
+
+// remap returns a copy of the dim node with the segment positions renumbered,
+// nil when no segment is left.
+func (dimNode *ConjunctionDimRealNode) remap(positions []int) *ConjunctionDimRealNode {
+	if dimNode == nil {
+		return nil
 	}
 
-	return dimNode
+	newDimNode := &ConjunctionDimRealNode{
+		dimName:     dimNode.dimName,
+		splitPoints: dimNode.splitPoints,
+		segments:    make([][]int, len(dimNode.segments)),
+	}
+	empty := true
+	for i, list := range dimNode.segments {
+		newDimNode.segments[i] = remapPositions(list, positions)
+		empty = empty && len(newDimNode.segments[i]) == 0
+	}
+	if empty {
+		return nil
+	}
+	return newDimNode
 }
 
 type ConjunctionDimDiscreteNode struct {
-	ConjunctionNode
+	ConjunctionDimNode
 
 	dimName interface{}
 
 	segments map[Measure][]int
+
+	// excluded lists the segments with an ExcludedMeasures constraint on the
+	// dim and excludedBy the ones among them excluding each value, both in
+	// ascending order.
+	excluded   []int
+	excludedBy map[Measure][]int
 }
 
 func (node *ConjunctionDimDiscreteNode) Search(measure Measure) []int {
@@ -285,7 +603,31 @@ func (node *ConjunctionDimDiscreteNode) Search(measure Measure) []int {
 		return nil
 	}
 
-	return node.segments[measure]
+	if len(node.excluded) == 0 {
+		return node.segments[discreteKey(measure)]
+	}
+	return node.appendSearch(nil, measure)
+}
+
+// appendSearch appends the segments matching the measure to dst.
+func (node *ConjunctionDimDiscreteNode) appendSearch(dst []int, measure Measure) []int {
+	if node == nil || node.segments == nil {
+		return dst
+	}
+
+	key := discreteKey(measure)
+	dst = append(dst, node.segments[key]...)
+	excludedBy := node.excludedBy[key]
+	for _, seg := range node.excluded {
+		for len(excludedBy) > 0 && excludedBy[0] < seg {
+			excludedBy = excludedBy[1:]
+		}
+		if len(excludedBy) > 0 && excludedBy[0] == seg {
+			continue
+		}
+		dst = append(dst, seg)
+	}
+	return dst
 }
 
 func (node *ConjunctionDimDiscreteNode) MaxInvertNode() int {
@@ -293,10 +635,10 @@ func (node *ConjunctionDimDiscreteNode) MaxInvertNode() int {
 		return 0
 	}
 
-	maxNodeNum := 0
-	for _, nodes := range node.segments {
-		if len(nodes) > maxNodeNum {
-			maxNodeNum = len(nodes)
+	maxNodeNum := len(node.excluded)
+	for key, nodes := range node.segments {
+		if len(nodes)+len(node.excluded)-len(node.excludedBy[key]) > maxNodeNum {
+			maxNodeNum = len(nodes) + len(node.excluded) - len(node.excludedBy[key])
 		}
 	}
 	return maxNodeNum
@@ -306,42 +648,127 @@ func (node *ConjunctionDimDiscreteNode) SearchRect(scatters interface{}) []int {
 	if node == nil || node.segments == nil {
 		return nil
 	}
-	if _, ok := scatters.(Measures); ok == false {
-		return nil
-	}
 
-	matchSegments := mapset.NewSet()
-	for _, d := range scatters.(Measures) {
-		for _, seg := range node.segments[d] {
+	matchSegments := mapset.NewSet[int]()
+	switch scatters.(type) {
+	case Measures:
+		for _, d := range scatters.(Measures) {
+			for _, seg := range node.Search(d) {
+				matchSegments.Add(seg)
+			}
+		}
+	case ExcludedMeasures:
+		for key, segments := range node.segments {
+			if scatters.(ExcludedMeasures).Contains(key) {
+				for _, seg := range segments {
+					matchSegments.Add(seg)
+				}
+			}
+		}
+		for _, seg := range node.excluded {
 			matchSegments.Add(seg)
 		}
+	default:
+		return nil
 	}
 
-	var result []int
-	for _, seg := range matchSegments.ToSlice() {
-		result = append(result, seg.(int))
-	}
-	return result
+	return matchSegments.ToSlice()
 }
 
-func NewDiscreteConjunctionNode(segments []*Segment, dimName interface{}) *ConjunctionDimDiscreteNode {
+func NewDiscreteConjunctionNode[T comparable](segments []*TypedSegment[T], dimName interface{}) *ConjunctionDimDiscreteNode {
 	node := &ConjunctionDimDiscreteNode{
-		dimName:  dimName,
-		segments: make(map[Measure][]int),
+		dimName:    dimName,
+		segments:   make(map[Measure][]int),
+		excludedBy: make(map[Measure][]int),
 	}
 	for segIndex, seg := range segments {
-		if seg.Rect[dimName] == nil {
-			continue
+		switch seg.Rect[dimName].(type) {
+		case Measures:
+			for _, m := range uniqueDiscreteKeys(seg.Rect[dimName].(Measures)) {
+				node.segments[m] = append(node.segments[m], segIndex)
+			}
+		case ExcludedMeasures:
+			node.excluded = append(node.excluded, segIndex)
+			for _, m := range uniqueDiscreteKeys(seg.Rect[dimName].(ExcludedMeasures)) {
+				node.excludedBy[m] = append(node.excludedBy[m], segIndex)
+				if _, ok := node.segments[m]; ok == false {
+					node.segments[m] = nil
+				}
+			}
+		}
+	}
+
+	if len(node.segments) == 0 && len(node.excluded) == 0 {
+		return nil
+	}
+
+	return node
+}
+
+// insert returns a copy of the dim node, nil for none, also listing the
+// segment at the position with the measures.
+func (dimNode *ConjunctionDimDiscreteNode) insert(dimName interface{}, segIndex int, scatters interface{}) *ConjunctionDimDiscreteNode {
+	newDimNode := &ConjunctionDimDiscreteNode{
+		dimName:    dimName,
+		segments:   make(map[Measure][]int),
+		excludedBy: make(map[Measure][]int),
+	}
+	if dimNode != nil {
+		for key, list := range dimNode.segments {
+			newDimNode.segments[key] = list
+		}
+		for key, list := range dimNode.excludedBy {
+			newDimNode.excludedBy[key] = list
 		}
+		newDimNode.excluded = dimNode.excluded
+	}
 
-		for _, m := range seg.Rect[dimName].(Measures) {
-			node.segments[m] = append(node.segments[m], segIndex)
+	// lists may be shared with older versions, copy them
+	switch scatters := scatters.(type) {
+	case Measures:
+		for _, m := range uniqueDiscreteKeys(scatters) {
+			list := newDimNode.segments[m]
+			newDimNode.segments[m] = append(list[:len(list):len(list)], segIndex)
+		}
+	case ExcludedMeasures:
+		newDimNode.excluded = append(newDimNode.excluded[:len(newDimNode.excluded):len(newDimNode.excluded)], segIndex)
+		for _, m := range uniqueDiscreteKeys(scatters) {
+			list := newDimNode.excludedBy[m]
+			newDimNode.excludedBy[m] = append(list[:len(list):len(list)], segIndex)
+			if _, ok := newDimNode.segments[m]; ok == false {
+				newDimNode.segments[m] = nil
+			}
 		}
 	}
+	return newDimNode
+}
 
-	if len(node.segments) == 0 {
+// remap returns a copy of the dim node with the segment positions renumbered,
+// without the keys no segment lists or excludes, nil when no segment is left.
+func (dimNode *ConjunctionDimDiscreteNode) remap(positions []int) *ConjunctionDimDiscreteNode {
+	if dimNode == nil {
 		return nil
 	}
 
-	return node
+	newDimNode := &ConjunctionDimDiscreteNode{
+		dimName:    dimNode.dimName,
+		segments:   make(map[Measure][]int),
+		excludedBy: make(map[Measure][]int),
+		excluded:   remapPositions(dimNode.excluded, positions),
+	}
+	for key, list := range dimNode.excludedBy {
+		if newList := remapPositions(list, positions); len(newList) > 0 {
+			newDimNode.excludedBy[key] = newList
+		}
+	}
+	for key, list := range dimNode.segments {
+		newList := remapPositions(list, positions)
+		if _, ok := newDimNode.excludedBy[key]; ok || len(newList) > 0 {
+			newDimNode.segments[key] = newList
+		}
+	}
+	if len(newDimNode.segments) == 0 && len(newDimNode.excluded) == 0 {
+		return nil
+	}
+	return newDimNode
 }
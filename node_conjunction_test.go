@@ -0,0 +1,120 @@
+package go_kd_segment_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestConjunctionNode_Insert(t *testing.T) {
+	rnd := rand.New(rand.NewSource(24))
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "age": DimTypeReal, "score": DimTypeReal}
+
+	randRect := func() Rect {
+		rect := Rect{}
+		switch rnd.Intn(4) {
+		case 0:
+			rect["country"] = Measures{MeasureString(fmt.Sprint("c", rnd.Intn(8))), MeasureString(fmt.Sprint("c", rnd.Intn(8)))}
+		case 1:
+			rect["country"] = ExcludedMeasures{MeasureString(fmt.Sprint("c", rnd.Intn(8)))}
+		}
+		if rnd.Intn(3) > 0 {
+			// wide overlapping intervals, so that no split pays off
+			from := rnd.Intn(40)
+			rect["age"] = Interval{MeasureInt(from), Exclusive{MeasureInt(from + 40 + rnd.Intn(40))}}
+		}
+		if rnd.Intn(3) == 0 {
+			rect["score"] = Interval{nil, MeasureInt(rnd.Intn(10))}
+		}
+		return rect
+	}
+	randPoint := func() Point {
+		p := Point{}
+		if rnd.Intn(5) > 0 {
+			p["country"] = MeasureString(fmt.Sprint("c", rnd.Intn(10)))
+		}
+		if rnd.Intn(5) > 0 {
+			p["age"] = MeasureInt(rnd.Intn(130))
+		}
+		if rnd.Intn(2) == 0 {
+			p["score"] = MeasureInt(rnd.Intn(12))
+		}
+		return p
+	}
+
+	tree := NewTypedTree[int](dimTypes, &TreeOptions{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0})
+	rects := make(map[int]Rect)
+	for i := 0; i < 200; i++ {
+		rects[i] = randRect()
+		_ = tree.Add(rects[i], i)
+	}
+	tree.Build()
+	if tree.Stats().ConjunctionNodes == 0 {
+		t.Fatal("no conjunction node built")
+	}
+
+	checkSearch := func() {
+		for i := 0; i < 300; i++ {
+			p := randPoint()
+			var expected []int
+			for data, rect := range rects {
+				if rect.Contains(p) {
+					expected = append(expected, data)
+				}
+			}
+			result := tree.Search(p)
+			sort.Ints(result)
+			sort.Ints(expected)
+			if fmt.Sprint(result) != fmt.Sprint(expected) {
+				t.Fatal("conjunction search error:", p, result, expected)
+			}
+		}
+	}
+
+	// an older snapshot keeps its results while segments are inserted
+	var points []Point
+	var before []string
+	old := tree.snapshot()
+	for i := 0; i < 100; i++ {
+		p := randPoint()
+		result := old.Search(p)
+		sort.Ints(result)
+		points = append(points, p)
+		before = append(before, fmt.Sprint(result))
+	}
+
+	for i := 200; i < 400; i++ {
+		rects[i] = randRect()
+		if i%50 == 0 {
+			rects[i] = Rect{}
+		}
+		if err := tree.Insert(rects[i], i); err != nil {
+			t.Fatal("insert error:", err)
+		}
+	}
+	checkSearch()
+
+	for i, p := range points {
+		result := old.Search(p)
+		sort.Ints(result)
+		if fmt.Sprint(result) != before[i] {
+			t.Fatal("insert changed an older snapshot:", p, result, before[i])
+		}
+	}
+
+	for i := 0; i < 400; i += 3 {
+		tree.Remove(i)
+		delete(rects, i)
+	}
+	checkSearch()
+
+	_ = tree.Upsert("rule", Rect{"age": Interval{MeasureInt(200), nil}}, 1000)
+	rects[1000] = Rect{"age": Interval{MeasureInt(200), nil}}
+	checkSearch()
+	if tree.Delete("rule") == false {
+		t.Fatal("delete error")
+	}
+	delete(rects, 1000)
+	checkSearch()
+}
@@ -3,77 +3,148 @@ package go_kd_segment_tree
 import (
 	"errors"
 	"fmt"
-	mapset "github.com/deckarep/golang-set"
+	mapset "github.com/deckarep/golang-set/v2"
+	"sort"
 	"strings"
 )
 
-type HashNode struct {
-	TreeNode
+// HashNode is the untyped hash node kept for compatibility with interface{} payloads.
+type HashNode = TypedHashNode[interface{}]
 
-	Tree            *Tree
+type TypedHashNode[T comparable] struct {
+	TypedTreeNode[T]
+
+	Tree            *TypedTree[T]
 	DimName         interface{}
 	Level           int
 	DecreasePercent float64
 
-	child map[Measure]TreeNode
-	pass  TreeNode
+	debt insertDebt
+
+	// dim is the index of DimName in the schema of the tree
+	dim int
+
+	// child is keyed by the schema id of the values
+	child map[int32]TypedTreeNode[T]
+	pass  TypedTreeNode[T]
+
+	// other holds the excluding segments, searched for values without a child
+	other TypedTreeNode[T]
 }
 
-func (node *HashNode) Search(p Point) []interface{} {
+func (node *TypedHashNode[T]) Search(p Point) []T {
 	if node == nil {
 		return nil
 	}
+	return node.SearchEncoded(node.Tree.schema.Encode(p))
+}
 
-	if _, ok := p[node.DimName]; ok == false {
+func (node *TypedHashNode[T]) SearchEncoded(p *EncodedPoint) []T {
+	if node == nil {
 		return nil
 	}
 
-	x := p[node.DimName]
+	// only the segments not constrained on the dim match a point lacking it
+	if p.Value(node.dim) == nil {
+		if node.pass != nil {
+			return node.pass.SearchEncoded(p)
+		}
+		return nil
+	}
 
-	var defaultResult []interface{}
+	var defaultResult []T
 	if node.pass != nil {
-		defaultResult = node.pass.Search(p)
+		defaultResult = node.pass.SearchEncoded(p)
 	}
 
-	var childResult []interface{}
-	if child, ok := node.child[x]; ok {
-		childResult = child.Search(p)
+	var results = [][]T{defaultResult}
+	node.eachChild(p, func(child TypedTreeNode[T]) {
+		results = append(results, child.SearchEncoded(p))
+	})
+	return unionResults(results...)
+}
+
+// eachChild calls visit with the children matching the values of the point on
+// the dim, other included. The pass child is left to the caller.
+func (node *TypedHashNode[T]) eachChild(p *EncodedPoint, visit func(child TypedTreeNode[T])) {
+	if p.Value(node.dim) == nil {
+		return
 	}
 
-	if len(defaultResult) == 0 {
-		return childResult
-	} else if len(childResult) == 0 {
-		return defaultResult
-	} else {
-		return mapset.NewSet(defaultResult...).Union(mapset.NewSet(childResult...)).ToSlice()
+	searchOther := matchHashValues(p.ValueIDs(node.dim), func(id int32) bool {
+		child, ok := node.child[id]
+		if ok {
+			visit(child)
+		}
+		return ok
+	})
+	if searchOther && node.other != nil {
+		visit(node.other)
 	}
 }
 
-func (node *HashNode) SearchRect(r Rect) []interface{} {
-	if node == nil {
-		return nil
+// matchHashValues calls child with the id of every distinct value of a point,
+// so that a multi-valued point visits each matching child once. child reports
+// whether there is a child for the id; matchHashValues reports whether a value
+// has none, in which case the other child matches.
+func matchHashValues(ids []int32, child func(id int32) bool) bool {
+	searchOther := false
+values:
+	for i, id := range ids {
+		for _, visited := range ids[:i] {
+			if visited == id {
+				continue values
+			}
+		}
+
+		if child(id) == false {
+			searchOther = true
+		}
 	}
+	return searchOther
+}
 
-	if _, ok := r[node.DimName]; ok == false {
+func (node *TypedHashNode[T]) SearchRect(r Rect) []T {
+	if node == nil {
 		return nil
 	}
 
-	if _, ok := r[node.DimName].(Measures); ok == false {
+	if _, ok := r[node.DimName]; ok == false {
 		return nil
 	}
 
-	scatters := r[node.DimName].(Measures)
-
-	var defaultResult []interface{}
+	var defaultResult []T
 	if node.pass != nil {
 		defaultResult = node.pass.SearchRect(r)
 	}
 
-	var childResult []interface{}
-	for _, x := range scatters {
-		if child, ok := node.child[x]; ok {
-			childResult = append(childResult, child.SearchRect(r))
+	var childResult []T
+	switch r[node.DimName].(type) {
+	case Measures:
+		searchOther := false
+		for _, x := range r[node.DimName].(Measures) {
+			id, _ := node.Tree.schema.ValueID(x)
+			if child, ok := node.child[id]; ok {
+				childResult = append(childResult, child.SearchRect(r)...)
+			} else {
+				searchOther = true
+			}
+		}
+		if searchOther && node.other != nil {
+			childResult = append(childResult, node.other.SearchRect(r)...)
+		}
+	case ExcludedMeasures:
+		excluded := r[node.DimName].(ExcludedMeasures)
+		for key, child := range node.child {
+			if excluded.Contains(node.Tree.schema.Value(key)) {
+				childResult = append(childResult, child.SearchRect(r)...)
+			}
 		}
+		if node.other != nil {
+			childResult = append(childResult, node.other.SearchRect(r)...)
+		}
+	default:
+		return nil
 	}
 
 	if len(defaultResult) == 0 {
@@ -81,86 +152,219 @@ func (node *HashNode) SearchRect(r Rect) []interface{} {
 	} else if len(childResult) == 0 {
 		return defaultResult
 	} else {
-		return mapset.NewSet(defaultResult...).Union(mapset.NewSet(childResult...)).ToSlice()
+		return mapset.NewSet[T](defaultResult...).Union(mapset.NewSet[T](childResult...)).ToSlice()
 	}
 }
 
-func (node *HashNode) Insert(seg *Segment) error {
+func (node *TypedHashNode[T]) Insert(seg *TypedSegment[T]) (TypedTreeNode[T], error) {
 	if seg == nil || node == nil {
-		return errors.New("hash node is None")
+		return nil, errors.New("hash node is None")
 	}
 
+	newNode := *node
+	newNode.debt.inserted++
+	var err error
+
 	if _, ok := seg.Rect[node.DimName]; ok == false {
-		if node.pass != nil {
-			return node.pass.Insert(seg)
-		} else {
-			node.pass = &LeafNode{
-				Segments: []*Segment{seg},
+		newNode.pass, err = insertNode(node.pass, seg)
+		if err != nil {
+			return nil, err
+		}
+		newNode.pass = node.Tree.rebuildDegraded(newNode.pass, node.Level+1)
+		return &newNode, nil
+	}
+
+	newNode.child = make(map[int32]TypedTreeNode[T], len(node.child))
+	for key, child := range node.child {
+		newNode.child[key] = child
+	}
+
+	switch seg.Rect[node.DimName].(type) {
+	case Measures:
+		for _, x := range uniqueDiscreteKeys(seg.Rect[node.DimName].(Measures)) {
+			id := node.Tree.schema.intern(x)
+			if child, ok := node.child[id]; ok {
+				newNode.child[id], err = child.Insert(seg)
+				if err != nil {
+					return nil, err
+				}
+				newNode.child[id] = node.Tree.rebuildDegraded(newNode.child[id], node.Level+1)
+			} else {
+				newNode.child[id] = node.newChild(x, seg)
+			}
+		}
+	case ExcludedMeasures:
+		excluded := seg.Rect[node.DimName].(ExcludedMeasures)
+		for key, child := range node.child {
+			if excluded.Contains(node.Tree.schema.Value(key)) {
+				newNode.child[key], err = child.Insert(seg)
+				if err != nil {
+					return nil, err
+				}
+				newNode.child[key] = node.Tree.rebuildDegraded(newNode.child[key], node.Level+1)
 			}
-			return nil
 		}
+		newNode.other, err = insertNode(node.other, seg)
+		if err != nil {
+			return nil, err
+		}
+		newNode.other = node.Tree.rebuildDegraded(newNode.other, node.Level+1)
+	default:
+		return nil, errors.New(fmt.Sprintf("wrong hash scatters: %v", node.DimName))
 	}
+	return &newNode, nil
+}
 
-	if _, ok := seg.Rect[node.DimName].(Measures); ok == false {
-		return errors.New(fmt.Sprintf("wrong hash scatters: %v", node.DimName))
+// newChild builds the child of a key without one: the segment and the
+// excluding segments of the other branch not excluding the key.
+func (node *TypedHashNode[T]) newChild(key Measure, seg *TypedSegment[T]) TypedTreeNode[T] {
+	var segments []*TypedSegment[T]
+	for _, other := range subtreeSegments(node.other) {
+		if excluded, ok := other.Rect[node.DimName].(ExcludedMeasures); ok && excluded.Contains(key) {
+			segments = append(segments, other)
+		}
 	}
+	segments = append(segments, seg)
+	return node.Tree.buildSubtree(segments, node.Level+1)
+}
 
-	scatters := seg.Rect[node.DimName].(Measures)
+func (node *TypedHashNode[T]) Remove(data T) TypedTreeNode[T] {
+	return node.removeChildren(func(child TypedTreeNode[T]) TypedTreeNode[T] {
+		return child.Remove(data)
+	})
+}
 
-	for _, x := range scatters {
-		if child, ok := node.child[x]; ok {
-			err := child.Insert(seg)
-			if err != nil {
-				return err
-			}
+func (node *TypedHashNode[T]) Delete(id string) TypedTreeNode[T] {
+	return node.removeChildren(func(child TypedTreeNode[T]) TypedTreeNode[T] {
+		return child.Delete(id)
+	})
+}
+
+func (node *TypedHashNode[T]) removeChildren(
+	remove func(TypedTreeNode[T]) TypedTreeNode[T],
+) TypedTreeNode[T] {
+	if node == nil {
+		return nil
+	}
+
+	var changed = false
+	var children = make(map[int32]TypedTreeNode[T], len(node.child))
+	for key, child := range node.child {
+		newChild := remove(child)
+		if newChild != child {
+			changed = true
+		}
+		if newChild != nil {
+			children[key] = newChild
 		}
 	}
-	return nil
+
+	var pass, other TypedTreeNode[T]
+	if node.pass != nil {
+		pass = remove(node.pass)
+	}
+	if node.other != nil {
+		other = remove(node.other)
+	}
+	if changed == false && pass == node.pass && other == node.other {
+		return node
+	}
+
+	// without children there is nothing left to hash on
+	if len(children) == 0 && other == nil {
+		return pass
+	}
+
+	newNode := *node
+	newNode.child, newNode.pass, newNode.other = children, pass, other
+	return &newNode
 }
 
-func (node *HashNode) Dumps(prefix string) string {
+func (node *TypedHashNode[T]) Dumps(prefix string) string {
 	if node == nil {
 		return ""
 	}
 
 	var msgs []string
-	msgs = append(msgs, fmt.Sprintf("%s -hnode{dim:%d, decreasePercent:%v}\n",
+	msgs = append(msgs, fmt.Sprintf("%s -hnode{dim:%v, decreasePercent:%v}\n",
 		prefix, node.DimName, node.DecreasePercent))
 	if node.pass != nil {
 		msgs = append(msgs, node.pass.Dumps(fmt.Sprintf("%v    %v:", prefix, "<PASS>")))
 	}
+	if node.other != nil {
+		msgs = append(msgs, node.other.Dumps(fmt.Sprintf("%v    %v:", prefix, "<OTHER>")))
+	}
+	var children []string
 	for childKey, child := range node.child {
-		msgs = append(msgs, child.Dumps(fmt.Sprintf("%v    %v:", prefix, childKey)))
+		children = append(children, child.Dumps(fmt.Sprintf("%v    %v:", prefix, node.Tree.schema.Value(childKey))))
 	}
+	sort.Strings(children)
+	msgs = append(msgs, children...)
 	return strings.Join(msgs, "\n")
 }
 
-func NewHashNode(tree *Tree,
-	segments []*Segment,
+func NewHashNode[T comparable](tree *TypedTree[T],
+	segments []*TypedSegment[T],
 	dimName interface{},
 	decreasePercent float64,
 	level int,
-) (*HashNode, []*Segment, map[Measure][]*Segment) {
-	hashSegments := make(map[Measure][]*Segment)
+) (*TypedHashNode[T], []*TypedSegment[T], map[Measure][]*TypedSegment[T], []*TypedSegment[T]) {
+	passSegments, hashSegments, otherSegments := partitionHashSegments(segments, dimName)
+
+	node := &TypedHashNode[T]{
+		Tree:            tree,
+		DimName:         dimName,
+		Level:           level,
+		DecreasePercent: decreasePercent,
+		dim:             tree.schema.dimIndexOrNone(dimName),
+		child:           make(map[int32]TypedTreeNode[T]),
+		debt:            insertDebt{built: len(segments)},
+	}
+
+	return node, passSegments, hashSegments, otherSegments
+}
+
+// partitionHashSegments splits the segments between the branches of a hash
+// node on the dim: pass, the children by key and other.
+func partitionHashSegments[T comparable](
+	segments []*TypedSegment[T],
+	dimName interface{},
+) ([]*TypedSegment[T], map[Measure][]*TypedSegment[T], []*TypedSegment[T]) {
+	hashSegments := make(map[Measure][]*TypedSegment[T])
 
-	var passSegments []*Segment
+	var passSegments []*TypedSegment[T]
+	var otherSegments []*TypedSegment[T]
 	for _, seg := range segments {
-		if seg.Rect[dimName] == nil {
+		switch seg.Rect[dimName].(type) {
+		case nil:
 			passSegments = append(passSegments, seg)
-			continue
-		}
-		for _, key := range seg.Rect[dimName].(Measures) {
-			hashSegments[key] = append(hashSegments[key], seg)
+		case Measures:
+			for _, key := range uniqueDiscreteKeys(seg.Rect[dimName].(Measures)) {
+				hashSegments[key] = append(hashSegments[key], seg)
+			}
+		case ExcludedMeasures:
+			otherSegments = append(otherSegments, seg)
+			for _, key := range seg.Rect[dimName].(ExcludedMeasures) {
+				key = discreteKey(key)
+				if _, ok := hashSegments[key]; ok == false {
+					hashSegments[key] = nil
+				}
+			}
 		}
 	}
 
-	node := &HashNode{
-		Tree:            tree,
-		DimName:         dimName,
-		Level:           level,
-		DecreasePercent: decreasePercent,
-		child:           make(map[Measure]TreeNode),
+	// excluding segments go to every key they do not exclude, the other branch
+	// covers the keys without a child
+	for key := range hashSegments {
+		for _, seg := range otherSegments {
+			if seg.Rect[dimName].(ExcludedMeasures).Contains(key) {
+				hashSegments[key] = append(hashSegments[key], seg)
+			}
+		}
+		if len(hashSegments[key]) == 0 {
+			delete(hashSegments, key)
+		}
 	}
 
-	return node, passSegments, hashSegments
+	return passSegments, hashSegments, otherSegments
 }
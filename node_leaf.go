@@ -3,23 +3,66 @@ package go_kd_segment_tree
 import (
 	"errors"
 	"fmt"
-	mapset "github.com/deckarep/golang-set"
+	mapset "github.com/deckarep/golang-set/v2"
 )
 
-type LeafNode struct {
-	TreeNode
-	Segments []*Segment
+// LeafNode is the untyped leaf node kept for compatibility with interface{} payloads.
+type LeafNode = TypedLeafNode[interface{}]
+
+type TypedLeafNode[T comparable] struct {
+	TypedTreeNode[T]
+	Segments []*TypedSegment[T]
+
+	debt insertDebt
 }
 
-func (node *LeafNode) Search(p Point) []interface{} {
+func (node *TypedLeafNode[T]) Search(p Point) []T {
 	if node == nil {
 		return nil
 	}
 	if node.Segments != nil {
-		var result = mapset.NewSet()
+		var result = mapset.NewSet[T]()
+		// the other rects of a rule already matched are skipped
+		var matched map[string]bool
 		for _, seg := range node.Segments {
+			if seg.ID != "" && matched[seg.ID] {
+				continue
+			}
 			if seg.Rect.Contains(p) {
 				result = result.Union(seg.Data)
+				if seg.ID != "" {
+					if matched == nil {
+						matched = make(map[string]bool)
+					}
+					matched[seg.ID] = true
+				}
+			}
+		}
+		return result.ToSlice()
+	}
+	return nil
+}
+
+func (node *TypedLeafNode[T]) SearchEncoded(p *EncodedPoint) []T {
+	if node == nil {
+		return nil
+	}
+	if node.Segments != nil {
+		var result = mapset.NewSet[T]()
+		// the other rects of a rule already matched are skipped
+		var matched map[string]bool
+		for _, seg := range node.Segments {
+			if seg.ID != "" && matched[seg.ID] {
+				continue
+			}
+			if seg.containsEncoded(p) {
+				result = result.Union(seg.Data)
+				if seg.ID != "" {
+					if matched == nil {
+						matched = make(map[string]bool)
+					}
+					matched[seg.ID] = true
+				}
 			}
 		}
 		return result.ToSlice()
@@ -27,12 +70,12 @@ func (node *LeafNode) Search(p Point) []interface{} {
 	return nil
 }
 
-func (node *LeafNode) SearchRect(r Rect) []interface{} {
+func (node *TypedLeafNode[T]) SearchRect(r Rect) []T {
 	if node == nil {
 		return nil
 	}
 	if node.Segments != nil {
-		var result = mapset.NewSet()
+		var result = mapset.NewSet[T]()
 		for _, seg := range node.Segments {
 			if seg.Rect.HasIntersect(r) {
 				result = result.Union(seg.Data)
@@ -43,16 +86,55 @@ func (node *LeafNode) SearchRect(r Rect) []interface{} {
 	return nil
 }
 
-func (node *LeafNode) Insert(seg *Segment) error {
+func (node *TypedLeafNode[T]) Insert(seg *TypedSegment[T]) (TypedTreeNode[T], error) {
 	if node == nil {
-		return errors.New("leaf node is nil")
+		return nil, errors.New("leaf node is nil")
 	}
-	node.Segments = append(node.Segments, seg)
 
-	return nil
+	segments := make([]*TypedSegment[T], 0, len(node.Segments)+1)
+	segments = append(segments, node.Segments...)
+	segments = append(segments, seg)
+
+	return &TypedLeafNode[T]{
+		Segments: segments,
+		debt:     insertDebt{built: node.debt.built, inserted: node.debt.inserted + 1},
+	}, nil
+}
+
+func (node *TypedLeafNode[T]) Remove(data T) TypedTreeNode[T] {
+	return node.removeSegments(func(segments []*TypedSegment[T]) ([]*TypedSegment[T], bool) {
+		return removeSegmentsData(segments, data)
+	})
+}
+
+func (node *TypedLeafNode[T]) Delete(id string) TypedTreeNode[T] {
+	return node.removeSegments(func(segments []*TypedSegment[T]) ([]*TypedSegment[T], bool) {
+		return deleteSegments(segments, id)
+	})
 }
 
-func (node *LeafNode) Dumps(prefix string) string {
+func (node *TypedLeafNode[T]) removeSegments(
+	remove func([]*TypedSegment[T]) ([]*TypedSegment[T], bool),
+) TypedTreeNode[T] {
+	if node == nil {
+		return nil
+	}
+
+	segments, changed := remove(node.Segments)
+	if changed == false {
+		return node
+	}
+	if len(segments) == 0 {
+		return nil
+	}
+
+	return &TypedLeafNode[T]{
+		Segments: segments,
+		debt:     node.debt,
+	}
+}
+
+func (node *TypedLeafNode[T]) Dumps(prefix string) string {
 	if node == nil {
 		return ""
 	}
@@ -60,15 +142,30 @@ func (node *LeafNode) Dumps(prefix string) string {
 	return fmt.Sprintf("%s -leaf:{size=%v}", prefix, len(node.Segments))
 }
 
-func MergeSegments(segments []*Segment) []*Segment {
-	var newSegments []*Segment
-	var uniqMap = make(map[string]*Segment)
+// MergeSegments merges segments with identical rects and ids into one segment
+// carrying the union of their data. Input segments are never modified.
+func MergeSegments[T comparable](segments []*TypedSegment[T]) []*TypedSegment[T] {
+	var newSegments []*TypedSegment[T]
+	var merged []bool
+	var uniqMap = make(map[string]int)
 	for _, seg := range segments {
-		rectKey := seg.Rect.Key()
-		if s, ok := uniqMap[rectKey]; ok {
-			s.Data = s.Data.Union(seg.Data)
+		rectKey := fmt.Sprintf("%q@%v", seg.ID, seg.Rect.Key())
+		if i, ok := uniqMap[rectKey]; ok {
+			if merged[i] == false {
+				newSegments[i] = &TypedSegment[T]{
+					ID:     newSegments[i].ID,
+					Rect:   newSegments[i].Rect,
+					Data:   newSegments[i].Data.Clone(),
+					merged: append([]*TypedSegment[T]{}, newSegments[i].sources()...),
+				}
+				merged[i] = true
+			}
+			newSegments[i].Data = newSegments[i].Data.Union(seg.Data)
+			newSegments[i].merged = append(newSegments[i].merged, seg.sources()...)
 		} else {
+			uniqMap[rectKey] = len(newSegments)
 			newSegments = append(newSegments, seg)
+			merged = append(merged, false)
 		}
 	}
 	return newSegments
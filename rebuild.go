@@ -0,0 +1,121 @@
+package go_kd_segment_tree
+
+import (
+	"sort"
+)
+
+// insertDebt tracks how far a subtree drifted from the one a build would
+// produce: the segments it was built with and the ones inserted into it since.
+type insertDebt struct {
+	built    int
+	inserted int
+}
+
+// nodeDebt returns the insert debt of the node, zero for a nil node.
+func nodeDebt[T comparable](node TypedTreeNode[T]) insertDebt {
+	if isNilNode(node) {
+		return insertDebt{}
+	}
+
+	switch node := node.(type) {
+	case *TypedLeafNode[T]:
+		return node.debt
+	case *TypedBinaryNode[T]:
+		return node.debt
+	case *TypedHashNode[T]:
+		return node.debt
+	case *TypedConjunctionNode[T]:
+		return node.debt
+	}
+	return insertDebt{}
+}
+
+// builtDebt returns the debt of a node loaded with the children, which were
+// built with all their segments.
+func builtDebt[T comparable](children ...TypedTreeNode[T]) insertDebt {
+	var debt insertDebt
+	for _, child := range children {
+		debt.built += nodeDebt(child).built
+	}
+	return debt
+}
+
+// rebuildDegraded returns the node rebuilt at the level when the segments
+// inserted into it since it was built exceed the rebuild thresholds of the
+// options, the node itself otherwise. The caller holds updateMu.
+func (tree *TypedTree[T]) rebuildDegraded(node TypedTreeNode[T], level int) TypedTreeNode[T] {
+	if tree.options.RebuildInsertRate == 0 || isNilNode(node) {
+		return node
+	}
+
+	debt := nodeDebt(node)
+	if debt.inserted < tree.options.RebuildInsertMin ||
+		float64(debt.inserted) <= tree.options.RebuildInsertRate*float64(debt.built) {
+		return node
+	}
+
+	return tree.buildSubtree(subtreeSegments(node), level)
+}
+
+// buildSubtree builds the segments into a node at the level, drawing the
+// tie-breakers of the segments inserted since the last build. The caller holds
+// updateMu.
+func (tree *TypedTree[T]) buildSubtree(segments []*TypedSegment[T], level int) TypedTreeNode[T] {
+	for _, seg := range segments {
+		if seg.rnd == 0 {
+			seg.rnd = tree.tieBreaker(seg)
+		}
+	}
+
+	// the sampled queries reaching a subtree are unknown, only the root
+	// keeps using them
+	var traffic []*EncodedPoint
+	if level == 1 {
+		traffic = tree.encodeTraffic()
+	}
+	return newNode(segments, traffic, tree, level)
+}
+
+// subtreeSegments returns the distinct segments held by the node in index
+// order: the segments merged into the copies of leaves, and once the copies of
+// a segment made by removals, which share its index.
+func subtreeSegments[T comparable](node TypedTreeNode[T]) []*TypedSegment[T] {
+	var segments []*TypedSegment[T]
+	var seen = make(map[int]bool)
+	var walk func(node TypedTreeNode[T])
+	walk = func(node TypedTreeNode[T]) {
+		if isNilNode(node) {
+			return
+		}
+
+		var nodeSegments []*TypedSegment[T]
+		switch node := node.(type) {
+		case *TypedLeafNode[T]:
+			nodeSegments = node.Segments
+		case *TypedConjunctionNode[T]:
+			nodeSegments = node.segments
+		case *TypedBinaryNode[T]:
+			walk(node.Left)
+			walk(node.Right)
+			walk(node.Pass)
+		case *TypedHashNode[T]:
+			for _, child := range node.child {
+				walk(child)
+			}
+			walk(node.pass)
+			walk(node.other)
+		}
+		for _, seg := range nodeSegments {
+			for _, source := range seg.sources() {
+				if seen[source.index] == false {
+					seen[source.index] = true
+					segments = append(segments, source)
+				}
+			}
+		}
+	}
+	walk(node)
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].index < segments[j].index })
+	return segments
+}
@@ -0,0 +1,177 @@
+package go_kd_segment_tree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestTree_RebuildDegraded(t *testing.T) {
+	rnd := rand.New(rand.NewSource(23))
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "age": DimTypeReal}
+
+	randRect := func() Rect {
+		rect := Rect{}
+		switch rnd.Intn(4) {
+		case 0:
+			rect["country"] = Measures{MeasureString(fmt.Sprint("c", rnd.Intn(8)))}
+		case 1, 2:
+			rect["country"] = ExcludedMeasures{MeasureString(fmt.Sprint("c", rnd.Intn(8)))}
+		}
+		if rnd.Intn(4) > 0 {
+			from := rnd.Intn(100)
+			rect["age"] = Interval{MeasureInt(from), Exclusive{MeasureInt(from + 1 + rnd.Intn(10))}}
+		}
+		return rect
+	}
+	randPoint := func() Point {
+		p := Point{}
+		if rnd.Intn(5) > 0 {
+			p["country"] = MeasureString(fmt.Sprint("c", rnd.Intn(10)))
+		}
+		if rnd.Intn(5) > 0 {
+			p["age"] = MeasureInt(rnd.Intn(110))
+		}
+		return p
+	}
+
+	var maxLeafSizes []int
+	for _, rate := range []float64{0, 0.5} {
+		tree := NewTypedTree[int](dimTypes, &TreeOptions{LeafNodeDataMax: 2, Seed: 23, RebuildInsertRate: rate})
+		rects := make(map[int]Rect)
+		for i := 0; i < 100; i++ {
+			rects[i] = randRect()
+			_ = tree.Add(rects[i], i)
+		}
+		tree.Build()
+
+		// searches keep running on the previous snapshot during a rebuild
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					_ = tree.Search(Point{"age": MeasureInt(50)})
+				}
+			}
+		}()
+		for i := 100; i < 1000; i++ {
+			rects[i] = randRect()
+			if err := tree.Insert(rects[i], i); err != nil {
+				t.Fatal("insert error:", err)
+			}
+		}
+		tree.Remove(7)
+		delete(rects, 7)
+		close(stop)
+		wg.Wait()
+
+		for i := 0; i < 300; i++ {
+			p := randPoint()
+			var expected []int
+			for data, rect := range rects {
+				if rect.Contains(p) {
+					expected = append(expected, data)
+				}
+			}
+			result := tree.Search(p)
+			sort.Ints(result)
+			sort.Ints(expected)
+			if fmt.Sprint(result) != fmt.Sprint(expected) {
+				t.Fatal("rebuilt search error:", p, result, expected)
+			}
+		}
+
+		stats := tree.Stats()
+		if rate == 0 && stats.InsertedSegments != 900 {
+			t.Fatal("inserted segments error:", stats.InsertedSegments)
+		}
+		if rate > 0 && (stats.InsertDebt > rate || stats.InsertedSegments >= 900) {
+			t.Fatal("root not rebuilt:", stats.InsertedSegments, stats.InsertDebt)
+		}
+		maxLeafSizes = append(maxLeafSizes, stats.MaxLeafSize)
+
+		if rate > 0 {
+			// a loaded tree keeps the thresholds and its built segments
+			var buf bytes.Buffer
+			_ = tree.Save(&buf, &TreeCodec[int]{})
+			loaded, err := LoadTypedTree[int](&buf, &TreeCodec[int]{})
+			if err != nil || loaded.options.RebuildInsertRate != rate || loaded.options.RebuildInsertMin != 2 {
+				t.Fatal("load rebuild options error:", err)
+			}
+			_ = loaded.Insert(randRect(), 2000)
+			if stats := loaded.Stats(); stats.InsertedSegments != 1 {
+				t.Fatal("loaded insert debt error:", stats.InsertedSegments)
+			}
+		}
+	}
+	if maxLeafSizes[1] >= maxLeafSizes[0] {
+		t.Fatal("rebuilds did not bound the leaves:", maxLeafSizes)
+	}
+}
+
+func TestTree_RebuildReproducible(t *testing.T) {
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "age": DimTypeReal}
+
+	build := func() *TypedTree[int] {
+		rnd := rand.New(rand.NewSource(23))
+		randRect := func() Rect {
+			// few distinct rects, so that leaves merge the rects of several
+			// payloads, listed by several hash children
+			from := rnd.Intn(5) * 20
+			return Rect{
+				"country": Measures{MeasureString(fmt.Sprint("c", rnd.Intn(4))), MeasureString(fmt.Sprint("c", rnd.Intn(4)))},
+				"age":     Interval{MeasureInt(from), Exclusive{MeasureInt(from + 20)}},
+			}
+		}
+
+		tree := NewTypedTree[int](dimTypes, &TreeOptions{LeafNodeDataMax: 2, Seed: 23, BuildWorkers: 4, RebuildInsertRate: 0.2})
+		for i := 0; i < 300; i++ {
+			_ = tree.Add(randRect(), i%100)
+		}
+		tree.Build()
+		for i := 300; i < 600; i++ {
+			if err := tree.Insert(randRect(), i%100); err != nil {
+				t.Fatal("insert error:", err)
+			}
+		}
+		return tree
+	}
+	artifacts := func(tree *TypedTree[int]) string {
+		var saved bytes.Buffer
+		if err := tree.Save(&saved, &TreeCodec[int]{}); err != nil {
+			t.Fatal("save error:", err)
+		}
+		return tree.Dumps() + saved.String()
+	}
+
+	tree := build()
+	if stats := tree.Stats(); stats.InsertedSegments >= 300 || stats.Segments != 600 {
+		t.Fatal("rebuild stats error:", stats.InsertedSegments, stats.Segments)
+	}
+	expected := artifacts(tree)
+	for i := 0; i < 5; i++ {
+		if artifacts(build()) != expected {
+			t.Fatal("seeded rebuild is not reproducible")
+		}
+	}
+
+	// a loaded tree keeps the merged segments apart
+	var buf bytes.Buffer
+	_ = tree.Save(&buf, &TreeCodec[int]{})
+	loaded, err := LoadTypedTree[int](&buf, &TreeCodec[int]{})
+	if err != nil {
+		t.Fatal("load error:", err)
+	}
+	if stats := loaded.Stats(); stats.Segments != 600 {
+		t.Fatal("loaded segment stats error:", stats.Segments)
+	}
+}
@@ -0,0 +1,479 @@
+package go_kd_segment_tree
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Rule files describe the dims of a tree and the rules it indexes:
+//
+//	dims:
+//	  country: discrete              # string values
+//	  os: discrete
+//	  age: real                      # float values
+//	  start: {type: real, measure: time}
+//	rules:
+//	  - id: r1                       # optional stable id, see Upsert
+//	    rect:
+//	      country: [US, CA]          # Measures
+//	      os: {not: [ios]}           # ExcludedMeasures
+//	      age: [18, 35]              # closed Interval, null is unbounded
+//	      start: {gte: "2020-01-01T00:00:00Z", lt: "2021-01-01T00:00:00Z"}
+//	    data: target1
+//
+// The measure of a dim is one of string, int, uint, float or time; discrete
+// dims default to string and real dims to float. Times are RFC 3339 strings.
+// JSON files use the same structure.
+
+const (
+	ruleMeasureString = "string"
+	ruleMeasureInt    = "int"
+	ruleMeasureUint   = "uint"
+	ruleMeasureFloat  = "float"
+	ruleMeasureTime   = "time"
+)
+
+type ruleDim struct {
+	dimType DimType
+	measure string
+}
+
+// LoadRulesJSON reads a JSON rule file into a tree ready to build.
+func LoadRulesJSON(r io.Reader, opts *TreeOptions) (*Tree, error) {
+	return LoadTypedRulesJSON[interface{}](r, opts)
+}
+
+// LoadRulesYAML reads a YAML rule file into a tree ready to build.
+func LoadRulesYAML(r io.Reader, opts *TreeOptions) (*Tree, error) {
+	return LoadTypedRulesYAML[interface{}](r, opts)
+}
+
+// LoadTypedRulesJSON reads a JSON rule file, decoding the rule data into T.
+func LoadTypedRulesJSON[T comparable](r io.Reader, opts *TreeOptions) (*TypedTree[T], error) {
+	doc, err := parseJSONRules(r)
+	if err != nil {
+		return nil, err
+	}
+	return loadRules[T](doc, opts)
+}
+
+// LoadTypedRulesYAML reads a YAML rule file, decoding the rule data into T.
+func LoadTypedRulesYAML[T comparable](r io.Reader, opts *TreeOptions) (*TypedTree[T], error) {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+		if err == io.EOF {
+			return nil, errors.New("empty rule file")
+		}
+		return nil, err
+	}
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		return loadRules[T](doc.Content[0], opts)
+	}
+	return loadRules[T](&doc, opts)
+}
+
+func ruleError(node *yaml.Node, format string, args ...interface{}) error {
+	return errors.New(fmt.Sprintf("line %v: %v", node.Line, fmt.Sprintf(format, args...)))
+}
+
+// mappingFields returns the values of a mapping node by key, rejecting keys
+// not listed.
+func mappingFields(node *yaml.Node, keys ...string) (map[string]*yaml.Node, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, ruleError(node, "expect a mapping")
+	}
+
+	fields := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		found := false
+		for _, k := range keys {
+			if key.Value == k {
+				found = true
+			}
+		}
+		if found == false {
+			return nil, ruleError(key, "unknown field:%v", key.Value)
+		}
+		if _, ok := fields[key.Value]; ok {
+			return nil, ruleError(key, "duplicated field:%v", key.Value)
+		}
+		fields[key.Value] = node.Content[i+1]
+	}
+	return fields, nil
+}
+
+func loadRules[T comparable](doc *yaml.Node, opts *TreeOptions) (*TypedTree[T], error) {
+	fields, err := mappingFields(doc, "dims", "rules")
+	if err != nil {
+		return nil, err
+	}
+	if fields["dims"] == nil {
+		return nil, ruleError(doc, "missing dims")
+	}
+
+	dims, err := loadRuleDims(fields["dims"])
+	if err != nil {
+		return nil, err
+	}
+
+	dimTypes := make(DimTypes)
+	for name, dim := range dims {
+		dimTypes[name] = dim.dimType
+	}
+	tree := NewTypedTree[T](dimTypes, opts)
+
+	rules := fields["rules"]
+	if rules == nil {
+		return tree, nil
+	}
+	if rules.Kind != yaml.SequenceNode {
+		return nil, ruleError(rules, "expect a list of rules")
+	}
+
+	ids := make(map[string]bool)
+	for _, rule := range rules.Content {
+		if err := loadRule(tree, dims, ids, rule); err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+func loadRuleDims(node *yaml.Node) (map[string]ruleDim, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, ruleError(node, "expect a mapping of dims")
+	}
+
+	dims := make(map[string]ruleDim)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name, value := node.Content[i], node.Content[i+1]
+		if _, ok := dims[name.Value]; ok {
+			return nil, ruleError(name, "duplicated dim:%v", name.Value)
+		}
+
+		typeNode, measureNode := value, (*yaml.Node)(nil)
+		if value.Kind == yaml.MappingNode {
+			fields, err := mappingFields(value, "type", "measure")
+			if err != nil {
+				return nil, err
+			}
+			if typeNode = fields["type"]; typeNode == nil {
+				return nil, ruleError(value, "missing type of dim:%v", name.Value)
+			}
+			measureNode = fields["measure"]
+		}
+
+		var dim ruleDim
+		switch typeNode.Value {
+		case "discrete":
+			dim = ruleDim{dimType: DimTypeDiscrete, measure: ruleMeasureString}
+		case "real":
+			dim = ruleDim{dimType: DimTypeReal, measure: ruleMeasureFloat}
+		default:
+			return nil, ruleError(typeNode, "not support dim type:%v", typeNode.Value)
+		}
+
+		if measureNode != nil {
+			switch measureNode.Value {
+			case ruleMeasureString, ruleMeasureInt, ruleMeasureUint, ruleMeasureFloat, ruleMeasureTime:
+				dim.measure = measureNode.Value
+			default:
+				return nil, ruleError(measureNode, "not support measure:%v", measureNode.Value)
+			}
+		}
+		dims[name.Value] = dim
+	}
+	return dims, nil
+}
+
+func loadRule[T comparable](tree *TypedTree[T], dims map[string]ruleDim, ids map[string]bool, node *yaml.Node) error {
+	fields, err := mappingFields(node, "id", "rect", "data")
+	if err != nil {
+		return err
+	}
+	if fields["data"] == nil {
+		return ruleError(node, "missing data")
+	}
+
+	rect := Rect{}
+	if rectNode := fields["rect"]; rectNode != nil && rectNode.Tag != "!!null" {
+		if rectNode.Kind != yaml.MappingNode {
+			return ruleError(rectNode, "expect a mapping of dims")
+		}
+		for i := 0; i+1 < len(rectNode.Content); i += 2 {
+			name, value := rectNode.Content[i], rectNode.Content[i+1]
+			dim, ok := dims[name.Value]
+			if ok == false {
+				return ruleError(name, "unknown dim:%v", name.Value)
+			}
+			if _, ok := rect[name.Value]; ok {
+				return ruleError(name, "duplicated dim:%v", name.Value)
+			}
+
+			var d interface{}
+			if dim.dimType == DimTypeReal {
+				d, err = loadRuleInterval(dim, value)
+			} else {
+				d, err = loadRuleMeasures(dim, value)
+			}
+			if err != nil {
+				return err
+			}
+			rect[name.Value] = d
+		}
+	}
+
+	var data T
+	if err := fields["data"].Decode(&data); err != nil {
+		return ruleError(fields["data"], "data error:%v", err)
+	}
+	if t := reflect.TypeOf(data); t != nil && t.Comparable() == false {
+		return ruleError(fields["data"], "data is not comparable:%T", data)
+	}
+
+	if idNode := fields["id"]; idNode != nil {
+		if idNode.Kind != yaml.ScalarNode || idNode.Value == "" {
+			return ruleError(idNode, "expect a rule id")
+		}
+		if ids[idNode.Value] {
+			return ruleError(idNode, "duplicated rule id:%v", idNode.Value)
+		}
+		ids[idNode.Value] = true
+
+		if err := tree.Upsert(idNode.Value, rect, data); err != nil {
+			return ruleError(node, "%v", err)
+		}
+		return nil
+	}
+
+	if err := tree.Add(rect, data); err != nil {
+		return ruleError(node, "%v", err)
+	}
+	return nil
+}
+
+func loadRuleInterval(dim ruleDim, node *yaml.Node) (Interval, error) {
+	var interval Interval
+	switch node.Kind {
+	case yaml.SequenceNode:
+		if len(node.Content) != 2 {
+			return interval, ruleError(node, "expect an interval of two endpoints")
+		}
+		for i, endpoint := range node.Content {
+			if endpoint.Tag == "!!null" {
+				continue
+			}
+			m, err := loadRuleMeasure(dim, endpoint)
+			if err != nil {
+				return interval, err
+			}
+			interval[i] = m
+		}
+	case yaml.MappingNode:
+		fields, err := mappingFields(node, "gt", "gte", "lt", "lte")
+		if err != nil {
+			return interval, err
+		}
+		for _, pair := range [][2]string{{"gt", "gte"}, {"lt", "lte"}} {
+			if fields[pair[0]] != nil && fields[pair[1]] != nil {
+				return interval, ruleError(node, "both %v and %v are set", pair[0], pair[1])
+			}
+		}
+		for _, key := range []string{"gt", "gte", "lt", "lte"} {
+			endpoint := fields[key]
+			if endpoint == nil {
+				continue
+			}
+			m, err := loadRuleMeasure(dim, endpoint)
+			if err != nil {
+				return interval, err
+			}
+			switch key {
+			case "gt":
+				interval[0] = Exclusive{m}
+			case "gte":
+				interval[0] = m
+			case "lt":
+				interval[1] = Exclusive{m}
+			case "lte":
+				interval[1] = m
+			}
+		}
+	default:
+		return interval, ruleError(node, "expect an interval")
+	}
+
+	if interval[0] != nil && interval[1] != nil &&
+		interval.lowerBound().compare(interval.upperBound()) > 0 {
+		return interval, ruleError(node, "empty interval:%v", interval)
+	}
+	return interval, nil
+}
+
+func loadRuleMeasures(dim ruleDim, node *yaml.Node) (interface{}, error) {
+	excluded := false
+	if node.Kind == yaml.MappingNode {
+		fields, err := mappingFields(node, "not")
+		if err != nil {
+			return nil, err
+		}
+		if fields["not"] == nil {
+			return nil, ruleError(node, "expect excluded values")
+		}
+		node = fields["not"]
+		excluded = true
+	}
+
+	values := []*yaml.Node{node}
+	if node.Kind == yaml.SequenceNode {
+		values = node.Content
+	}
+
+	var measures []Measure
+	for _, value := range values {
+		m, err := loadRuleMeasure(dim, value)
+		if err != nil {
+			return nil, err
+		}
+		measures = append(measures, m)
+	}
+
+	if excluded {
+		return ExcludedMeasures(measures), nil
+	}
+	return Measures(measures), nil
+}
+
+func loadRuleMeasure(dim ruleDim, node *yaml.Node) (Measure, error) {
+	if node.Kind != yaml.ScalarNode || node.Tag == "!!null" {
+		return nil, ruleError(node, "expect a %v value", dim.measure)
+	}
+
+	switch dim.measure {
+	case ruleMeasureString:
+		return MeasureString(node.Value), nil
+	case ruleMeasureInt:
+		var x int64
+		if err := node.Decode(&x); err != nil {
+			return nil, ruleError(node, "expect an int value:%v", node.Value)
+		}
+		return MeasureInt(x), nil
+	case ruleMeasureUint:
+		var x uint64
+		if err := node.Decode(&x); err != nil {
+			return nil, ruleError(node, "expect a uint value:%v", node.Value)
+		}
+		return MeasureUint(x), nil
+	case ruleMeasureFloat:
+		var x float64
+		if err := node.Decode(&x); err != nil {
+			return nil, ruleError(node, "expect a float value:%v", node.Value)
+		}
+		return MeasureFloat(x), nil
+	case ruleMeasureTime:
+		t, err := time.Parse(time.RFC3339Nano, node.Value)
+		if err != nil {
+			return nil, ruleError(node, "expect a RFC 3339 time:%v", node.Value)
+		}
+		return MeasureTime(t), nil
+	}
+	return nil, ruleError(node, "not support measure:%v", dim.measure)
+}
+
+// parseJSONRules parses a JSON document into yaml nodes carrying the line of
+// each value, so both formats share the rule loading and its errors.
+func parseJSONRules(r io.Reader) (*yaml.Node, error) {
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &jsonRuleParser{
+		dec:   json.NewDecoder(bytes.NewReader(input)),
+		input: input,
+	}
+	p.dec.UseNumber()
+
+	node, err := p.parse()
+	if err == nil {
+		if _, err = p.dec.Token(); err == io.EOF {
+			return node, nil
+		} else if err == nil {
+			err = errors.New("unexpected data after the rules")
+		}
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if syntaxErr, ok := err.(*json.SyntaxError); ok {
+		return nil, errors.New(fmt.Sprintf("line %v: %v", p.line(syntaxErr.Offset), err))
+	}
+	return nil, errors.New(fmt.Sprintf("line %v: %v", p.line(p.dec.InputOffset()), err))
+}
+
+type jsonRuleParser struct {
+	dec   *json.Decoder
+	input []byte
+}
+
+func (p *jsonRuleParser) line(offset int64) int {
+	if offset > int64(len(p.input)) {
+		offset = int64(len(p.input))
+	}
+	return bytes.Count(p.input[:offset], []byte("\n")) + 1
+}
+
+func (p *jsonRuleParser) parse() (*yaml.Node, error) {
+	token, err := p.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	node := &yaml.Node{Kind: yaml.ScalarNode, Line: p.line(p.dec.InputOffset())}
+	switch token := token.(type) {
+	case json.Delim:
+		if token == '{' {
+			node.Kind, node.Tag = yaml.MappingNode, "!!map"
+		} else {
+			node.Kind, node.Tag = yaml.SequenceNode, "!!seq"
+		}
+		for p.dec.More() {
+			if node.Kind == yaml.MappingNode {
+				key, err := p.parse()
+				if err != nil {
+					return nil, err
+				}
+				node.Content = append(node.Content, key)
+			}
+			value, err := p.parse()
+			if err != nil {
+				return nil, err
+			}
+			node.Content = append(node.Content, value)
+		}
+		if _, err := p.dec.Token(); err != nil {
+			return nil, err
+		}
+	case string:
+		node.Tag, node.Value = "!!str", token
+	case json.Number:
+		node.Tag, node.Value = "!!int", token.String()
+		if strings.ContainsAny(node.Value, ".eE") {
+			node.Tag = "!!float"
+		}
+	case bool:
+		node.Tag, node.Value = "!!bool", fmt.Sprint(token)
+	case nil:
+		node.Tag, node.Value = "!!null", "null"
+	}
+	return node, nil
+}
@@ -0,0 +1,144 @@
+package go_kd_segment_tree
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRulesYAML = `
+dims:
+  country: discrete
+  os: discrete
+  age: real
+  level: {type: discrete, measure: int}
+  start: {type: real, measure: time}
+rules:
+  - id: r1
+    rect:
+      country: [US, CA]
+      age: [18, 35]
+    data: target1
+  - rect:
+      os: {not: [ios]}
+      age: {gt: 35}
+    data: target2
+  - rect:
+      level: 3
+      start: {gte: "2020-01-01T00:00:00Z", lt: "2021-01-01T00:00:00Z"}
+    data: target3
+  - data: target4
+`
+
+const testRulesJSON = `{
+  "dims": {
+    "country": "discrete",
+    "os": "discrete",
+    "age": "real",
+    "level": {"type": "discrete", "measure": "int"},
+    "start": {"type": "real", "measure": "time"}
+  },
+  "rules": [
+    {"id": "r1", "rect": {"country": ["US", "CA"], "age": [18, 35]}, "data": "target1"},
+    {"rect": {"os": {"not": ["ios"]}, "age": {"gt": 35}}, "data": "target2"},
+    {"rect": {"level": 3, "start": {"gte": "2020-01-01T00:00:00Z", "lt": "2021-01-01T00:00:00Z"}}, "data": "target3"},
+    {"data": "target4"}
+  ]
+}`
+
+func TestLoadRules(t *testing.T) {
+	yamlTree, err := LoadRulesYAML(strings.NewReader(testRulesYAML), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonTree, err := LoadRulesJSON(strings.NewReader(testRulesJSON), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tree := range []*Tree{yamlTree, jsonTree} {
+		tree.Build()
+
+		if seg, ok := tree.Get("r1"); !ok || seg.Data.Contains("target1") == false {
+			t.Fatal("rule id error")
+		}
+
+		for _, c := range []struct {
+			p        Point
+			expected string
+		}{
+			{Point{"country": MeasureString("US"), "age": MeasureFloat(18)}, "[target1 target4]"},
+			{Point{"country": MeasureString("CN"), "age": MeasureFloat(20)}, "[target4]"},
+			{Point{"os": MeasureString("android"), "age": MeasureFloat(40)}, "[target2 target4]"},
+			{Point{"os": MeasureString("ios"), "age": MeasureFloat(40)}, "[target4]"},
+			{Point{"level": MeasureInt(3), "start": MeasureTime(time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC))}, "[target3 target4]"},
+			{Point{"level": MeasureInt(3), "start": MeasureTime(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))}, "[target4]"},
+		} {
+			var result []string
+			for _, d := range tree.Search(c.p) {
+				result = append(result, d.(string))
+			}
+			sort.Strings(result)
+			if fmt.Sprint(result) != c.expected {
+				t.Fatal("rule tree search error:", c.p, result, c.expected)
+			}
+		}
+	}
+
+	typedTree, err := LoadTypedRulesYAML[int](strings.NewReader("dims: {a: discrete}\nrules: [{rect: {a: x}, data: 7}]"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	typedTree.Build()
+	if result := typedTree.Search(Point{"a": MeasureString("x")}); len(result) != 1 || result[0] != 7 {
+		t.Fatal("typed rule tree search error:", result)
+	}
+}
+
+func TestLoadRules_Errors(t *testing.T) {
+	for _, c := range []struct {
+		rules string
+		err   string
+	}{
+		{"dims:\n  a: discrete\nrules:\n  - rect: {b: [x]}\n    data: 1", "line 4: unknown dim:b"},
+		{"dims:\n  a: real\nrules:\n  - rect:\n      a: [x, 2]\n    data: 1", "line 5: expect a float value:x"},
+		{"dims:\n  a: real\nrules:\n  - rect: {a: [3, 2]}\n    data: 1", "line 4: empty interval"},
+		{"dims:\n  a: real\nrules:\n  - rect: {a: {gt: 1, gte: 2}}\n    data: 1", "line 4: both gt and gte are set"},
+		{"dims:\n  a: color\n", "line 2: not support dim type:color"},
+		{"dims:\n  a: discrete\nrules:\n  - rect: {}\n", "line 4: missing data"},
+		{"dims:\n  a: discrete\nrules:\n  - {id: x, data: 1}\n  - {id: x, data: 2}", "line 5: duplicated rule id:x"},
+		{"dims:\n  a: discrete\nrules:\n  - data: {k: v}", "line 4: data is not comparable"},
+		{"dims:\n  a: {type: discrete, measure: int}\nrules:\n  - rect: {a: [1, x]}\n    data: 1", "line 4: expect an int value:x"},
+	} {
+		_, err := LoadRulesYAML(strings.NewReader(c.rules), nil)
+		if err == nil || strings.HasPrefix(err.Error(), c.err) == false {
+			t.Fatal("rule error mismatch:", err, c.err)
+		}
+	}
+
+	// the first invalid endpoint is reported, in gt, gte, lt, lte order
+	for i := 0; i < 20; i++ {
+		_, err := LoadRulesYAML(strings.NewReader("dims:\n  a: real\nrules:\n  - rect: {a: {lte: y, gt: x}}\n    data: 1"), nil)
+		if err == nil || err.Error() != "line 4: expect a float value:x" {
+			t.Fatal("rule endpoint error mismatch:", err)
+		}
+	}
+
+	for _, c := range []struct {
+		rules string
+		err   string
+	}{
+		{"{\n\"dims\": {\"a\": \"discrete\"},\n\"rules\": [\n{\"rect\": {\"b\": [\"x\"]}, \"data\": 1}]}", "line 4: unknown dim:b"},
+		{"{\n\"dims\": {\"a\": \"real\"},\n\"rules\": [\n{\"rect\": {\"a\": [\"x\", 2]},\n\"data\": 1}]}", "line 4: expect a float value:x"},
+		{"{\n\"dims\": {\"a\": \"real\"},\n\"rules\": [\n{\"rect\": {\"a\": [1, 2]}, \"data\": 1},,\n]}", "line 4:"},
+		{"{\n\"dims\": {\"a\": \"real\"}\n", "line 3:"},
+		{"{\"dims\": {}}\n{}", "line 2: unexpected data after the rules"},
+	} {
+		_, err := LoadRulesJSON(strings.NewReader(c.rules), nil)
+		if err == nil || strings.HasPrefix(err.Error(), c.err) == false {
+			t.Fatal("json rule error mismatch:", err, c.err)
+		}
+	}
+}
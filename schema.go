@@ -0,0 +1,295 @@
+package go_kd_segment_tree
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Schema assigns dense indices to the dims of a tree and interns the values of
+// its discrete dims, so that searches find point values by dim index and
+// compare discrete values by integer id. Values are interned by hash key, so a
+// MeasureUint fitting an int64 shares the id of the equal MeasureInt.
+//
+// The values of the added rects are interned and never forgotten; the values
+// of searched points are only looked up.
+type Schema struct {
+	dims     []interface{}
+	dimIndex map[interface{}]int
+	dimTypes []DimType
+
+	internMu sync.Mutex
+	ids      sync.Map
+	values   atomic.Pointer[[]Measure]
+}
+
+// NewSchema returns a schema of the dims, indexed in the order of their names
+// and then of their types.
+func NewSchema(dimTypes DimTypes) *Schema {
+	schema := &Schema{
+		dimIndex: make(map[interface{}]int),
+	}
+	for dimName := range dimTypes {
+		schema.dims = append(schema.dims, dimName)
+	}
+	sort.Slice(schema.dims, func(i, j int) bool {
+		iName, jName := fmt.Sprint(schema.dims[i]), fmt.Sprint(schema.dims[j])
+		if iName != jName {
+			return iName < jName
+		}
+		return fmt.Sprintf("%T", schema.dims[i]) < fmt.Sprintf("%T", schema.dims[j])
+	})
+	for i, dimName := range schema.dims {
+		schema.dimIndex[dimName] = i
+		schema.dimTypes = append(schema.dimTypes, dimTypes[dimName])
+	}
+	schema.values.Store(&[]Measure{})
+	return schema
+}
+
+// Dims returns the dim names by index.
+func (schema *Schema) Dims() []interface{} {
+	return append([]interface{}{}, schema.dims...)
+}
+
+// DimIndex returns the index of the dim.
+func (schema *Schema) DimIndex(dimName interface{}) (int, bool) {
+	dim, ok := schema.dimIndex[dimName]
+	return dim, ok
+}
+
+// dimIndexOrNone returns the index of the dim, -1 for a dim out of the schema.
+func (schema *Schema) dimIndexOrNone(dimName interface{}) int {
+	if dim, ok := schema.dimIndex[dimName]; ok {
+		return dim
+	}
+	return -1
+}
+
+// ValueID returns the id of an interned discrete value.
+func (schema *Schema) ValueID(m Measure) (int32, bool) {
+	if id, ok := schema.ids.Load(discreteKey(m)); ok {
+		return id.(int32), true
+	}
+	return -1, false
+}
+
+// Value returns the hash key of the discrete value with the id, nil for an
+// unknown id.
+func (schema *Schema) Value(id int32) Measure {
+	values := *schema.values.Load()
+	if id < 0 || int(id) >= len(values) {
+		return nil
+	}
+	return values[id]
+}
+
+// intern returns the id of the discrete value, assigning the next one to a
+// value never seen.
+func (schema *Schema) intern(m Measure) int32 {
+	key := discreteKey(m)
+	if id, ok := schema.ids.Load(key); ok {
+		return id.(int32)
+	}
+
+	schema.internMu.Lock()
+	defer schema.internMu.Unlock()
+
+	if id, ok := schema.ids.Load(key); ok {
+		return id.(int32)
+	}
+
+	// searches only read the values below the length they loaded, appending
+	// keeps them valid
+	values := *schema.values.Load()
+	id := int32(len(values))
+	values = append(values, key)
+	schema.values.Store(&values)
+	schema.ids.Store(key, id)
+	return id
+}
+
+// EncodedPoint is a point encoded by a schema: its values by dim index and the
+// ids of the values of its discrete dims, -1 for a value never interned. It
+// is built once per search.
+type EncodedPoint struct {
+	schema *Schema
+	point  Point
+
+	values []Measure
+	// ids of dim d are ids[idFrom[d]:idFrom[d+1]]
+	idFrom []int32
+	ids    []int32
+}
+
+// Encode returns the encoding of the point.
+func (schema *Schema) Encode(p Point) *EncodedPoint {
+	return schema.EncodeInto(&EncodedPoint{}, p)
+}
+
+// EncodeInto encodes the point into dst, reusing its buffers, and returns it.
+func (schema *Schema) EncodeInto(dst *EncodedPoint, p Point) *EncodedPoint {
+	dst.schema = schema
+	dst.point = p
+	if cap(dst.values) < len(schema.dims) {
+		dst.values = make([]Measure, len(schema.dims))
+		// one id per dim fits in the buffer of idFrom
+		buf := make([]int32, 2*len(schema.dims)+1)
+		dst.idFrom = buf[:len(schema.dims)+1]
+		dst.ids = buf[len(schema.dims)+1 : len(schema.dims)+1]
+	}
+	dst.values = dst.values[:len(schema.dims)]
+	dst.idFrom = dst.idFrom[:len(schema.dims)+1]
+	dst.ids = dst.ids[:0]
+
+	for dim, dimName := range schema.dims {
+		x := p[dimName]
+		dst.values[dim] = x
+		dst.idFrom[dim] = int32(len(dst.ids))
+		if x == nil || schema.dimTypes[dim] != DimTypeDiscrete {
+			continue
+		}
+
+		if set, ok := x.(MeasureSet); ok {
+			for _, m := range set {
+				id, _ := schema.ValueID(m)
+				dst.ids = append(dst.ids, id)
+			}
+		} else {
+			id, _ := schema.ValueID(x)
+			dst.ids = append(dst.ids, id)
+		}
+	}
+	dst.idFrom[len(schema.dims)] = int32(len(dst.ids))
+	return dst
+}
+
+// Point returns the encoded point.
+func (p *EncodedPoint) Point() Point {
+	return p.point
+}
+
+// Value returns the value of the dim with the index, nil when it is missing.
+func (p *EncodedPoint) Value(dim int) Measure {
+	if dim < 0 || dim >= len(p.values) {
+		return nil
+	}
+	return p.values[dim]
+}
+
+// ValueIDs returns the ids of the values of the discrete dim with the index.
+func (p *EncodedPoint) ValueIDs(dim int) []int32 {
+	if dim < 0 || dim >= len(p.values) {
+		return nil
+	}
+	return p.ids[p.idFrom[dim]:p.idFrom[dim+1]]
+}
+
+// release drops the references of the encoding to the point values.
+func (p *EncodedPoint) release() {
+	p.point = nil
+	for i := range p.values {
+		p.values[i] = nil
+	}
+}
+
+const (
+	segmentDimInterval = iota
+	segmentDimMeasures
+	segmentDimExcluded
+)
+
+// segmentDim is a dim of a segment rect encoded by a schema: an interval of a
+// real dim or the sorted value ids of a discrete dim.
+type segmentDim struct {
+	dim      int
+	kind     uint8
+	interval Interval
+	ids      []int32
+}
+
+// encodeRect encodes the rect, interning its discrete values; it fails for a
+// rect with a dim out of the schema.
+func (schema *Schema) encodeRect(rect Rect) ([]segmentDim, bool) {
+	dims := make([]segmentDim, 0, len(rect))
+	for dimName, d := range rect {
+		dim, ok := schema.dimIndex[dimName]
+		if ok == false {
+			return nil, false
+		}
+
+		switch d := d.(type) {
+		case Interval:
+			dims = append(dims, segmentDim{dim: dim, kind: segmentDimInterval, interval: d})
+		case Measures:
+			dims = append(dims, segmentDim{dim: dim, kind: segmentDimMeasures, ids: schema.internAll(d)})
+		case ExcludedMeasures:
+			dims = append(dims, segmentDim{dim: dim, kind: segmentDimExcluded, ids: schema.internAll(d)})
+		default:
+			return nil, false
+		}
+	}
+	sort.Slice(dims, func(i, j int) bool { return dims[i].dim < dims[j].dim })
+	return dims, true
+}
+
+// internAll returns the sorted distinct ids of the values.
+func (schema *Schema) internAll(measures []Measure) []int32 {
+	var ids []int32
+	for _, m := range uniqueDiscreteKeys(measures) {
+		ids = append(ids, schema.intern(m))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// containsID reports whether the sorted ids hold the id.
+func containsID(ids []int32, id int32) bool {
+	lo, hi := 0, len(ids)
+	for lo < hi {
+		h := int(uint(lo+hi) >> 1)
+		if ids[h] < id {
+			lo = h + 1
+		} else {
+			hi = h
+		}
+	}
+	return lo < len(ids) && ids[lo] == id
+}
+
+// containsEncoded is Rect.Contains for an encoded point, discrete values
+// matching by hash key.
+func (s *TypedSegment[T]) containsEncoded(p *EncodedPoint) bool {
+	if s.encoded == false {
+		return s.Rect.Contains(p.point)
+	}
+
+	for i := range s.dims {
+		d := &s.dims[i]
+		x := p.Value(d.dim)
+		if x == nil {
+			return false
+		}
+
+		switch d.kind {
+		case segmentDimInterval:
+			if d.interval.Contains(x) == false {
+				return false
+			}
+		case segmentDimMeasures, segmentDimExcluded:
+			excluded := d.kind == segmentDimExcluded
+			found := false
+			for _, id := range p.ValueIDs(d.dim) {
+				if containsID(d.ids, id) != excluded {
+					found = true
+					break
+				}
+			}
+			if found == false {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,150 @@
+package go_kd_segment_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestSchema_Encode(t *testing.T) {
+	schema := NewSchema(DimTypes{"b": DimTypeReal, "a": DimTypeDiscrete, "c": DimTypeDiscrete})
+	if fmt.Sprint(schema.Dims()) != "[a b c]" {
+		t.Fatal("schema dims error:", schema.Dims())
+	}
+	if dim, ok := schema.DimIndex("c"); ok == false || dim != 2 {
+		t.Fatal("schema dim index error:", dim, ok)
+	}
+	if _, ok := schema.DimIndex("d"); ok {
+		t.Fatal("schema unknown dim error")
+	}
+
+	id := schema.intern(MeasureUint(7))
+	if schema.intern(MeasureInt(7)) != id || schema.intern(MeasureString("x")) == id {
+		t.Fatal("schema intern error")
+	}
+	if v, ok := schema.ValueID(MeasureInt(7)); ok == false || v != id || schema.Value(id) != MeasureInt(7) {
+		t.Fatal("schema value id error:", v, ok, schema.Value(id))
+	}
+	if _, ok := schema.ValueID(MeasureInt(8)); ok {
+		t.Fatal("schema value not interned error")
+	}
+
+	p := schema.Encode(Point{
+		"a": MeasureSet{MeasureString("x"), MeasureInt(8), MeasureUint(7)},
+		"b": MeasureFloat(1.5),
+		"d": MeasureInt(7),
+	})
+	xID, _ := schema.ValueID(MeasureString("x"))
+	if fmt.Sprint(p.ValueIDs(0)) != fmt.Sprint([]int32{xID, -1, id}) {
+		t.Fatal("encode set error:", p.ValueIDs(0))
+	}
+	if p.Value(1) != MeasureFloat(1.5) || len(p.ValueIDs(1)) != 0 {
+		t.Fatal("encode real error:", p.Value(1), p.ValueIDs(1))
+	}
+	if p.Value(2) != nil || len(p.ValueIDs(2)) != 0 || p.Value(3) != nil {
+		t.Fatal("encode missing dim error")
+	}
+
+	// the buffers are reused by the next encoding
+	schema.EncodeInto(p, Point{"c": MeasureInt(7)})
+	if p.Value(0) != nil || p.Value(1) != nil || fmt.Sprint(p.ValueIDs(2)) != fmt.Sprint([]int32{id}) {
+		t.Fatal("encode into error:", p.values, p.ValueIDs(2))
+	}
+}
+
+func TestTree_SearchEncoded(t *testing.T) {
+	rnd := rand.New(rand.NewSource(19))
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "tag": DimTypeDiscrete, "age": DimTypeReal}
+
+	randRect := func() Rect {
+		rect := Rect{}
+		switch rnd.Intn(3) {
+		case 0:
+			rect["country"] = Measures{MeasureString(fmt.Sprint("c", rnd.Intn(6)))}
+		case 1:
+			rect["country"] = ExcludedMeasures{MeasureString(fmt.Sprint("c", rnd.Intn(6)))}
+		}
+		if rnd.Intn(2) == 0 {
+			rect["tag"] = Measures{MeasureInt(rnd.Intn(10)), MeasureUint(rnd.Intn(10))}
+		}
+		if rnd.Intn(3) > 0 {
+			from := rnd.Intn(60)
+			rect["age"] = Interval{MeasureInt(from), Exclusive{MeasureInt(from + rnd.Intn(30))}}
+		}
+		return rect
+	}
+	randPoint := func() Point {
+		p := Point{}
+		if rnd.Intn(5) > 0 {
+			p["country"] = MeasureString(fmt.Sprint("c", rnd.Intn(7)))
+		}
+		if rnd.Intn(3) > 0 {
+			p["tag"] = MeasureSet{MeasureInt(rnd.Intn(10)), MeasureUint(rnd.Intn(12))}
+		}
+		if rnd.Intn(5) > 0 {
+			p["age"] = MeasureInt(rnd.Intn(90))
+		}
+		return p
+	}
+
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+	} {
+		tree := NewTypedTree[int](dimTypes, opts)
+		var rects []Rect
+		for i := 0; i < 300; i++ {
+			rect := randRect()
+			rects = append(rects, rect)
+			_ = tree.Add(rect, i)
+		}
+		tree.Build()
+
+		other := NewSchema(dimTypes)
+		encoded := &EncodedPoint{}
+		for i := 0; i < 300; i++ {
+			p := randPoint()
+
+			var expected []int
+			for data, rect := range rects {
+				if rect.Contains(p) {
+					expected = append(expected, data)
+				}
+			}
+
+			for _, result := range [][]int{
+				tree.Search(p),
+				tree.SearchEncoded(tree.Schema().EncodeInto(encoded, p)),
+				tree.SearchEncoded(other.Encode(p)),
+			} {
+				sort.Ints(result)
+				if fmt.Sprint(result) != fmt.Sprint(expected) {
+					t.Fatal("search encoded error:", p, result, expected)
+				}
+			}
+		}
+	}
+
+	// values interned by concurrent inserts while searching
+	tree := NewTypedTree[int](dimTypes, &TreeOptions{LeafNodeDataMax: 2})
+	_ = tree.Add(Rect{"tag": Measures{MeasureInt(0)}}, 0)
+	tree.Build()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 200; i++ {
+			_ = tree.Insert(Rect{"tag": Measures{MeasureInt(i)}}, i)
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		tag := i % 200
+		if result := tree.Search(Point{"tag": MeasureInt(tag)}); len(result) > 1 || (len(result) == 1 && result[0] != tag) {
+			t.Fatal("concurrent search encoded error:", tag, result)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,120 @@
+package go_kd_segment_tree
+
+// SearchFunc calls fn once for every distinct data of the segments containing
+// the point, stopping as soon as fn returns false. Unlike Search it does not
+// build intermediate results at every node.
+func (tree *TypedTree[T]) SearchFunc(p Point, fn func(data T) bool) {
+	root := tree.snapshot()
+	if root == nil {
+		return
+	}
+
+	w := &searchWalker[T]{p: tree.schema.Encode(p), fn: fn}
+	w.walk(root)
+}
+
+// searchWalker walks the node graph like the Search methods of the nodes, with
+// one dedup set for the whole search.
+type searchWalker[T comparable] struct {
+	p       *EncodedPoint
+	fn      func(data T) bool
+	seen    map[T]struct{}
+	stopped bool
+}
+
+func (w *searchWalker[T]) emit(seg *TypedSegment[T]) {
+	seg.Data.Each(func(data T) bool {
+		if _, ok := w.seen[data]; ok {
+			return false
+		}
+		if w.seen == nil {
+			w.seen = make(map[T]struct{})
+		}
+		w.seen[data] = struct{}{}
+
+		if w.fn(data) == false {
+			w.stopped = true
+		}
+		return w.stopped
+	})
+}
+
+func (w *searchWalker[T]) walk(node TypedTreeNode[T]) {
+	if w.stopped {
+		return
+	}
+
+	switch node := node.(type) {
+	case *TypedLeafNode[T]:
+		if node == nil {
+			return
+		}
+		for _, seg := range node.Segments {
+			if seg.containsEncoded(w.p) {
+				w.emit(seg)
+				if w.stopped {
+					return
+				}
+			}
+		}
+	case *TypedBinaryNode[T]:
+		if node == nil {
+			return
+		}
+		w.walk(node.Pass)
+
+		x := w.p.Value(node.dim)
+		if x == nil {
+			return
+		}
+
+		searchLeft, searchRight := false, false
+		if set, ok := x.(MeasureSet); ok {
+			for _, m := range set {
+				if m.Smaller(node.Mid) {
+					searchLeft = true
+				} else {
+					searchRight = true
+				}
+			}
+		} else if x.Smaller(node.Mid) {
+			searchLeft = true
+		} else {
+			searchRight = true
+		}
+
+		if searchLeft {
+			w.walk(node.Left)
+		}
+		if searchRight {
+			w.walk(node.Right)
+		}
+	case *TypedHashNode[T]:
+		if node == nil {
+			return
+		}
+		w.walk(node.pass)
+		node.eachChild(w.p, w.walk)
+	case *TypedConjunctionNode[T]:
+		if node == nil {
+			return
+		}
+		for _, segIndex := range node.unconstrained {
+			w.emit(node.segments[segIndex])
+			if w.stopped {
+				return
+			}
+		}
+
+		var c conjunctionCounter
+		node.countPoint(w.p, &c)
+		for _, segIndex := range c.touched {
+			if seg := node.segments[segIndex]; c.counters[segIndex] == len(seg.Rect) {
+				w.emit(seg)
+				if w.stopped {
+					return
+				}
+			}
+		}
+	}
+}
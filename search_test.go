@@ -0,0 +1,78 @@
+package go_kd_segment_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestTree_SearchFunc(t *testing.T) {
+	rnd := rand.New(rand.NewSource(16))
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "tag": DimTypeDiscrete, "age": DimTypeReal}
+
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+	} {
+		tree := NewTypedTree[int](dimTypes, opts)
+		tree.SearchFunc(Point{}, func(data int) bool {
+			t.Fatal("search of a tree not built error")
+			return true
+		})
+
+		for i := 0; i < 400; i++ {
+			rect := Rect{}
+			switch rnd.Intn(3) {
+			case 0:
+				rect["country"] = Measures{MeasureString(fmt.Sprint("c", rnd.Intn(6)))}
+			case 1:
+				rect["country"] = ExcludedMeasures{MeasureString(fmt.Sprint("c", rnd.Intn(6)))}
+			}
+			if rnd.Intn(2) == 0 {
+				rect["tag"] = Measures{MeasureInt(rnd.Intn(10)), MeasureInt(rnd.Intn(10))}
+			}
+			if rnd.Intn(3) > 0 {
+				from := rnd.Intn(60)
+				rect["age"] = Interval{MeasureInt(from), Exclusive{MeasureInt(from + rnd.Intn(30))}}
+			}
+			// several segments share each data
+			_ = tree.Add(rect, i%150)
+		}
+		tree.Build()
+
+		for i := 0; i < 500; i++ {
+			p := Point{}
+			if rnd.Intn(5) > 0 {
+				p["country"] = MeasureString(fmt.Sprint("c", rnd.Intn(7)))
+			}
+			if rnd.Intn(3) > 0 {
+				p["tag"] = MeasureSet{MeasureInt(rnd.Intn(10)), MeasureInt(rnd.Intn(10)), MeasureInt(rnd.Intn(12))}
+			}
+			if rnd.Intn(5) > 0 {
+				p["age"] = MeasureInt(rnd.Intn(90))
+			}
+
+			var result []int
+			tree.SearchFunc(p, func(data int) bool {
+				result = append(result, data)
+				return true
+			})
+			expected := tree.Search(p)
+			sort.Ints(result)
+			sort.Ints(expected)
+			if fmt.Sprint(result) != fmt.Sprint(expected) {
+				t.Fatal("search func error:", p, result, expected)
+			}
+
+			calls := 0
+			tree.SearchFunc(p, func(data int) bool {
+				calls++
+				return false
+			})
+			if (len(expected) > 0 && calls != 1) || (len(expected) == 0 && calls != 0) {
+				t.Fatal("search func does not stop:", calls)
+			}
+		}
+	}
+}
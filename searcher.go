@@ -0,0 +1,167 @@
+package go_kd_segment_tree
+
+// Searcher is the untyped searcher kept for compatibility with interface{} payloads.
+type Searcher = TypedSearcher[interface{}]
+
+// TypedSearcher searches a tree reusing its own buffers, so that searches do
+// not allocate once the buffers have grown. Visited segments are stamped with
+// the epoch of the search in arrays indexed by internal segment index, and
+// conjunction node counters are reset the same way.
+//
+// A searcher is not safe for concurrent use; keep one per goroutine. The
+// result of Search is only valid until the next search.
+type TypedSearcher[T comparable] struct {
+	tree  *TypedTree[T]
+	point EncodedPoint
+
+	results  []T
+	seen     map[T]struct{}
+	emitData func(data T) bool
+
+	epoch     uint32
+	segStamps []uint32
+
+	counter conjunctionCounter
+}
+
+// NewSearcher returns a searcher of the tree, following the builds and
+// updates of the tree.
+func (tree *TypedTree[T]) NewSearcher() *TypedSearcher[T] {
+	s := &TypedSearcher[T]{
+		tree: tree,
+		seen: make(map[T]struct{}),
+	}
+	s.emitData = s.addData
+	return s
+}
+
+// Search returns the distinct data of the segments containing the point.
+func (s *TypedSearcher[T]) Search(p Point) []T {
+	for _, data := range s.results {
+		delete(s.seen, data)
+	}
+	s.results = s.results[:0]
+
+	root := s.tree.snapshot()
+	if root == nil {
+		return s.results
+	}
+
+	s.epoch = nextEpoch(s.epoch, s.segStamps)
+
+	s.tree.schema.EncodeInto(&s.point, p)
+	s.walk(root)
+	s.point.release()
+	return s.results
+}
+
+func (s *TypedSearcher[T]) addData(data T) bool {
+	if _, ok := s.seen[data]; ok == false {
+		s.seen[data] = struct{}{}
+		s.results = append(s.results, data)
+	}
+	return false
+}
+
+// visit reports whether the segment is seen for the first time in the search.
+func (s *TypedSearcher[T]) visit(seg *TypedSegment[T]) bool {
+	if seg.index == 0 {
+		return true
+	}
+	if seg.index >= len(s.segStamps) {
+		stamps := make([]uint32, 2*seg.index)
+		copy(stamps, s.segStamps)
+		s.segStamps = stamps
+	}
+	if s.segStamps[seg.index] == s.epoch {
+		return false
+	}
+	s.segStamps[seg.index] = s.epoch
+	return true
+}
+
+func (s *TypedSearcher[T]) walk(node TypedTreeNode[T]) {
+	switch node := node.(type) {
+	case *TypedLeafNode[T]:
+		if node == nil {
+			return
+		}
+		for _, seg := range node.Segments {
+			if s.visit(seg) && seg.containsEncoded(&s.point) {
+				seg.Data.Each(s.emitData)
+			}
+		}
+	case *TypedBinaryNode[T]:
+		if node == nil {
+			return
+		}
+		s.walk(node.Pass)
+
+		x := s.point.Value(node.dim)
+		if x == nil {
+			return
+		}
+
+		searchLeft, searchRight := false, false
+		if set, ok := x.(MeasureSet); ok {
+			for _, m := range set {
+				if m.Smaller(node.Mid) {
+					searchLeft = true
+				} else {
+					searchRight = true
+				}
+			}
+		} else if x.Smaller(node.Mid) {
+			searchLeft = true
+		} else {
+			searchRight = true
+		}
+
+		if searchLeft {
+			s.walk(node.Left)
+		}
+		if searchRight {
+			s.walk(node.Right)
+		}
+	case *TypedHashNode[T]:
+		if node == nil {
+			return
+		}
+		s.walk(node.pass)
+		node.eachChild(&s.point, s.walk)
+	case *TypedConjunctionNode[T]:
+		if node == nil {
+			return
+		}
+		s.walkConjunction(node)
+	}
+}
+
+func (s *TypedSearcher[T]) walkConjunction(node *TypedConjunctionNode[T]) {
+	for _, segIndex := range node.unconstrained {
+		if seg := node.segments[segIndex]; s.visit(seg) {
+			seg.Data.Each(s.emitData)
+		}
+	}
+
+	node.countPoint(&s.point, &s.counter)
+	for _, segIndex := range s.counter.touched {
+		seg := node.segments[segIndex]
+		if s.counter.counters[segIndex] == len(seg.Rect) && s.visit(seg) {
+			seg.Data.Each(s.emitData)
+		}
+	}
+}
+
+// nextEpoch returns the epoch following epoch, clearing the stamps when it
+// wraps around.
+func nextEpoch(epoch uint32, stamps []uint32) uint32 {
+	epoch++
+	if epoch == 0 {
+		for i := range stamps {
+			stamps[i] = 0
+		}
+		epoch = 1
+	}
+	return epoch
+}
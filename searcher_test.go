@@ -0,0 +1,97 @@
+package go_kd_segment_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestTree_Searcher(t *testing.T) {
+	rnd := rand.New(rand.NewSource(17))
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "tag": DimTypeDiscrete, "age": DimTypeReal}
+
+	randRect := func() Rect {
+		rect := Rect{}
+		switch rnd.Intn(3) {
+		case 0:
+			rect["country"] = Measures{MeasureString(fmt.Sprint("c", rnd.Intn(6)))}
+		case 1:
+			rect["country"] = ExcludedMeasures{MeasureString(fmt.Sprint("c", rnd.Intn(6)))}
+		}
+		if rnd.Intn(2) == 0 {
+			rect["tag"] = Measures{MeasureInt(rnd.Intn(10)), MeasureInt(rnd.Intn(10))}
+		}
+		if rnd.Intn(3) > 0 {
+			from := rnd.Intn(60)
+			rect["age"] = Interval{MeasureInt(from), Exclusive{MeasureInt(from + rnd.Intn(30))}}
+		}
+		return rect
+	}
+	randPoint := func() Point {
+		p := Point{}
+		if rnd.Intn(5) > 0 {
+			p["country"] = MeasureString(fmt.Sprint("c", rnd.Intn(7)))
+		}
+		if rnd.Intn(3) > 0 {
+			p["tag"] = MeasureSet{MeasureInt(rnd.Intn(10)), MeasureInt(rnd.Intn(10)), MeasureInt(rnd.Intn(12))}
+		}
+		if rnd.Intn(5) > 0 {
+			p["age"] = MeasureInt(rnd.Intn(90))
+		}
+		return p
+	}
+
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+	} {
+		tree := NewTypedTree[int](dimTypes, opts)
+		searcher := tree.NewSearcher()
+		if len(searcher.Search(Point{})) > 0 {
+			t.Fatal("search of a tree not built error")
+		}
+
+		for i := 0; i < 400; i++ {
+			// several segments share each data
+			_ = tree.Add(randRect(), i%150)
+		}
+		tree.Build()
+
+		check := func() {
+			for i := 0; i < 300; i++ {
+				p := randPoint()
+				result := append([]int{}, searcher.Search(p)...)
+				expected := tree.Search(p)
+				sort.Ints(result)
+				sort.Ints(expected)
+				if fmt.Sprint(result) != fmt.Sprint(expected) {
+					t.Fatal("searcher error:", p, result, expected)
+				}
+			}
+		}
+		check()
+
+		for i := 0; i < 50; i++ {
+			_ = tree.Insert(randRect(), 150+i)
+			_ = tree.Upsert(fmt.Sprint("rule", i%10), randRect(), 200+i)
+		}
+		check()
+
+		for i := 0; i < 100; i++ {
+			_ = tree.Add(randRect(), 300+i)
+		}
+		tree.Build()
+		check()
+
+		points := []Point{randPoint(), randPoint(), randPoint()}
+		allocs := testing.AllocsPerRun(10, func() {
+			for _, p := range points {
+				_ = searcher.Search(p)
+			}
+		})
+		if allocs > 0 {
+			t.Fatal("searcher allocs error:", allocs)
+		}
+	}
+}
@@ -2,39 +2,66 @@ package go_kd_segment_tree
 
 import (
 	"fmt"
-	mapset "github.com/deckarep/golang-set"
-	"math/rand"
+	mapset "github.com/deckarep/golang-set/v2"
 	"sort"
 )
 
-type Segment struct {
+// Segment is the untyped segment kept for compatibility with interface{} payloads.
+type Segment = TypedSegment[interface{}]
+
+type TypedSegment[T comparable] struct {
+	// ID is the caller supplied stable id of the segment, empty when unset.
+	ID   string
 	Rect Rect
-	Data mapset.Set
+	Data mapset.Set[T]
 	rnd  float64
+
+	// index is the internal id of the segment in its tree, used by searchers
+	// to stamp the segments already visited; 0 until the tree assigns it.
+	index int
+
+	// dims is the rect encoded by the schema of the tree along with the
+	// index; encoded is false when the rect has a dim out of the schema.
+	dims    []segmentDim
+	encoded bool
+
+	// merged lists the segments a leaf merged into this copy for their same
+	// id and rect, nil for the others.
+	merged []*TypedSegment[T]
+}
+
+// sources returns the segments merged into the segment, the segment itself
+// when it is not a merged copy.
+func (s *TypedSegment[T]) sources() []*TypedSegment[T] {
+	if s.merged != nil {
+		return s.merged
+	}
+	return []*TypedSegment[T]{s}
 }
 
-func (s *Segment) String() string {
+func (s *TypedSegment[T]) String() string {
 	return fmt.Sprintf("{%v, %v}", s.Rect, s.Data)
 }
 
-func (s *Segment) Clone() *Segment {
-	newSegment := &Segment{
+func (s *TypedSegment[T]) Clone() *TypedSegment[T] {
+	newSegment := &TypedSegment[T]{
+		ID:   s.ID,
 		Rect: s.Rect.Clone(),
 		Data: s.Data.Clone(),
 	}
 	return newSegment
 }
 
-type sortSegments struct {
+type sortSegments[T comparable] struct {
 	dimName  interface{}
-	segments []*Segment
+	segments []*TypedSegment[T]
 }
 
-func (s *sortSegments) Len() int {
+func (s *sortSegments[T]) Len() int {
 	return len(s.segments)
 }
 
-func (s *sortSegments) Less(i, j int) bool {
+func (s *sortSegments[T]) Less(i, j int) bool {
 	iSeg, iSegOk := s.segments[i].Rect[s.dimName]
 	jSeg, jSegOk := s.segments[j].Rect[s.dimName]
 
@@ -49,35 +76,29 @@ func (s *sortSegments) Less(i, j int) bool {
 	if iSegOk && jSegOk {
 		switch iSeg.(type) {
 		case Interval:
-			if iSeg.(Interval)[0].Equal(jSeg.(Interval)[0]) == false {
-				return iSeg.(Interval)[0].Smaller(jSeg.(Interval)[0])
+			if c := iSeg.(Interval).lowerBound().compare(jSeg.(Interval).lowerBound()); c != 0 {
+				return c < 0
 			}
 		}
 	}
 
-	if s.segments[i].rnd == 0 {
-		s.segments[i].rnd = rand.Float64()
+	// the tie-breakers are drawn by Build, segments sharing one keep their
+	// index order
+	if s.segments[i].rnd != s.segments[j].rnd {
+		return s.segments[i].rnd < s.segments[j].rnd
 	}
-	if s.segments[j].rnd == 0 {
-		s.segments[j].rnd = rand.Float64()
-	}
-	for s.segments[i].rnd == s.segments[j].rnd {
-		s.segments[i].rnd = rand.Float64()
-		s.segments[j].rnd = rand.Float64()
-	}
-
-	return s.segments[i].rnd < s.segments[j].rnd
-
+	return s.segments[i].index < s.segments[j].index
 }
 
-func (s *sortSegments) Swap(i, j int) {
+func (s *sortSegments[T]) Swap(i, j int) {
 	s.segments[i], s.segments[j] =
 		s.segments[j], s.segments[i]
 }
 
+// sortMeasures sorts measures in ascending order; sort it stably, so that equal
+// measures keep their order.
 type sortMeasures struct {
 	measures []Measure
-	randNum  []float64
 }
 
 func (s *sortMeasures) Len() int {
@@ -85,25 +106,6 @@ func (s *sortMeasures) Len() int {
 }
 
 func (s *sortMeasures) Less(i, j int) bool {
-	if len(s.randNum) == 0 {
-		s.randNum = make([]float64, len(s.measures))
-	}
-
-	if s.measures[i].Equal(s.measures[j]) {
-		if s.randNum[i] == 0 {
-			s.randNum[i] = rand.Float64()
-		}
-		if s.randNum[j] == 0 {
-			s.randNum[j] = rand.Float64()
-		}
-
-		for s.randNum[i] == s.randNum[j] {
-			s.randNum[i] = rand.Float64()
-			s.randNum[j] = rand.Float64()
-		}
-		return s.randNum[i] < s.randNum[j]
-	}
-
 	return s.measures[i].Smaller(s.measures[j])
 }
 
@@ -112,8 +114,8 @@ func (s *sortMeasures) Swap(i, j int) {
 		s.measures[j], s.measures[i]
 }
 
-func getRealDimSegmentsDecrease(segments []*Segment, dimName interface{}) (int, Measure) {
-	var dimSegments []*Segment
+func getRealDimSegmentsDecrease[T comparable](segments []*TypedSegment[T], dimName interface{}) (int, Measure) {
+	var dimSegments []*TypedSegment[T]
 	for _, seg := range segments {
 		if seg.Rect[dimName] != nil {
 			dimSegments = append(dimSegments, seg)
@@ -123,32 +125,35 @@ func getRealDimSegmentsDecrease(segments []*Segment, dimName interface{}) (int,
 		return 0, nil
 	}
 
-	sort.Sort(&sortSegments{dimName: dimName, segments: dimSegments})
+	sort.Sort(&sortSegments[T]{dimName: dimName, segments: dimSegments})
 
-	var starts []Measure
-	var ends []Measure
+	var starts []bound
+	var ends []bound
 	for _, seg := range dimSegments {
-		starts = append(starts, seg.Rect[dimName].(Interval)[0])
-		ends = append(ends, seg.Rect[dimName].(Interval)[1])
+		starts = append(starts, seg.Rect[dimName].(Interval).lowerBound())
+		if end := seg.Rect[dimName].(Interval).upperBound(); end.m != nil {
+			ends = append(ends, end)
+		}
 	}
 	if len(starts) == 0 || len(ends) == 0 {
 		return 0, nil
 	}
 
-	sort.Sort(&sortMeasures{measures: starts})
-	sort.Sort(&sortMeasures{measures: ends})
+	sort.Sort(sortBounds(starts))
+	sort.Sort(sortBounds(ends))
 	pos := 0
-	for pos < len(starts)-1 && ends[pos].Smaller(starts[len(ends)-1-pos]) {
+	for pos < len(ends)-1 && ends[pos].compare(starts[len(starts)-1-pos]) < 0 {
 		pos += 1
 	}
-	midMeasure := ends[pos]
+	midMeasure := ends[pos].m
 
 	leftCuttingNum := 0
 	rightCuttingNum := 0
 	for _, seg := range dimSegments {
-		if seg.Rect[dimName].(Interval)[1].Smaller(midMeasure) {
+		switch binarySide(seg.Rect[dimName].(Interval), midMeasure) {
+		case -1:
 			leftCuttingNum += 1
-		} else if seg.Rect[dimName].(Interval)[0].BiggerOrEqual(midMeasure) {
+		case 1:
 			rightCuttingNum += 1
 		}
 	}
@@ -161,8 +166,8 @@ func getRealDimSegmentsDecrease(segments []*Segment, dimName interface{}) (int,
 
 }
 
-func getDiscreteDimSegmentsDecrease(segments []*Segment, dimName interface{}) (int, Measure) {
-	var dimSegments []*Segment
+func getDiscreteDimSegmentsDecrease[T comparable](segments []*TypedSegment[T], dimName interface{}) (int, Measure) {
+	var dimSegments []*TypedSegment[T]
 	for _, seg := range segments {
 		if seg.Rect[dimName] != nil {
 			dimSegments = append(dimSegments, seg)
@@ -173,16 +178,32 @@ func getDiscreteDimSegmentsDecrease(segments []*Segment, dimName interface{}) (i
 	}
 
 	var scatterMap = make(map[Measure]int)
+	var excludedNum = 0
+	var excludedMap = make(map[Measure]int)
 	for _, seg := range dimSegments {
-		for _, s := range seg.Rect[dimName].(Measures) {
-			scatterMap[s] = scatterMap[s] + 1
+		switch seg.Rect[dimName].(type) {
+		case Measures:
+			for _, s := range seg.Rect[dimName].(Measures) {
+				s = discreteKey(s)
+				scatterMap[s] = scatterMap[s] + 1
+			}
+		case ExcludedMeasures:
+			excludedNum += 1
+			for _, s := range uniqueDiscreteKeys(seg.Rect[dimName].(ExcludedMeasures)) {
+				excludedMap[s] = excludedMap[s] + 1
+				if _, ok := scatterMap[s]; ok == false {
+					scatterMap[s] = 0
+				}
+			}
 		}
 	}
-	var hottestKeyMatchNum = 0
+	// excluding segments are routed to every key they do not exclude and to
+	// the branch of unlisted keys
+	var hottestKeyMatchNum = excludedNum
 	var maxMeasure Measure
 	for m, n := range scatterMap {
-		if n > hottestKeyMatchNum {
-			hottestKeyMatchNum = n
+		if n+excludedNum-excludedMap[m] > hottestKeyMatchNum {
+			hottestKeyMatchNum = n + excludedNum - excludedMap[m]
 			maxMeasure = m
 		}
 	}
@@ -194,3 +215,17 @@ func getDiscreteDimSegmentsDecrease(segments []*Segment, dimName interface{}) (i
 
 	return len(segments) - hottestKeyMatchNum, maxMeasure
 }
+
+// uniqueDiscreteKeys returns the distinct hash keys of the measures.
+func uniqueDiscreteKeys(measures []Measure) []Measure {
+	var keys []Measure
+	var seen = make(map[Measure]bool)
+	for _, m := range measures {
+		m = discreteKey(m)
+		if seen[m] == false {
+			seen[m] = true
+			keys = append(keys, m)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,220 @@
+package go_kd_segment_tree
+
+import (
+	"unsafe"
+)
+
+// Rough sizes used by the memory estimate of TreeStats.
+const (
+	statsPointerBytes   = 8
+	statsInterfaceBytes = 16
+	statsSliceBytes     = 24
+	statsMapEntryBytes  = 48
+	statsSetBytes       = 64
+)
+
+// TreeStats describes the shape of a built tree.
+type TreeStats struct {
+	LeafNodes        int
+	BinaryNodes      int
+	HashNodes        int
+	ConjunctionNodes int
+
+	// MaxDepth is the level of the deepest node, the root being at level 1.
+	MaxDepth int
+	// DepthHistogram counts the leaf and conjunction nodes by level.
+	DepthHistogram map[int]int
+	// LeafSizeHistogram counts the leaf nodes by number of segments.
+	LeafSizeHistogram map[int]int
+	MaxLeafSize       int
+
+	// DimSplits counts the binary and hash nodes splitting on each dim.
+	DimSplits map[interface{}]int
+
+	// Segments is the number of distinct segments of the index and
+	// SegmentCopies the number of times leaf and conjunction nodes hold them:
+	// a segment crossing the mid of a binary node or listed by several hash
+	// children is held more than once. DuplicationFactor is their ratio. The
+	// segments a leaf merges for their same id and rect count apart.
+	Segments          int
+	SegmentCopies     int
+	DuplicationFactor float64
+
+	Conjunctions []ConjunctionStats
+
+	// InsertedSegments is the number of segments inserted since the root was
+	// built, and InsertDebt their share of the segments it was built with.
+	InsertedSegments int
+	InsertDebt       float64
+
+	// EstimatedBytes roughly estimates the memory held by the nodes and the
+	// segments, payloads excluded.
+	EstimatedBytes int64
+}
+
+// ConjunctionStats describes the inverted lists of a conjunction node.
+type ConjunctionStats struct {
+	Level    int
+	Segments int
+	// Lists is the number of inverted lists, Entries their total size and
+	// MaxList the size of the longest one.
+	Lists   int
+	Entries int
+	MaxList int
+}
+
+// Stats walks the latest built index and returns its statistics.
+func (tree *TypedTree[T]) Stats() *TreeStats {
+	s := &treeStats[T]{
+		stats: &TreeStats{
+			DepthHistogram:    make(map[int]int),
+			LeafSizeHistogram: make(map[int]int),
+			DimSplits:         make(map[interface{}]int),
+		},
+		segments: make(map[*TypedSegment[T]]bool),
+		indexes:  make(map[int]bool),
+	}
+	root := tree.snapshot()
+	s.walk(root, 1)
+
+	stats := s.stats
+	debt := nodeDebt(root)
+	stats.InsertedSegments = debt.inserted
+	if debt.built > 0 {
+		stats.InsertDebt = float64(debt.inserted) / float64(debt.built)
+	}
+	stats.Segments = len(s.indexes)
+	if stats.Segments > 0 {
+		stats.DuplicationFactor = float64(stats.SegmentCopies) / float64(stats.Segments)
+	}
+	for seg := range s.segments {
+		stats.EstimatedBytes += segmentBytes(seg)
+	}
+	return stats
+}
+
+type treeStats[T comparable] struct {
+	stats    *TreeStats
+	segments map[*TypedSegment[T]]bool
+
+	// indexes identifies the segments, the copies made by removals sharing
+	// their index
+	indexes map[int]bool
+}
+
+func (s *treeStats[T]) addSegments(segments []*TypedSegment[T]) {
+	for _, seg := range segments {
+		s.segments[seg] = true
+		for _, source := range seg.sources() {
+			s.stats.SegmentCopies++
+			s.indexes[source.index] = true
+		}
+	}
+}
+
+func (s *treeStats[T]) walk(node TypedTreeNode[T], level int) {
+	stats := s.stats
+	switch node := node.(type) {
+	case *TypedLeafNode[T]:
+		if node == nil {
+			return
+		}
+		stats.LeafNodes++
+		stats.DepthHistogram[level]++
+		stats.LeafSizeHistogram[len(node.Segments)]++
+		if len(node.Segments) > stats.MaxLeafSize {
+			stats.MaxLeafSize = len(node.Segments)
+		}
+		s.addSegments(node.Segments)
+		stats.EstimatedBytes += int64(unsafe.Sizeof(*node)) + int64(statsPointerBytes*len(node.Segments))
+	case *TypedBinaryNode[T]:
+		if node == nil {
+			return
+		}
+		stats.BinaryNodes++
+		stats.DimSplits[node.DimName]++
+		stats.EstimatedBytes += int64(unsafe.Sizeof(*node))
+		s.walk(node.Left, level+1)
+		s.walk(node.Right, level+1)
+		s.walk(node.Pass, level+1)
+	case *TypedHashNode[T]:
+		if node == nil {
+			return
+		}
+		stats.HashNodes++
+		stats.DimSplits[node.DimName]++
+		stats.EstimatedBytes += int64(unsafe.Sizeof(*node)) + int64(statsMapEntryBytes*len(node.child))
+		for _, child := range node.child {
+			s.walk(child, level+1)
+		}
+		s.walk(node.pass, level+1)
+		s.walk(node.other, level+1)
+	case *TypedConjunctionNode[T]:
+		if node == nil {
+			return
+		}
+		stats.ConjunctionNodes++
+		stats.DepthHistogram[level]++
+		s.addSegments(node.segments)
+		stats.EstimatedBytes += int64(unsafe.Sizeof(*node)) +
+			int64(statsPointerBytes*(len(node.segments)+len(node.unconstrained)))
+
+		conjunction := ConjunctionStats{Level: level, Segments: len(node.segments)}
+		addList := func(list []int) {
+			conjunction.Lists++
+			conjunction.Entries += len(list)
+			if len(list) > conjunction.MaxList {
+				conjunction.MaxList = len(list)
+			}
+			stats.EstimatedBytes += int64(statsSliceBytes + statsPointerBytes*len(list))
+		}
+		for _, dim := range node.dims {
+			switch dimNode := dim.node.(type) {
+			case *ConjunctionDimRealNode:
+				stats.EstimatedBytes += int64(statsMapEntryBytes + statsInterfaceBytes*len(dimNode.splitPoints))
+				for _, list := range dimNode.segments {
+					addList(list)
+				}
+			case *ConjunctionDimDiscreteNode:
+				stats.EstimatedBytes += int64(statsMapEntryBytes *
+					(1 + len(dimNode.segments) + len(dimNode.excludedBy)))
+				for _, list := range dimNode.segments {
+					addList(list)
+				}
+				for _, list := range dimNode.excludedBy {
+					addList(list)
+				}
+				if len(dimNode.excluded) > 0 {
+					addList(dimNode.excluded)
+				}
+			}
+		}
+		stats.Conjunctions = append(stats.Conjunctions, conjunction)
+	default:
+		return
+	}
+
+	if level > stats.MaxDepth {
+		stats.MaxDepth = level
+	}
+}
+
+// segmentBytes roughly estimates the memory held by a segment and its rect.
+func segmentBytes[T comparable](seg *TypedSegment[T]) int64 {
+	bytes := int64(unsafe.Sizeof(*seg)) + int64(len(seg.ID)) + statsSetBytes
+	if seg.Data != nil {
+		bytes += int64(statsInterfaceBytes * seg.Data.Cardinality())
+	}
+	for _, d := range seg.Rect {
+		bytes += statsMapEntryBytes
+		switch d := d.(type) {
+		case Interval:
+			bytes += 2 * statsInterfaceBytes
+		case Measures:
+			bytes += int64(statsSliceBytes + statsInterfaceBytes*len(d))
+		case ExcludedMeasures:
+			bytes += int64(statsSliceBytes + statsInterfaceBytes*len(d))
+		}
+	}
+	return bytes
+}
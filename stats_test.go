@@ -0,0 +1,101 @@
+package go_kd_segment_tree
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestTree_Stats(t *testing.T) {
+	if stats := NewTree(DimTypes{}, nil).Stats(); stats.LeafNodes != 0 || stats.Segments != 0 || stats.EstimatedBytes != 0 {
+		t.Fatal("empty tree stats error:", stats)
+	}
+
+	rnd := rand.New(rand.NewSource(14))
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "age": DimTypeReal}
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+	} {
+		tree := NewTypedTree[int](dimTypes, opts)
+		for i := 0; i < 300; i++ {
+			from := rnd.Intn(100)
+			_ = tree.Add(Rect{
+				"country": Measures{MeasureString(fmt.Sprint("c", rnd.Intn(5))), MeasureString(fmt.Sprint("c", rnd.Intn(5)))},
+				"age":     Interval{MeasureInt(from), MeasureInt(from + rnd.Intn(30))},
+			}, i)
+		}
+		tree.Build()
+
+		stats := tree.Stats()
+		if stats.Segments != 300 || stats.SegmentCopies < stats.Segments || stats.DuplicationFactor < 1 {
+			t.Fatal("segment stats error:", stats)
+		}
+		if stats.LeafNodes+stats.ConjunctionNodes == 0 || stats.EstimatedBytes <= 0 {
+			t.Fatal("node stats error:", stats)
+		}
+
+		leaves, leafSegments, terminals, splits := 0, 0, 0, 0
+		for size, count := range stats.LeafSizeHistogram {
+			leaves += count
+			leafSegments += size * count
+			if size > stats.MaxLeafSize {
+				t.Fatal("max leaf size error:", stats)
+			}
+		}
+		for depth, count := range stats.DepthHistogram {
+			terminals += count
+			if depth > stats.MaxDepth {
+				t.Fatal("max depth error:", stats)
+			}
+		}
+		for _, count := range stats.DimSplits {
+			splits += count
+		}
+		conjunctionSegments := 0
+		for _, conjunction := range stats.Conjunctions {
+			conjunctionSegments += conjunction.Segments
+			if conjunction.Lists == 0 || conjunction.Entries < conjunction.MaxList {
+				t.Fatal("conjunction stats error:", conjunction)
+			}
+		}
+		if leaves != stats.LeafNodes || terminals != stats.LeafNodes+stats.ConjunctionNodes ||
+			splits != stats.BinaryNodes+stats.HashNodes || len(stats.Conjunctions) != stats.ConjunctionNodes ||
+			leafSegments+conjunctionSegments > stats.SegmentCopies {
+			t.Fatal("stats totals error:", stats)
+		}
+		if opts.ConjunctionTargetRateMin > 0 && stats.ConjunctionNodes == 0 {
+			t.Fatal("no conjunction node:", stats)
+		}
+	}
+
+	// a rect with two payloads merged in each of the hash children it is
+	// listed by is held twice
+	tree := NewTypedTree[int](dimTypes, &TreeOptions{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.1})
+	for i := 0; i < 2; i++ {
+		_ = tree.Add(Rect{"country": Measures{MeasureString("a"), MeasureString("b")}}, i)
+		_ = tree.Add(Rect{"country": Measures{MeasureString(fmt.Sprint("c", i))}}, 10+i)
+	}
+	tree.Build()
+	stats := tree.Stats()
+	if stats.HashNodes != 1 || stats.Segments != 4 || stats.SegmentCopies != 6 {
+		t.Fatal("merged segment stats error:", tree.Dumps(), stats)
+	}
+	_ = tree.Insert(Rect{"country": Measures{MeasureString("a")}}, 20)
+	tree.Remove(0)
+	if stats := tree.Stats(); stats.Segments != 4 || stats.SegmentCopies != 5 {
+		t.Fatal("merged segment stats after updates error:", stats)
+	}
+
+	// dims no rect constrains have no inverted lists
+	tree = NewTypedTree[int](DimTypes{"country": DimTypeDiscrete, "age": DimTypeReal, "os": DimTypeDiscrete},
+		&TreeOptions{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0})
+	for i := 0; i < 20; i++ {
+		_ = tree.Add(Rect{"country": Measures{MeasureString(fmt.Sprint("c", i%3))}}, i)
+	}
+	tree.Build()
+	stats = tree.Stats()
+	if stats.ConjunctionNodes != 1 || len(stats.Conjunctions) != 1 || stats.Conjunctions[0].Lists != 3 {
+		t.Fatal("unconstrained dim stats error:", stats)
+	}
+}
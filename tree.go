@@ -3,8 +3,10 @@ package go_kd_segment_tree
 import (
 	"errors"
 	"fmt"
-	mapset "github.com/deckarep/golang-set"
+	mapset "github.com/deckarep/golang-set/v2"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 )
 
 const DefaultTreeLevelMax = 16
@@ -17,26 +19,74 @@ type DimTypes map[interface{}]DimType
 var DimTypeDiscrete = DimType{Type: 0}
 var DimTypeReal = DimType{Type: 1}
 
-type Tree struct {
-	mu       sync.RWMutex
+// Tree is the untyped tree kept for compatibility with interface{} payloads.
+type Tree = TypedTree[interface{}]
+
+// TypedTree indexes rects carrying payloads of type T; searches return []T.
+//
+// Searches never block: they run against an immutable snapshot of the node
+// graph, while Build and Insert publish a new snapshot atomically once it is
+// complete. Snapshots already in use by searches stay valid.
+type TypedTree[T comparable] struct {
 	updateMu sync.Mutex
 
 	dimTypes map[interface{}]DimType
+	schema   *Schema
 
 	options *TreeOptions
 
-	segments []*Segment
-	root     TreeNode
+	segments []*TypedSegment[T]
+	root     atomic.Pointer[treeSnapshot[T]]
+
+	// lastSegmentIndex is the last internal segment index assigned
+	lastSegmentIndex int
+	indexMu          sync.Mutex
+
+	// buildWorkers holds a token per goroutine building nodes besides the
+	// caller of Build, nil for a sequential build
+	buildWorkers chan struct{}
+}
+
+type treeSnapshot[T comparable] struct {
+	root TypedTreeNode[T]
 }
 
 type TreeOptions struct {
 	TreeLevelMax                int
-	LeafNodeDataMax                 int
+	LeafNodeDataMax             int
 	BranchingDecreasePercentMin float64
 	ConjunctionTargetRateMin    float64
+
+	// BuildWorkers is the number of goroutines building sibling subtrees and
+	// evaluating the branching dims concurrently; 0 or 1 builds sequentially.
+	BuildWorkers int
+
+	// Seed makes Build reproducible: the ties between segments are broken by
+	// values derived from it and the order the segments were added in; 0
+	// draws them from math/rand.
+	Seed int64
+
+	// TrafficSample is a sample of the searched points. When set, Build picks
+	// the splits minimizing the number of segments they examine on average
+	// instead of the ones removing the most segments from a branch. Save does
+	// not keep it.
+	TrafficSample []Point
+
+	// RebuildInsertRate rebuilds a subtree on insert once the segments
+	// inserted into it since it was built exceed this share of the segments
+	// it was built with; 0 never rebuilds. Only the root keeps using
+	// TrafficSample when rebuilt.
+	RebuildInsertRate float64
+	// RebuildInsertMin is the number of inserted segments below which a
+	// subtree is not rebuilt, LeafNodeDataMax when 0.
+	RebuildInsertMin int
 }
 
 func NewTree(dimTypes map[interface{}]DimType, opts *TreeOptions) *Tree {
+	return NewTypedTree[interface{}](dimTypes, opts)
+}
+
+func NewTypedTree[T comparable](dimTypes map[interface{}]DimType, opts *TreeOptions) *TypedTree[T] {
 	if opts == nil {
 		opts = &TreeOptions{}
 	}
@@ -53,64 +103,111 @@ func NewTree(dimTypes map[interface{}]DimType, opts *TreeOptions) *Tree {
 		opts.BranchingDecreasePercentMin = DefaultBranchDecreasePercentMin
 	}
 
-	return &Tree{
+	if opts.RebuildInsertMin == 0 {
+		opts.RebuildInsertMin = opts.LeafNodeDataMax
+	}
+
+	tree := &TypedTree[T]{
 		dimTypes: dimTypes,
+		schema:   NewSchema(dimTypes),
 		options:  opts,
 	}
+	if opts.BuildWorkers > 1 {
+		tree.buildWorkers = make(chan struct{}, opts.BuildWorkers-1)
+	}
+	return tree
+}
+
+// Schema returns the schema encoding the points searched in the tree.
+func (tree *TypedTree[T]) Schema() *Schema {
+	return tree.schema
 }
 
-func (tree *Tree) Search(p Point) []interface{} {
-	tree.mu.RLock()
-	defer tree.mu.RUnlock()
+// indexSegments assigns an internal index to the segments without one and
+// encodes their rect. The caller holds updateMu; a parallel build also calls it
+// from its workers.
+func (tree *TypedTree[T]) indexSegments(segments []*TypedSegment[T]) {
+	tree.indexMu.Lock()
+	defer tree.indexMu.Unlock()
+
+	for _, seg := range segments {
+		if seg.index == 0 {
+			tree.lastSegmentIndex++
+			seg.index = tree.lastSegmentIndex
+			seg.dims, seg.encoded = tree.schema.encodeRect(seg.Rect)
+		}
+	}
+}
 
-	if tree.root == nil {
+// goBuild runs f on a build worker when one is free and on the calling
+// goroutine otherwise, so that nested builds never wait for a worker.
+func (tree *TypedTree[T]) goBuild(wg *sync.WaitGroup, f func()) {
+	select {
+	case tree.buildWorkers <- struct{}{}:
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-tree.buildWorkers }()
+			f()
+		}()
+	default:
+		f()
+	}
+}
+
+// snapshot returns the root of the latest published node graph.
+func (tree *TypedTree[T]) snapshot() TypedTreeNode[T] {
+	if snapshot := tree.root.Load(); snapshot != nil {
+		return snapshot.root
+	}
+	return nil
+}
+
+func (tree *TypedTree[T]) Search(p Point) []T {
+	root := tree.snapshot()
+	if root == nil {
 		return nil
 	}
-	return tree.root.Search(p)
+	return root.SearchEncoded(tree.schema.Encode(p))
 }
 
-func (tree *Tree) SearchRect(r Rect) ([]interface{}, error) {
-	tree.mu.RLock()
-	defer tree.mu.RUnlock()
+// SearchEncoded is Search for a point encoded once by the schema of the tree.
+func (tree *TypedTree[T]) SearchEncoded(p *EncodedPoint) []T {
+	root := tree.snapshot()
+	if root == nil {
+		return nil
+	}
+	if p.schema != tree.schema {
+		p = tree.schema.Encode(p.point)
+	}
+	return root.SearchEncoded(p)
+}
 
-	if tree.root == nil {
+func (tree *TypedTree[T]) SearchRect(r Rect) ([]T, error) {
+	root := tree.snapshot()
+	if root == nil {
 		return nil, nil
 	}
 
-	for name, d := range r {
-		if d == nil {
-			delete(r, name)
-			continue
-		}
-
-		switch d.(type) {
-		case Interval:
-			if tree.dimTypes[name] != DimTypeReal {
-				return nil, errors.New(fmt.Sprintf("dim type error:%v", name))
-			}
-		case Measures:
-			if tree.dimTypes[name] != DimTypeDiscrete {
-				return nil, errors.New(fmt.Sprintf("dim type error:%v", name))
-			}
-		default:
-			return  nil, errors.New(fmt.Sprintf("not support rect type:%v", name))
-		}
+	if err := tree.checkRect(r); err != nil {
+		return nil, err
 	}
 
-	return tree.root.SearchRect(r), nil
+	return root.SearchRect(r), nil
 }
 
-func (tree *Tree) Dumps() string {
-	tree.mu.RLock()
-	defer tree.mu.RUnlock()
+func (tree *TypedTree[T]) Dumps() string {
+	root := tree.snapshot()
+	if root == nil {
+		return ""
+	}
 
-	return fmt.Sprintf("%v", tree.root.Dumps(""))
+	return fmt.Sprintf("%v", root.Dumps(""))
 }
 
-func (tree *Tree) Add(rect Rect, data interface{}) error {
-	tree.updateMu.Lock()
-	defer tree.updateMu.Unlock()
-
+// checkRect drops the nil dims of the rect and checks the others against the
+// dim types of the tree.
+func (tree *TypedTree[T]) checkRect(rect Rect) error {
 	for name, d := range rect {
 		if d == nil {
 			delete(rect, name)
@@ -122,77 +219,193 @@ func (tree *Tree) Add(rect Rect, data interface{}) error {
 			if tree.dimTypes[name] != DimTypeReal {
 				return errors.New(fmt.Sprintf("dim type error:%v", name))
 			}
-		case Measures:
+		case Measures, ExcludedMeasures:
 			if tree.dimTypes[name] != DimTypeDiscrete {
 				return errors.New(fmt.Sprintf("dim type error:%v", name))
 			}
 		default:
-			return  errors.New(fmt.Sprintf("not support rect type:%v", name))
+			return errors.New(fmt.Sprintf("not support rect type:%v", name))
 		}
 	}
+	return nil
+}
+
+func (tree *TypedTree[T]) Add(rect Rect, data T) error {
+	tree.updateMu.Lock()
+	defer tree.updateMu.Unlock()
+
+	if err := tree.checkRect(rect); err != nil {
+		return err
+	}
 
-	seg := &Segment{
+	seg := &TypedSegment[T]{
 		Rect: rect.Clone(),
-		Data: mapset.NewSet(data),
+		Data: mapset.NewSet[T](data),
 	}
+	tree.indexSegments([]*TypedSegment[T]{seg})
 
 	tree.segments = append(tree.segments, seg)
 	return nil
 }
 
-func (tree *Tree) Insert(rect Rect, data interface{}) error {
+// Insert adds the rect and makes it searchable at once. The first insert into
+// an empty or unbuilt tree builds a root with the pending segments; a rect the
+// index rejects is not kept pending either.
+func (tree *TypedTree[T]) Insert(rect Rect, data T) error {
 	tree.updateMu.Lock()
 	defer tree.updateMu.Unlock()
 
-	for name, d := range rect {
-		if d == nil {
-			delete(rect, name)
-			continue
+	if err := tree.checkRect(rect); err != nil {
+		return err
+	}
+
+	seg := &TypedSegment[T]{
+		Rect: rect.Clone(),
+		Data: mapset.NewSet[T](data),
+	}
+	tree.indexSegments([]*TypedSegment[T]{seg})
+
+	// an empty or unbuilt tree gets a root built with the pending segments
+	root := tree.snapshot()
+	if root == nil {
+		segments := append(append([]*TypedSegment[T]{}, tree.segments...), seg)
+		tree.segments = append(tree.segments, seg)
+		tree.root.Store(&treeSnapshot[T]{root: tree.buildSubtree(segments, 1)})
+		return nil
+	}
+
+	newRoot, err := root.Insert(seg)
+	if err != nil {
+		return errors.New(fmt.Sprintf("insert error: %v", err))
+	}
+	newRoot = tree.rebuildDegraded(newRoot, 1)
+
+	tree.segments = append(tree.segments, seg)
+	tree.root.Store(&treeSnapshot[T]{root: newRoot})
+	return nil
+}
+
+// Upsert sets the rect and data of the segment with the stable id, replacing
+// the previous version both in the pending segments and in the built index.
+func (tree *TypedTree[T]) Upsert(id string, rect Rect, data T) error {
+	return tree.UpsertRule(id, []Rect{rect}, data)
+}
+
+// UpsertRule sets a disjunctive rule: data is searched for every point in any
+// of the rects. The rects share the stable id, replacing its previous version,
+// and are removed, deleted and reported together. A rule needs at least one
+// rect; Delete removes one.
+func (tree *TypedTree[T]) UpsertRule(id string, rects []Rect, data T) error {
+	if len(rects) == 0 {
+		return errors.New(fmt.Sprintf("rule without rects:%v", id))
+	}
+
+	tree.updateMu.Lock()
+	defer tree.updateMu.Unlock()
+
+	var segs []*TypedSegment[T]
+	for _, rect := range rects {
+		if err := tree.checkRect(rect); err != nil {
+			return err
 		}
 
-		switch d.(type) {
-		case Interval:
-			if tree.dimTypes[name] != DimTypeReal {
-				return errors.New(fmt.Sprintf("dim type error:%v", name))
-			}
-		case Measures:
-			if tree.dimTypes[name] != DimTypeDiscrete {
-				return errors.New(fmt.Sprintf("dim type error:%v", name))
+		segs = append(segs, &TypedSegment[T]{
+			ID:   id,
+			Rect: rect.Clone(),
+			Data: mapset.NewSet[T](data),
+		})
+	}
+
+	tree.indexSegments(segs)
+
+	// a built tree emptied by removals still indexes the rule
+	root := tree.snapshot()
+	built := tree.root.Load() != nil
+	if built {
+		if root != nil {
+			root = root.Delete(id)
+		}
+		for _, seg := range segs {
+			var err error
+			if root, err = insertNode(root, seg); err != nil {
+				return errors.New(fmt.Sprintf("upsert rule error: %v", err))
 			}
-		default:
-			return  errors.New(fmt.Sprintf("not support rect type:%v", name))
+			root = tree.rebuildDegraded(root, 1)
 		}
 	}
 
-	seg := &Segment{
-		Rect: rect.Clone(),
-		Data: mapset.NewSet(data),
+	tree.segments, _ = deleteSegments(tree.segments, id)
+	tree.segments = append(tree.segments, segs...)
+	if built {
+		tree.root.Store(&treeSnapshot[T]{root: root})
 	}
+	return nil
+}
 
-	tree.segments = append(tree.segments, seg)
-	return tree.root.Insert(seg)
+// Get returns a copy of the segment with the stable id, the first rect of a
+// rule with several of them.
+func (tree *TypedTree[T]) Get(id string) (*TypedSegment[T], bool) {
+	tree.updateMu.Lock()
+	defer tree.updateMu.Unlock()
+
+	for _, seg := range tree.segments {
+		if seg.ID == id {
+			return seg.Clone(), true
+		}
+	}
+	return nil, false
 }
 
-func (tree *Tree) Remove(data interface{}) {
+// GetRule returns copies of all the segments of the rule with the stable id.
+func (tree *TypedTree[T]) GetRule(id string) ([]*TypedSegment[T], bool) {
 	tree.updateMu.Lock()
 	defer tree.updateMu.Unlock()
 
-	var newSegments []*Segment
+	var segs []*TypedSegment[T]
 	for _, seg := range tree.segments {
-		if seg.Data.Contains(data) {
-			seg.Data.Remove(data)
-			if len(seg.Data.ToSlice()) > 0 {
-				newSegments = append(newSegments, seg)
-			}
-		} else {
-			newSegments = append(newSegments, seg)
+		if seg.ID == id {
+			segs = append(segs, seg.Clone())
 		}
 	}
+	return segs, len(segs) > 0
+}
+
+// Delete removes the segment with the stable id from the pending segments and
+// from the built index, and reports whether it existed.
+func (tree *TypedTree[T]) Delete(id string) bool {
+	tree.updateMu.Lock()
+	defer tree.updateMu.Unlock()
+
+	var found bool
+	tree.segments, found = deleteSegments(tree.segments, id)
+
+	if root := tree.snapshot(); root != nil {
+		if newRoot := root.Delete(id); newRoot != root {
+			tree.root.Store(&treeSnapshot[T]{root: newRoot})
+		}
+	}
+	return found
+}
+
+// Remove removes data from the pending segments and from the built index, so
+// the next search does not return it anymore.
+func (tree *TypedTree[T]) Remove(data T) {
+	tree.updateMu.Lock()
+	defer tree.updateMu.Unlock()
+
+	tree.segments, _ = removeSegmentsData(tree.segments, data)
+
+	root := tree.snapshot()
+	if root == nil {
+		return
+	}
 
-	tree.segments = newSegments
+	if newRoot := root.Remove(data); newRoot != root {
+		tree.root.Store(&treeSnapshot[T]{root: newRoot})
+	}
 }
 
-func (tree *Tree) Build() {
+func (tree *TypedTree[T]) Build() {
 	tree.updateMu.Lock()
 	defer tree.updateMu.Unlock()
 
@@ -200,9 +413,31 @@ func (tree *Tree) Build() {
 		return
 	}
 
-	newNode := NewNode(tree.segments, tree, 1)
+	// the tie-breakers are drawn before building, so that the workers of a
+	// parallel build only read the segments
+	for _, seg := range tree.segments {
+		if seg.rnd == 0 {
+			seg.rnd = tree.tieBreaker(seg)
+		}
+	}
+
+	// building sorts the segments, keep their order
+	segments := append([]*TypedSegment[T]{}, tree.segments...)
+	newNode := NewNode(segments, tree, 1)
+
+	tree.root.Store(&treeSnapshot[T]{root: newNode})
+}
+
+// tieBreaker returns the tie-breaker of the segment in (0, 1], derived from the
+// seed and the segment index by splitmix64 when the tree has a seed.
+func (tree *TypedTree[T]) tieBreaker(seg *TypedSegment[T]) float64 {
+	if tree.options.Seed == 0 {
+		return rand.Float64()
+	}
 
-	tree.mu.Lock()
-	tree.root = newNode
-	tree.mu.Unlock()
+	x := uint64(tree.options.Seed) + uint64(seg.index)*0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return float64(x>>11+1) / (1 << 53)
 }
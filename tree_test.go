@@ -2,9 +2,12 @@ package go_kd_segment_tree
 
 import (
 	"fmt"
+	mapset "github.com/deckarep/golang-set/v2"
 	"log"
 	"math/rand"
+	"sort"
 	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -70,7 +73,7 @@ func init() {
 
 	tree = NewTree(dimType, &TreeOptions{
 		TreeLevelMax:                16,
-		LeafNodeDataMax:                 4,
+		LeafNodeDataMax:             4,
 		BranchingDecreasePercentMin: 0.1,
 	})
 	for i, rect := range testRects {
@@ -98,7 +101,7 @@ func TestNewTree(t *testing.T) {
 
 	tree := NewTree(dimType, &TreeOptions{
 		TreeLevelMax:                16,
-		LeafNodeDataMax:                 16,
+		LeafNodeDataMax:             16,
 		BranchingDecreasePercentMin: 0.1,
 	})
 	for i, rect := range testRects[:testSize] {
@@ -128,7 +131,7 @@ func TestNewTree(t *testing.T) {
 		"Field2": DimTypeReal,
 	}, &TreeOptions{
 		TreeLevelMax:                16,
-		LeafNodeDataMax:                 4,
+		LeafNodeDataMax:             4,
 		BranchingDecreasePercentMin: 0.1,
 	})
 
@@ -149,12 +152,46 @@ func TestNewTree(t *testing.T) {
 }
 
 func BenchmarkTree_Search(b *testing.B) {
+	b.Run("tree", func(b *testing.B) {
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			p := searchPoint[i%len(searchPoint)]
+			_ = tree.Search(p)
+		}
+	})
+
+	b.Run("searcher", func(b *testing.B) {
+		searcher := tree.NewSearcher()
+		allocs := testing.AllocsPerRun(10, func() {
+			for _, p := range searchPoint {
+				_ = searcher.Search(p)
+			}
+		})
+		if allocs > 0 {
+			b.Fatal("searcher allocs error:", allocs)
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			p := searchPoint[i%len(searchPoint)]
+			_ = searcher.Search(p)
+		}
+	})
+}
+
+func BenchmarkTree_SearchFunc(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
 
 	for i := 0; i < b.N; i++ {
 		p := searchPoint[i%len(searchPoint)]
-		_ = tree.Search(p)
+		tree.SearchFunc(p, func(data interface{}) bool {
+			return true
+		})
 	}
 
 }
@@ -172,3 +209,492 @@ func BenchmarkNoTree_Search(b *testing.B) {
 	}
 
 }
+
+func TestTypedTree(t *testing.T) {
+	typedTree := NewTypedTree[int](DimTypes{
+		"Field1": DimTypeDiscrete,
+		"Field2": DimTypeReal,
+	}, nil)
+
+	for i := 0; i < 20; i++ {
+		err := typedTree.Add(Rect{
+			"Field1": Measures{MeasureString("one"), MeasureString(strconv.Itoa(i))},
+			"Field2": Interval{MeasureFloat(float64(i)), MeasureFloat(float64(i) + 1.5)}},
+			i)
+		if err != nil {
+			t.Fatal("node add error:", err)
+		}
+	}
+	// same rect as data 3, merged into one segment
+	_ = typedTree.Add(Rect{
+		"Field1": Measures{MeasureString("one"), MeasureString("3")},
+		"Field2": Interval{MeasureFloat(3), MeasureFloat(4.5)}},
+		100)
+	typedTree.Build()
+
+	result := typedTree.Search(Point{"Field1": MeasureString("one"), "Field2": MeasureFloat(3.2)})
+	sort.Ints(result)
+	if fmt.Sprint(result) != "[2 3 100]" {
+		t.Fatal("typed tree search error:", result)
+	}
+
+	result = typedTree.Search(Point{"Field1": MeasureString("5"), "Field2": MeasureFloat(5.2)})
+	if len(result) != 1 || result[0] != 5 {
+		t.Fatal("typed tree search error:", result)
+	}
+}
+
+func TestTree_HalfOpenIntervals(t *testing.T) {
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+	} {
+		tree := NewTypedTree[int](DimTypes{"time": DimTypeReal, "age": DimTypeReal}, opts)
+
+		var rects []Rect
+		for i := 0; i < 64; i++ {
+			// consecutive windows [i*10, i*10+10) never overlap at their borders
+			rect := Rect{"time": Interval{MeasureInt(i * 10), Exclusive{MeasureInt(i*10 + 10)}}}
+			switch i % 3 {
+			case 0:
+				rect["age"] = Interval{MeasureInt(18), nil}
+			case 1:
+				rect["age"] = Interval{nil, Exclusive{MeasureInt(18)}}
+			}
+			rects = append(rects, rect)
+			if err := tree.Add(rect, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tree.Build()
+
+		for x := -5; x < 650; x++ {
+			for _, age := range []int{0, 17, 18, 60} {
+				p := Point{"time": MeasureInt(x), "age": MeasureInt(age)}
+				var expected []int
+				for i, rect := range rects {
+					if rect.Contains(p) {
+						expected = append(expected, i)
+					}
+				}
+				result := tree.Search(p)
+				sort.Ints(result)
+				if fmt.Sprint(result) != fmt.Sprint(expected) {
+					t.Fatal("half open search error:", p, result, expected)
+				}
+				if x%10 == 0 && x < 640 && len(result) > 1 {
+					t.Fatal("border point double matched:", p, result)
+				}
+			}
+		}
+	}
+}
+
+func TestTree_ExcludedMeasures(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	countries := []Measure{MeasureString("US"), MeasureString("CN"), MeasureString("RU"),
+		MeasureString("CA"), MeasureString("JP"), MeasureString("DE")}
+
+	var rects []Rect
+	for i := 0; i < 300; i++ {
+		rect := Rect{"age": Interval{MeasureInt(rnd.Intn(50)), MeasureInt(50 + rnd.Intn(50))}}
+		switch rnd.Intn(3) {
+		case 0:
+			rect["country"] = Measures{countries[rnd.Intn(len(countries))], countries[rnd.Intn(len(countries))]}
+		case 1:
+			rect["country"] = ExcludedMeasures{countries[rnd.Intn(len(countries))], countries[rnd.Intn(len(countries))]}
+		}
+		if rnd.Intn(2) == 0 {
+			rect["os"] = ExcludedMeasures{MeasureString("ios")}
+		}
+		rects = append(rects, rect)
+	}
+
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+	} {
+		tree := NewTypedTree[int](DimTypes{"country": DimTypeDiscrete, "os": DimTypeDiscrete, "age": DimTypeReal}, opts)
+		for i, rect := range rects {
+			if err := tree.Add(rect, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tree.Build()
+
+		for _, country := range append(countries, MeasureString("FR")) {
+			for _, os := range []Measure{MeasureString("ios"), MeasureString("android")} {
+				for age := 0; age < 100; age += 7 {
+					p := Point{"country": country, "os": os, "age": MeasureInt(age)}
+					var expected []int
+					for i, rect := range rects {
+						if rect.Contains(p) {
+							expected = append(expected, i)
+						}
+					}
+					result := tree.Search(p)
+					sort.Ints(result)
+					if fmt.Sprint(result) != fmt.Sprint(expected) {
+						t.Fatal("excluded search error:", p, result, expected)
+					}
+				}
+			}
+		}
+	}
+
+	if (Rect{"country": ExcludedMeasures{MeasureString("CN")}}).Contains(Point{"country": MeasureString("CN")}) {
+		t.Fatal("excluded value should not match")
+	}
+	if !(Rect{"country": ExcludedMeasures{MeasureString("CN")}}).HasIntersect(Rect{"country": Measures{MeasureString("CN"), MeasureString("US")}}) {
+		t.Fatal("exclusion should intersect a list with an allowed value")
+	}
+	if (Rect{"country": ExcludedMeasures{MeasureString("CN"), MeasureString("US")}}).Key() !=
+		(Rect{"country": ExcludedMeasures{MeasureString("US"), MeasureString("CN")}}).Key() {
+		t.Fatal("exclusion key should not depend on order")
+	}
+}
+
+func TestTree_MeasureSet(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+
+	var rects []Rect
+	for i := 0; i < 300; i++ {
+		rect := Rect{}
+		switch rnd.Intn(3) {
+		case 0:
+			rect["tag"] = Measures{MeasureInt(rnd.Intn(20)), MeasureInt(rnd.Intn(20))}
+		case 1:
+			rect["tag"] = ExcludedMeasures{MeasureInt(rnd.Intn(20))}
+		}
+		if rnd.Intn(2) == 0 {
+			start := rnd.Intn(100)
+			rect["score"] = Interval{MeasureInt(start), Exclusive{MeasureInt(start + rnd.Intn(20))}}
+		}
+		rects = append(rects, rect)
+	}
+
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+	} {
+		tree := NewTypedTree[int](DimTypes{"tag": DimTypeDiscrete, "score": DimTypeReal}, opts)
+		for i, rect := range rects {
+			if err := tree.Add(rect, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tree.Build()
+
+		for i := 0; i < 300; i++ {
+			var tags, scores MeasureSet
+			for j := rnd.Intn(4); j >= 0; j-- {
+				tags = append(tags, MeasureInt(rnd.Intn(25)))
+			}
+			for j := rnd.Intn(3); j >= 0; j-- {
+				scores = append(scores, MeasureInt(rnd.Intn(120)))
+			}
+			p := Point{"tag": tags, "score": scores}
+
+			var expected []int
+			for i, rect := range rects {
+				if rect.Contains(p) {
+					expected = append(expected, i)
+				}
+			}
+			result := tree.Search(p)
+			sort.Ints(result)
+			if fmt.Sprint(result) != fmt.Sprint(expected) {
+				t.Fatal("measure set search error:", p, result, expected)
+			}
+		}
+	}
+}
+
+func TestTree_ConcurrentUpdate(t *testing.T) {
+	tree := NewTypedTree[int](DimTypes{"tag": DimTypeDiscrete, "score": DimTypeReal}, &TreeOptions{LeafNodeDataMax: 2})
+	rect := func(i int) Rect {
+		return Rect{
+			"tag":   Measures{MeasureInt(i % 10)},
+			"score": Interval{MeasureInt(i), MeasureInt(i + 20)},
+		}
+	}
+	for i := 0; i < 200; i++ {
+		_ = tree.Add(rect(i), i)
+	}
+	tree.Build()
+
+	p := Point{"tag": MeasureInt(3), "score": MeasureInt(250)}
+	snapshot := tree.snapshot()
+	if len(snapshot.Search(p)) != 0 {
+		t.Fatal("snapshot search error")
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_ = tree.Search(Point{"tag": MeasureInt(rnd.Intn(10)), "score": MeasureInt(rnd.Intn(450))})
+				_, _ = tree.SearchRect(Rect{"tag": Measures{MeasureInt(rnd.Intn(10))}})
+			}
+		}(int64(r))
+	}
+
+	for i := 200; i < 400; i++ {
+		if err := tree.Insert(rect(i), i); err != nil {
+			t.Fatal(err)
+		}
+		if i%7 == 0 {
+			tree.Remove(i - 150)
+		}
+		if i%50 == 0 {
+			tree.Build()
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// searches holding the old snapshot are not affected by later updates
+	if len(snapshot.Search(p)) != 0 {
+		t.Fatal("snapshot changed by insert")
+	}
+	result := tree.Search(p)
+	sort.Ints(result)
+	if fmt.Sprint(result) != "[233 243]" {
+		t.Fatal("search after insert error:", result)
+	}
+}
+
+func TestTree_Remove(t *testing.T) {
+	rnd := rand.New(rand.NewSource(3))
+
+	var rects []Rect
+	for i := 0; i < 200; i++ {
+		rect := Rect{}
+		if rnd.Intn(3) > 0 {
+			rect["tag"] = Measures{MeasureInt(rnd.Intn(10)), MeasureInt(rnd.Intn(10))}
+		}
+		if rnd.Intn(3) > 0 {
+			start := rnd.Intn(100)
+			rect["score"] = Interval{MeasureInt(start), MeasureInt(start + rnd.Intn(30))}
+		}
+		rects = append(rects, rect)
+	}
+
+	for _, opts := range []*TreeOptions{
+		{LeafNodeDataMax: 2},
+		{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0},
+	} {
+		tree := NewTypedTree[int](DimTypes{"tag": DimTypeDiscrete, "score": DimTypeReal}, opts)
+		for i, rect := range rects {
+			// every rect carries two payloads, one of them shared by ten rects
+			_ = tree.Add(rect, i)
+			_ = tree.Add(rect, 1000+i/10)
+		}
+		tree.Build()
+
+		removed := make(map[int]bool)
+		for round := 0; round < 3; round++ {
+			for i := 0; i < 80; i++ {
+				data := rnd.Intn(200)
+				if rnd.Intn(4) == 0 {
+					data = 1000 + rnd.Intn(20)
+				}
+				removed[data] = true
+				tree.Remove(data)
+			}
+
+			for i := 0; i < 200; i++ {
+				p := Point{"tag": MeasureInt(rnd.Intn(10)), "score": MeasureInt(rnd.Intn(130))}
+				var expected []int
+				for j, rect := range rects {
+					if rect.Contains(p) {
+						if removed[j] == false {
+							expected = append(expected, j)
+						}
+						if removed[1000+j/10] == false {
+							expected = append(expected, 1000+j/10)
+						}
+					}
+				}
+				expected = mapset.NewSet[int](expected...).ToSlice()
+				sort.Ints(expected)
+				result := tree.Search(p)
+				sort.Ints(result)
+				if fmt.Sprint(result) != fmt.Sprint(expected) {
+					t.Fatal("search after remove error:", p, result, expected)
+				}
+			}
+		}
+
+		for i := 0; i < 200; i++ {
+			tree.Remove(i)
+			tree.Remove(1000 + i/10)
+		}
+		if tree.snapshot() != nil {
+			t.Fatal("empty tree should have no root")
+		}
+	}
+}
+
+func TestTree_Upsert(t *testing.T) {
+	tree := NewTypedTree[string](DimTypes{"country": DimTypeDiscrete, "age": DimTypeReal}, &TreeOptions{LeafNodeDataMax: 1})
+
+	for i := 0; i < 20; i++ {
+		err := tree.Upsert(fmt.Sprint("rule", i), Rect{
+			"country": Measures{MeasureString("US")},
+			"age":     Interval{MeasureInt(i), MeasureInt(i + 10)},
+		}, fmt.Sprint("campaign", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// same rect as rule0 but a different id, kept as its own segment
+	_ = tree.Upsert("copy0", Rect{
+		"country": Measures{MeasureString("US")},
+		"age":     Interval{MeasureInt(0), MeasureInt(10)},
+	}, "campaign0")
+	tree.Build()
+
+	search := func(country string, age int) string {
+		result := tree.Search(Point{"country": MeasureString(country), "age": MeasureInt(age)})
+		sort.Strings(result)
+		return fmt.Sprint(result)
+	}
+	if search("US", 0) != "[campaign0]" {
+		t.Fatal("search error:", search("US", 0))
+	}
+
+	// retarget rule0 to CA on the built tree
+	err := tree.Upsert("rule0", Rect{"country": Measures{MeasureString("CA")}}, "campaign0-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if search("US", 0) != "[campaign0]" || search("CA", 0) != "[campaign0-ca]" {
+		t.Fatal("search after upsert error:", search("US", 0), search("CA", 0))
+	}
+
+	seg, ok := tree.Get("rule0")
+	if !ok || seg.Data.Contains("campaign0-ca") == false || seg.Rect.Key() != (Rect{"country": Measures{MeasureString("CA")}}).Key() {
+		t.Fatal("get error:", seg)
+	}
+
+	if tree.Delete("copy0") == false || tree.Delete("copy0") == true {
+		t.Fatal("delete error")
+	}
+	if search("US", 0) != "[]" || search("US", 5) != "[campaign1 campaign2 campaign3 campaign4 campaign5]" {
+		t.Fatal("search after delete error:", search("US", 0), search("US", 5))
+	}
+	if _, ok := tree.Get("copy0"); ok {
+		t.Fatal("deleted segment still found")
+	}
+
+	// the rebuilt tree agrees with the incremental updates
+	tree.Build()
+	if search("US", 0) != "[]" || search("CA", 50) != "[campaign0-ca]" {
+		t.Fatal("search after build error:", search("US", 0), search("CA", 50))
+	}
+}
+
+func TestTree_UpsertRule(t *testing.T) {
+	rnd := rand.New(rand.NewSource(12))
+	dimTypes := DimTypes{"country": DimTypeDiscrete, "age": DimTypeReal}
+
+	randomRects := func() []Rect {
+		var rects []Rect
+		for i := rnd.Intn(4); i >= 0; i-- {
+			from := rnd.Intn(50)
+			rects = append(rects, Rect{
+				"country": Measures{MeasureString(fmt.Sprint("c", rnd.Intn(4)))},
+				"age":     Interval{MeasureInt(from), MeasureInt(from + rnd.Intn(30))},
+			})
+		}
+		return rects
+	}
+
+	for _, c := range []struct {
+		opts *TreeOptions
+		live bool
+	}{
+		{&TreeOptions{LeafNodeDataMax: 2}, true},
+		{&TreeOptions{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0}, true},
+		{&TreeOptions{LeafNodeDataMax: 2, BranchingDecreasePercentMin: 0.9, ConjunctionTargetRateMin: 1.0}, false},
+	} {
+		tree := NewTypedTree[string](dimTypes, c.opts)
+		rules := make(map[string][]Rect)
+		upsert := func(i int) {
+			id := fmt.Sprint("rule", i)
+			rules[id] = randomRects()
+			if err := tree.UpsertRule(id, rules[id], id); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i := 0; i < 100; i++ {
+			upsert(i)
+		}
+		if c.live {
+			tree.Build()
+		}
+		for i := 0; i < 100; i += 7 {
+			upsert(i)
+		}
+		if tree.Delete("rule1") == false {
+			t.Fatal("delete rule error")
+		}
+		delete(rules, "rule1")
+		tree.Remove("rule2")
+		delete(rules, "rule2")
+		if c.live == false {
+			tree.Build()
+		}
+
+		if segs, ok := tree.GetRule("rule7"); !ok || len(segs) != len(rules["rule7"]) {
+			t.Fatal("get rule error:", segs)
+		}
+		if _, ok := tree.GetRule("rule1"); ok {
+			t.Fatal("deleted rule still found")
+		}
+		if err := tree.UpsertRule("rule7", nil, "rule7"); err == nil {
+			t.Fatal("upsert of a rule without rects error")
+		}
+
+		for i := 0; i < 500; i++ {
+			p := Point{"country": MeasureString(fmt.Sprint("c", rnd.Intn(4))), "age": MeasureInt(rnd.Intn(80))}
+
+			var expected []string
+			for id, rects := range rules {
+				for _, rect := range rects {
+					if rect.Contains(p) {
+						expected = append(expected, id)
+						break
+					}
+				}
+			}
+			result := tree.Search(p)
+			sort.Strings(expected)
+			sort.Strings(result)
+			if fmt.Sprint(result) != fmt.Sprint(expected) {
+				t.Fatal("rule search error:", p, result, expected)
+			}
+		}
+	}
+
+	// identical rects of different rules are never merged together
+	segs := MergeSegments([]*Segment{
+		{ID: "a", Rect: Rect{"age": Interval{MeasureInt(1), MeasureInt(2)}}, Data: mapset.NewSet[interface{}]("a")},
+		{ID: "a", Rect: Rect{"age": Interval{MeasureInt(1), MeasureInt(2)}}, Data: mapset.NewSet[interface{}]("a")},
+		{ID: "b", Rect: Rect{"age": Interval{MeasureInt(1), MeasureInt(2)}}, Data: mapset.NewSet[interface{}]("b")},
+	})
+	if len(segs) != 2 || segs[0].ID != "a" || segs[1].ID != "b" {
+		t.Fatal("merge rule segments error:", segs)
+	}
+}